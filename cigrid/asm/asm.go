@@ -2,132 +2,352 @@ package asm
 
 import "cigrid/ir"
 import "cigrid/ir_translator"
+import "cigrid/diag"
+import "math"
 import "strconv"
+import "strings"
 
-func address(addressMap map[string]int, reg interface{}) (string, bool) {
-	if temp, ok := reg.(int); ok {
-		// int type, refers to a temporary register
-		return "qword [rsp + " + 
-			strconv.Itoa((temp + len(addressMap)) * 8) + "]", true
-	} else if temp, ok := reg.(string); ok {
-		// string type
-		if value, ok := addressMap[temp]; ok {
-			// if variable name
-			return "qword [rsp + " + strconv.Itoa(value * 8) + "]", true
-		} else if temp[0] == 91 && temp[len(temp) - 1] == 93 {
-			// like [r10]
-			return temp, true
-		} else {
-			// if existing register, like rax, rdi
-			return temp, false
+// address returns the NASM operand of reg and whether it is in memory.
+// Slots are addressed from rbp, so pushes do not move them. Variables
+// take the frameSize slots right below rbp, with slot 0 lowest so that
+// arrays grow upwards; temp registers follow below them.
+//   [rbp - 8 * frameSize]                   slot 0
+//   [rbp - 8 * (frameSize + 1 + temp)]      temp
+func address(addressMap map[string]int, frameSize int, reg ir.Operand) (string, bool) {
+	switch op := reg.(type) {
+	case ir.Temp:
+		return "qword [rbp - " + 
+			strconv.Itoa((int(op) + frameSize + 1) * 8) + "]", true
+	case ir.Var:
+		return "qword [rbp - " + 
+			strconv.Itoa((frameSize - addressMap[string(op)]) * 8) + "]", true
+	case ir.Imm:
+		return strconv.FormatInt(int64(op), 10), false
+	case ir.PhysReg:
+		return string(op), false
+	case ir.Global:
+		// the address of the label, an immediate only where the code is
+		// not position independent; see source
+		return string(op), false
+	case ir.Mem:
+		// like [rbp + 16] or [rel g_x]
+		base := ""
+		if g, ok := op.Base.(ir.Global); ok {
+			base = "rel " + string(g)
+		} else if r, ok := op.Base.(ir.PhysReg); ok {
+			base = string(r)
+		}
+		if op.Offset > 0 {
+			base += " + " + strconv.Itoa(op.Offset)
+		} else if op.Offset < 0 {
+			base += " - " + strconv.Itoa(-op.Offset)
 		}
+		return "qword [" + base + "]", true
 	}
 	return "", false
 }
 
-func generateSingleAsm(i *ir_translator.IrFunction) []string {
+// unsupported reports an IR instruction the backend cannot lower. The IR
+// keeps no spans per instruction, so it points at the function.
+func unsupported(diags *diag.List, i *ir_translator.IrFunction,
+				 v ir.IntermediateRepresentation) {
+	diags.Errorf(diag.UnsupportedInstruction, i.ReadSpan(),
+		"cannot generate assembly for `%s` in function `%s`", v.IrString(), i.ReadName())
+}
+
+// calleeSaved are the registers a function has to preserve for its
+// caller in the System V AMD64 ABI, besides rbp which holds the frame
+var calleeSaved = []string{"rbx", "r12", "r13", "r14", "r15"}
+
+// usedCalleeSaved returns the callee-saved registers the IR refers to,
+// either directly or as the base of a memory operand like [r12 + 8]
+func usedCalleeSaved(irList []ir.IntermediateRepresentation) []string {
+	used := map[string]bool{}
+	for _, v := range irList {
+		for _, r := range ir.Registers(v) {
+			used[string(r)] = true
+		}
+	}
 	result := []string{}
+	for _, v := range calleeSaved {
+		if used[v] {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// Options change how the IR is lowered
+type Options struct {
+	// TrapDiv checks every divisor and stops the program with a message
+	// on stderr and status 136, as SIGFPE would, if it is zero
+	TrapDiv bool
+}
+
+// divTrap is where a zero divisor jumps with TrapDiv
+const divTrap = "cigrid_div_trap"
+
+// DivTrapMessage and DivTrapStatus are what a program built with TrapDiv
+// writes to stderr and exits with on a zero divisor
+const (
+	DivTrapMessage = "cigrid: division by zero\n"
+	DivTrapStatus  = 136
+)
+
+func generateSingleAsm(i *ir_translator.IrFunction, opts Options, diags *diag.List) []Inst {
+	result := []Inst{}
 	functionName := i.ReadName()
-	result = append(result, functionName + ": ")
+	result = append(result, label(functionName))
 	addressMap := i.ReadAddressMap()
-	stack_depth := (i.ReadMaxRegister() + len(addressMap)) * 8
-	result = append(result, "sub rsp, " + strconv.Itoa(stack_depth))
-	callee_register := []string{"rbp", "rbx", "r12", "r13", "r14", "r15"}
+	frameSize := i.ReadFrameSize()
+	callee_register := usedCalleeSaved(i.ReadIrList())
+	// rsp is 16-byte aligned after the prologue, call sites rely on it:
+	// 8 (return address) + 8 (rbp) + stack_depth + saved registers
+	stack_depth := (i.ReadMaxRegister() + frameSize) * 8
+	if (stack_depth + len(callee_register) * 8) % 16 != 0 {
+		stack_depth += 8
+	}
+	// the saved registers go below the slots, which are addressed from rbp
+	result = append(result, op("push", "rbp"))
+	result = append(result, op("mov", "rbp", "rsp"))
+	if stack_depth > 0 {
+		result = append(result, op("sub", "rsp", strconv.Itoa(stack_depth)))
+	}
 	for _, v := range(callee_register) {
-		result = append(result, "push " + v)
+		result = append(result, op("push", v))
+	}
+	// source returns the NASM operand an instruction reads reg from. A
+	// label address cannot be an immediate in position independent code,
+	// so it is loaded RIP-relative into scratch first. Only a mov into a
+	// register takes an immediate outside 32 bits; one is loaded into
+	// scratch too.
+	source := func(reg ir.Operand, scratch string) (string, bool) {
+		if g, ok := reg.(ir.Global); ok {
+			result = append(result, op("lea", scratch, "[rel " + string(g) + "]"))
+			return scratch, false
+		} else if n, ok := reg.(ir.Imm); ok && (n < math.MinInt32 || n > math.MaxInt32) {
+			result = append(result, op("mov", scratch, strconv.FormatInt(int64(n), 10)))
+			return scratch, false
+		}
+		return address(addressMap, frameSize, reg)
 	}
 	for _, v := range(i.ReadIrList()) {
 		if value, ok := v.(ir.Label); ok {
-			result = append(result, string(value) + ": ")
+			result = append(result, label(string(value)))
 		} else if value, ok := v.(ir.CalcInst); ok {
 			if value.Operation == ir.ADD || value.Operation == ir.SUB ||
 			   value.Operation == ir.MOV || value.Operation == ir.XOR {
 				temp := string(value.Operation)
-				r1, o1 := address(addressMap, value.Operand1)
-				r2, o2 := address(addressMap, value.Operand2)
+				r1, o1 := address(addressMap, frameSize, value.Operand1)
+				if g, ok := value.Operand2.(ir.Global); ok && value.Operation == ir.MOV && !o1 {
+					// straight into the register
+					result = append(result, op("lea", r1, "[rel " + string(g) + "]"))
+					continue
+				} else if n, ok := value.Operand2.(ir.Imm); ok && value.Operation == ir.MOV && !o1 {
+					result = append(result, op("mov", r1, strconv.FormatInt(int64(n), 10)))
+					continue
+				}
+				r2, o2 := source(value.Operand2, "r11")
 				if o1 && o2 {
 					// Binary instructions (e.g., add) cannot use two memory operands.
-					mov_temp := "mov r10, " + r2
-					temp += " " + r1 + ", r10"
-					result = append(result, mov_temp)
-					result = append(result, temp)
+					result = append(result, op("mov", "r10", r2))
+					result = append(result, op(temp, r1, "r10"))
 				} else {
-					temp += " " + r1 + ", " + r2
-					result = append(result, temp)
+					result = append(result, op(temp, r1, r2))
+				}
+			} else if value.Operation == ir.MUL || value.Operation == ir.DIV ||
+					  value.Operation == ir.MOD {
+				divides := value.Operation != ir.MUL
+				r1, _ := address(addressMap, frameSize, value.Operand1)
+				r2, _ := source(value.Operand2, "r11")
+				result = append(result, op("mov", "rax", r1))
+				divisor, constant := value.Operand2.(ir.Imm)
+				if constant {
+					// the one operand forms take no immediate
+					result = append(result, op("mov", "r11", r2))
+					r2 = "r11"
+				}
+				if divides && opts.TrapDiv && (!constant || divisor == 0) {
+					result = append(result, op("cmp", r2, "0"))
+					result = append(result, op("je", divTrap))
+				}
+				if divides {
+					// idiv divides rdx:rax, the quotient goes to rax and
+					// the remainder to rdx
+					result = append(result, op("cqo"))
+					result = append(result, op("idiv", r2))
+				} else {
+					result = append(result, op("imul", r2))
+				}
+				if value.Operation == ir.MOD {
+					result = append(result, op("mov", r1, "rdx"))
+				} else {
+					result = append(result, op("mov", r1, "rax"))
 				}
-			} else if value.Operation == ir.MUL || value.Operation == ir.DIV {
-				temp := string(value.Operation)
-				r1, _ := address(addressMap, value.Operand1)
-				r2, _ := address(addressMap, value.Operand2)
-				result = append(result, "mov rax, " + r1)
-				temp += " " + r2 
-				result = append(result, temp)
-				result = append(result, "mov " + r1 + ", rax")
 			} else if value.Operation == ir.LEA {
-				temp := "lea r10, "
-				r1, _ := address(addressMap, value.Operand1)
-				r2, _ := address(addressMap, value.Operand2)
-				result = append(result, temp + r2[6:])
-				result = append(result, "mov " + r1 + ", r10")
+				r1, _ := address(addressMap, frameSize, value.Operand1)
+				r2, _ := address(addressMap, frameSize, value.Operand2)
+				result = append(result, op("lea", "r10", strings.TrimPrefix(r2, "qword ")))
+				result = append(result, op("mov", r1, "r10"))
+			} else {
+				unsupported(diags, i, v)
 			}
 		} else if _, ok := v.(ir.Ret); ok {
+			if len(callee_register) > 0 {
+				// rsp back to the saved registers, whatever was pushed since
+				depth := stack_depth + len(callee_register) * 8
+				result = append(result, op("lea", "rsp", "[rbp - " + strconv.Itoa(depth) + "]"))
+			}
 			for i := len(callee_register) - 1; i >= 0; i-- {
-				result = append(result, "pop " + callee_register[i])
+				result = append(result, op("pop", callee_register[i]))
 			}
-			result = append(result, "add rsp, " + strconv.Itoa(stack_depth))
-			result = append(result, "ret")
+			result = append(result, op("leave"))
+			result = append(result, op("ret"))
 		} else if value, ok := v.(ir.OneInst); ok {
-			if value.Operation == ir.NEG || value.Operation == ir.PUSH || 
-			   value.Operation == ir.POP {
-				temp := string(value.Operation)
-				r1, _ := address(addressMap, value.Operand1)
-				temp += " " + r1
-				result = append(result, temp)
+			if value.Operation == ir.PUSH {
+				r1, _ := source(value.Operand1, "r11")
+				result = append(result, op("push", r1))
+			} else if value.Operation == ir.NEG || value.Operation == ir.POP {
+				r1, _ := address(addressMap, frameSize, value.Operand1)
+				result = append(result, op(string(value.Operation), r1))
+			} else {
+				unsupported(diags, i, v)
 			}
 		} else if value, ok := v.(ir.CmpInst); ok {
-			temp := "cmp"
-			r1, o1 := address(addressMap, value.Left)
-			r2, o2 := address(addressMap, value.Right)
-			if o1 && o2 {
+			r1, o1 := source(value.Left, "r10")
+			r2, o2 := source(value.Right, "r11")
+			if _, ok := value.Left.(ir.Imm); ok {
+				// cmp takes no immediate on the left
+				result = append(result, op("mov", "r10", r1))
+				result = append(result, op("cmp", "r10", r2))
+			} else if o1 && o2 {
 				// Binary instructions (e.g., add) cannot use two memory operands.
-				mov_temp := "mov r10, " + r2
-				temp += " " + r1 + ", r10"
-				result = append(result, mov_temp)
-				result = append(result, temp)
+				result = append(result, op("mov", "r10", r2))
+				result = append(result, op("cmp", r1, "r10"))
 			} else {
-				temp += " " + r1 + ", " + r2
-				result = append(result, temp)
+				result = append(result, op("cmp", r1, r2))
+			}
+		} else if value, ok := v.(ir.LoadInst); ok {
+			// the address goes through r10, the value through r11
+			dest, _ := address(addressMap, frameSize, value.Dest)
+			addr, _ := source(value.Addr, "r10")
+			result = append(result, op("mov", "r10", addr))
+			result = append(result, op("mov", "r11", "qword [r10]"))
+			result = append(result, op("mov", dest, "r11"))
+		} else if value, ok := v.(ir.StoreInst); ok {
+			addr, _ := source(value.Addr, "r10")
+			val, _ := source(value.Value, "r11")
+			target := "qword [r10]"
+			if value.Offset != 0 {
+				target = "qword [r10 + " + strconv.Itoa(value.Offset) + "]"
 			}
+			result = append(result, op("mov", "r10", addr))
+			result = append(result, op("mov", "r11", val))
+			result = append(result, op("mov", target, "r11"))
 		} else if value, ok := v.(ir.JumpInst); ok {
-			result = append(result, value.IrString())
+			result = append(result, op("j" + string(value.JC), value.Addr))
 		} else if value, ok := v.(ir.CallInst); ok {
-			result = append(result, value.IrString())
+			// the registers live across the call wait in the top temp slots
+			slots := []string{}
+			for k, r := range value.Saved {
+				slot, _ := address(addressMap, frameSize, ir.Temp(i.ReadMaxRegister() - 1 - k))
+				slots = append(slots, slot)
+				result = append(result, op("mov", slot, string(r)))
+			}
+			result = append(result, op("call", value.FuntionName))
+			for k, r := range value.Saved {
+				result = append(result, op("mov", string(r), slots[k]))
+			}
+		} else {
+			unsupported(diags, i, v)
 		}
 	}
 	return result
 }
 
-func GenerateAsm(t *ir_translator.IrTranslator) []string {
+// byteList spells out the bytes of s and the terminating NUL for db.
+// Printable runs are quoted, everything else is written as a number, so
+// the bytes come out exactly as decoded by the lexer.
+func byteList(s string) string {
+	items := []string{}
+	run := ""
+	for i := 0; i < len(s); i++ {
+		if s[i] >= ' ' && s[i] <= '~' && s[i] != '"' {
+			run += string(s[i])
+			continue
+		}
+		if run != "" {
+			items = append(items, "\"" + run + "\"")
+			run = ""
+		}
+		items = append(items, strconv.Itoa(int(s[i])))
+	}
+	if run != "" {
+		items = append(items, "\"" + run + "\"")
+	}
+	items = append(items, "0")
+	return strings.Join(items, ", ")
+}
+
+// GenerateAsm lowers the IR of t to NASM source lines, each function
+// cleaned up by Peephole. Instructions it cannot lower are reported to
+// diags.
+func GenerateAsm(t *ir_translator.IrTranslator, opts Options, diags *diag.List) []string {
 	list := t.ReadIrFunctionList()
 	result := []string{}
 	result = append(result, "global main")
 	result = append(result, "extern printf")
+	if opts.TrapDiv {
+		result = append(result, "extern exit")
+	}
 	result = append(result, "section .data")
+	if opts.TrapDiv {
+		result = append(result, divTrap + "_message: db " + byteList(DivTrapMessage))
+	}
 	for k, v := range(t.ReadStringList()) {
-		pre := "str" + strconv.Itoa(k + 1) + ": db "
-		// 判断是否存在换行符
-		// 假设只在字符串末尾出现换行符
-		if v[len(v) - 2] == 92 && v[len(v) - 1] == 110 {
-			v = "\"" + v[:len(v) - 2] + "\"" + ", 10, 0"
+		result = append(result, "str" + strconv.Itoa(k + 1) + ": db " + byteList(v))
+	}
+	// globals, RIP-relative addressed as [rel g_x]
+	bss := []string{}
+	for _, v := range(t.ReadGlobalList()) {
+		if v.Initialized {
+			result = append(result, v.Name + ": dq " + strings.Join(v.Values, ", "))
 		} else {
-			v = "\"" + v[:len(v) - 2] + "\"" + ", 0"
+			bss = append(bss, v.Name + ": resq " + strconv.Itoa(v.Size))
 		}
-		result = append(result, pre + v)
+	}
+	if len(bss) > 0 {
+		result = append(result, "section .bss")
+		result = append(result, bss...)
 	}
 	result = append(result, "section .text")
 	for _, v := range(list) {
-		result = append(result, generateSingleAsm(v)...)
+		for _, inst := range Peephole(generateSingleAsm(v, opts, diags)) {
+			result = append(result, inst.String())
+		}
+	}
+	if opts.TrapDiv {
+		for _, inst := range divTrapCode() {
+			result = append(result, inst.String())
+		}
 	}
 	return result
 }
 
+// divTrapCode writes the message with the write system call, stderr is
+// not buffered, and exits through the C library, so that what printf
+// buffered still comes out
+func divTrapCode() []Inst {
+	return []Inst{
+		label(divTrap),
+		op("mov", "rax", "1"),
+		op("mov", "rdi", "2"),
+		op("lea", "rsi", "[rel " + divTrap + "_message]"),
+		op("mov", "rdx", strconv.Itoa(len(DivTrapMessage))),
+		op("syscall"),
+		// the divisor may be checked while arguments are being pushed
+		op("and", "rsp", "-16"),
+		op("mov", "rdi", strconv.Itoa(DivTrapStatus)),
+		op("call", "exit"),
+	}
+}
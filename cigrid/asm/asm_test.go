@@ -0,0 +1,59 @@
+package asm
+
+import "cigrid/diag"
+import "cigrid/ir/parse"
+import "strings"
+import "testing"
+
+func TestByteList(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"hi %d\n", `"hi %d", 10, 0`},
+		{"", "0"},
+		{"say \"x\"\t\\", `"say ", 34, "x", 34, 9, "\", 0`},
+		{"\x00\xff", "0, 255, 0"},
+	}
+	for _, test := range tests {
+		if got := byteList(test.s); got != test.want {
+			t.Errorf("byteList(%q) = %s, want %s", test.s, got, test.want)
+		}
+	}
+}
+
+// TestWideImmediate checks that an immediate outside 32 bits is only
+// ever moved into a register, the one form that encodes it
+func TestWideImmediate(t *testing.T) {
+	p := parse.New("test.ir", `function main frame 1 temps 1
+	var x.1 0
+	mov x.1 10000000000
+	mov %rcx -10000000000
+	add x.1 10000000000
+	cmp x.1 10000000000
+	cmp 10000000000 %rcx
+	push 10000000000
+	pop %rcx
+	mov temp0 [%rbp + 16]
+	idiv temp0 10000000000
+	mov %rax temp0
+	ret
+end
+`)
+	program := p.Parse()
+	for _, d := range p.Diagnostics().Items() {
+		t.Fatalf("%d:%d: %s", d.Span.Start.Line, d.Span.Start.Column, d.Message)
+	}
+	var diags diag.List
+	wide := map[string]bool{"10000000000": true, "-10000000000": true}
+	for _, v := range generateSingleAsm(program.ReadIrFunctionList()[0], Options{}, &diags) {
+		for k, arg := range v.Args {
+			if wide[arg] && (v.Op != "mov" || k != 1 || strings.Contains(v.Args[0], "[")) {
+				t.Errorf("%s cannot be encoded", strings.TrimSpace(v.String()))
+			}
+		}
+	}
+	if diags.Len() > 0 {
+		t.Errorf("%d diagnostics", diags.Len())
+	}
+}
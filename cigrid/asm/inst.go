@@ -0,0 +1,68 @@
+package asm
+
+import "strings"
+
+// Inst is one line of a function in NASM syntax: a label if Label is set,
+// else an instruction, Op applied to Args in Intel order (destination
+// first). Operands are kept as NASM writes them, "rax", "42" or
+// "qword [rbp - 8]".
+type Inst struct {
+	Label string
+	Op    string
+	Args  []string
+}
+
+func op(name string, args ...string) Inst {
+	return Inst{Op: name, Args: args}
+}
+
+func label(name string) Inst {
+	return Inst{Label: name}
+}
+
+func (i Inst) String() string {
+	if i.Label != "" {
+		return i.Label + ": "
+	}
+	if len(i.Args) == 0 {
+		return i.Op
+	}
+	return i.Op + " " + strings.Join(i.Args, ", ")
+}
+
+// is tells whether i is the instruction name with exactly n operands
+func (i Inst) is(name string, n int) bool {
+	return i.Label == "" && i.Op == name && len(i.Args) == n
+}
+
+// memory tells whether the operand a is in memory
+func memory(a string) bool {
+	return strings.HasSuffix(a, "]")
+}
+
+// register tells whether the operand a is a register. Labels, which
+// stand for their address, are neither registers nor memory.
+func register(a string) bool {
+	switch a {
+	case "rax", "rbx", "rcx", "rdx", "rsi", "rdi", "rbp", "rsp",
+		 "r8", "r9", "r10", "r11", "r12", "r13", "r14", "r15":
+		return true
+	}
+	return false
+}
+
+// mentions tells whether the operand a reads the register r, as itself
+// or in its address
+func mentions(a string, r string) bool {
+	if a == r {
+		return true
+	}
+	for _, v := range strings.FieldsFunc(a, func(c rune) bool {
+		return strings.ContainsRune(" []+-", c)
+	}) {
+		if v == r {
+			return true
+		}
+	}
+	return false
+}
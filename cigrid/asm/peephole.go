@@ -0,0 +1,124 @@
+package asm
+
+// Rule is a peephole rule: Apply looks at the instructions window starts
+// with and returns what replaces the first n of them, n = 0 if the rule
+// does not apply. A label is never part of a match but as a jump target,
+// so code is not moved across one.
+type Rule struct {
+	Name  string
+	Apply func(window []Inst) ([]Inst, int)
+}
+
+// Rules are the rules Peephole applies, in order
+var Rules = []Rule{
+	{"self-move", selfMove},
+	{"jump-to-next", jumpToNext},
+	{"move-back", moveBack},
+	{"overwritten-move", overwrittenMove},
+	{"zero-twice", zeroTwice},
+}
+
+// Peephole cleans up the code of a function with Rules
+func Peephole(list []Inst) []Inst {
+	return Rewrite(list, Rules)
+}
+
+// Rewrite applies rules at every instruction of list until none applies
+// anywhere
+func Rewrite(list []Inst, rules []Rule) []Inst {
+	for changed := true; changed; {
+		changed = false
+		for k := 0; k < len(list); k++ {
+			for _, r := range rules {
+				if out, n := r.Apply(list[k:]); n > 0 {
+					rest := list[k + n:]
+					list = append(append(append([]Inst{}, list[:k]...), out...), rest...)
+					changed = true
+				}
+			}
+		}
+	}
+	return list
+}
+
+// selfMove removes `mov r, r`
+func selfMove(w []Inst) ([]Inst, int) {
+	if len(w) > 0 && w[0].is("mov", 2) && w[0].Args[0] == w[0].Args[1] {
+		return nil, 1
+	}
+	return nil, 0
+}
+
+// jumpToNext removes a jmp to one of the labels right after it
+func jumpToNext(w []Inst) ([]Inst, int) {
+	if len(w) == 0 || !w[0].is("jmp", 1) {
+		return nil, 0
+	}
+	for _, v := range w[1:] {
+		if v.Label == "" {
+			break
+		} else if v.Label == w[0].Args[0] {
+			return nil, 1
+		}
+	}
+	return nil, 0
+}
+
+// moveBack removes the second of `mov a, b / mov b, a`, after which b
+// already holds a. That is not so if writing a changes where b is, as in
+// `mov r10, qword [r10]`.
+func moveBack(w []Inst) ([]Inst, int) {
+	if len(w) < 2 || !w[0].is("mov", 2) || !w[1].is("mov", 2) {
+		return nil, 0
+	}
+	a, b := w[0].Args[0], w[0].Args[1]
+	if w[1].Args[0] != b || w[1].Args[1] != a || mentions(b, a) {
+		return nil, 0
+	}
+	return w[:1], 2
+}
+
+// writes returns the register i sets without reading it, "" if none
+func writes(i Inst) string {
+	if i.is("mov", 2) && register(i.Args[0]) && !mentions(i.Args[1], i.Args[0]) {
+		return i.Args[0]
+	}
+	return zeroed(i)
+}
+
+// overwrittenMove removes `mov r, x` when the next instruction sets r
+// without reading it
+func overwrittenMove(w []Inst) ([]Inst, int) {
+	if len(w) < 2 || !w[0].is("mov", 2) {
+		return nil, 0
+	}
+	r := w[0].Args[0]
+	if !register(r) || r == "rsp" || r == "rbp" || writes(w[1]) != r {
+		return nil, 0
+	}
+	return w[1:2], 2
+}
+
+// zeroed returns the register `xor r, r` or `mov r, 0` clears, "" if i
+// is neither
+func zeroed(i Inst) string {
+	if (i.is("xor", 2) && i.Args[0] == i.Args[1] ||
+	   i.is("mov", 2) && i.Args[1] == "0") && register(i.Args[0]) {
+		return i.Args[0]
+	}
+	return ""
+}
+
+// zeroTwice removes the second of two instructions clearing the same
+// register. A mov may go after either, a xor only after a xor: unlike
+// mov it sets the flags.
+func zeroTwice(w []Inst) ([]Inst, int) {
+	if len(w) < 2 {
+		return nil, 0
+	}
+	r := zeroed(w[0])
+	if r == "" || zeroed(w[1]) != r || w[1].Op == "xor" && w[0].Op != "xor" {
+		return nil, 0
+	}
+	return w[:1], 2
+}
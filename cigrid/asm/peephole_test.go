@@ -0,0 +1,101 @@
+package asm
+
+import "strings"
+import "testing"
+
+// code reads lines like "mov rax, rbx" and ".L0:" back into Inst
+func code(lines ...string) []Inst {
+	result := []Inst{}
+	for _, v := range lines {
+		if strings.HasSuffix(v, ":") {
+			result = append(result, label(strings.TrimSuffix(v, ":")))
+		} else if name, args, ok := strings.Cut(v, " "); ok {
+			result = append(result, op(name, strings.Split(args, ", ")...))
+		} else {
+			result = append(result, op(v))
+		}
+	}
+	return result
+}
+
+func text(list []Inst) string {
+	result := []string{}
+	for _, v := range list {
+		result = append(result, strings.TrimSpace(v.String()))
+	}
+	return strings.Join(result, "; ")
+}
+
+func rule(t *testing.T, name string) Rule {
+	for _, v := range Rules {
+		if v.Name == name {
+			return v
+		}
+	}
+	t.Fatalf("no rule %s", name)
+	return Rule{}
+}
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		rule string
+		in   []Inst
+		want []Inst
+	}{
+		{"self-move", code("mov rax, rax", "ret"), code("ret")},
+		{"self-move", code("mov rax, rbx"), code("mov rax, rbx")},
+		{"self-move", code("mov qword [rbp - 8], rax"), code("mov qword [rbp - 8], rax")},
+
+		{"jump-to-next", code("jmp .L1", ".L1:", "ret"), code(".L1:", "ret")},
+		{"jump-to-next", code("jmp .L2", ".L1:", ".L2:"), code(".L1:", ".L2:")},
+		{"jump-to-next", code("jmp .L1", "ret", ".L1:"), code("jmp .L1", "ret", ".L1:")},
+		{"jump-to-next", code("je .L1", ".L1:"), code("je .L1", ".L1:")},
+
+		{"move-back", code("mov rax, qword [rbp - 8]", "mov qword [rbp - 8], rax"),
+			code("mov rax, qword [rbp - 8]")},
+		{"move-back", code("mov rcx, rsi", "mov rsi, rcx"), code("mov rcx, rsi")},
+		// r10 no longer points where it did
+		{"move-back", code("mov r10, qword [r10]", "mov qword [r10], r10"),
+			code("mov r10, qword [r10]", "mov qword [r10], r10")},
+		{"move-back", code("mov rax, rbx", "mov rbx, rcx"), code("mov rax, rbx", "mov rbx, rcx")},
+		{"move-back", code("mov rax, rbx", ".L0:", "mov rbx, rax"),
+			code("mov rax, rbx", ".L0:", "mov rbx, rax")},
+
+		{"overwritten-move", code("mov rax, 1", "mov rax, rbx"), code("mov rax, rbx")},
+		{"overwritten-move", code("mov rcx, qword [rbp - 8]", "xor rcx, rcx"), code("xor rcx, rcx")},
+		// the second one reads rax
+		{"overwritten-move", code("mov rax, 1", "mov rax, qword [rax]"),
+			code("mov rax, 1", "mov rax, qword [rax]")},
+		{"overwritten-move", code("mov rax, 1", "add rax, 2"), code("mov rax, 1", "add rax, 2")},
+		{"overwritten-move", code("mov qword [rbp - 8], 1", "mov qword [rbp - 8], 2"),
+			code("mov qword [rbp - 8], 1", "mov qword [rbp - 8], 2")},
+		{"overwritten-move", code("mov rax, 1", ".L0:", "mov rax, 2"),
+			code("mov rax, 1", ".L0:", "mov rax, 2")},
+
+		{"zero-twice", code("xor rax, rax", "xor rax, rax"), code("xor rax, rax")},
+		{"zero-twice", code("mov rax, 0", "mov rax, 0"), code("mov rax, 0")},
+		{"zero-twice", code("xor rax, rax", "mov rax, 0"), code("xor rax, rax")},
+		// the second xor sets the flags, the mov did not
+		{"zero-twice", code("mov rax, 0", "xor rax, rax"), code("mov rax, 0", "xor rax, rax")},
+		// the jump reads the flags the xor set
+		{"zero-twice", code("xor rax, rax", "jne .L1", "mov rax, 0"),
+			code("xor rax, rax", "jne .L1", "mov rax, 0")},
+		{"zero-twice", code("xor rax, rax", "xor rcx, rcx"), code("xor rax, rax", "xor rcx, rcx")},
+	}
+	for _, test := range tests {
+		got := Rewrite(test.in, []Rule{rule(t, test.rule)})
+		if text(got) != text(test.want) {
+			t.Errorf("%s: %s\ngot  %s\nwant %s", test.rule, text(test.in), text(got), text(test.want))
+		}
+	}
+}
+
+// TestPeephole applies the rules together until none applies
+func TestPeephole(t *testing.T) {
+	in := code("mov rcx, rcx", "mov rax, 5", "mov rax, 0", "xor rax, rax",
+		"jmp .L0", ".L0:", "mov rsi, qword [rbp - 8]", "mov qword [rbp - 8], rsi", "ret")
+	want := code("xor rax, rax", ".L0:", "mov rsi, qword [rbp - 8]", "ret")
+	if got := Peephole(in); text(got) != text(want) {
+		t.Errorf("got  %s\nwant %s", text(got), text(want))
+	}
+}
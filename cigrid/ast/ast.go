@@ -17,6 +17,7 @@ func identFunc() string {
 
 type Node interface {
 	String() string
+	Span() token.Span // 节点在源文件中的范围
 }
 
 type Global interface {
@@ -31,6 +32,9 @@ type FunctionLiteral struct {
 	Body       *BlockStatement
 }
 func (fl *FunctionLiteral) GlobalNode() {}
+func (fl *FunctionLiteral) Span() token.Span {
+	return fl.ReturnType.Span().Join(fl.Body.Span())
+}
 func (fl *FunctionLiteral) String() string {
 	var out bytes.Buffer 
 	out.WriteString(fl.ReturnType.String())
@@ -45,6 +49,58 @@ func (fl *FunctionLiteral) String() string {
 	return out.String()
 }
 
+// GlobalVarDef is a global scalar, `int x = 1;` or `int x;`
+type GlobalVarDef struct {
+	VarType *Type
+	Name    *Identifier
+	Value   Expression // nil if not initialised
+}
+func (gd *GlobalVarDef) GlobalNode() {}
+func (gd *GlobalVarDef) Span() token.Span {
+	if gd.Value == nil {
+		return gd.VarType.Span().Join(gd.Name.Span())
+	}
+	return gd.VarType.Span().Join(gd.Value.Span())
+}
+func (gd *GlobalVarDef) String() string {
+	var out bytes.Buffer
+	out.WriteString(gd.VarType.String())
+	out.WriteString(gd.Name.String())
+	if gd.Value != nil {
+		out.WriteString(" = ")
+		out.WriteString(gd.Value.String())
+	}
+	return out.String()
+}
+
+// GlobalArrayDef is a global array, `int a[2][3] = {{1, 2, 3}, {4, 5, 6}};`
+type GlobalArrayDef struct {
+	VarType *Type // element type
+	Name    *Identifier
+	Dims    []int
+	Value   *ArrayLiteral // nil if not initialised
+}
+func (ga *GlobalArrayDef) GlobalNode() {}
+func (ga *GlobalArrayDef) Span() token.Span {
+	if ga.Value == nil {
+		return ga.VarType.Span().Join(ga.Name.Span())
+	}
+	return ga.VarType.Span().Join(ga.Value.Span())
+}
+func (ga *GlobalArrayDef) String() string {
+	var out bytes.Buffer
+	out.WriteString(ga.VarType.String())
+	out.WriteString(ga.Name.String())
+	for _, v := range ga.Dims {
+		out.WriteString("[" + strconv.Itoa(v) + "]")
+	}
+	if ga.Value != nil {
+		out.WriteString(" = ")
+		out.WriteString(ga.Value.String())
+	}
+	return out.String()
+}
+
 type Statement interface {
 	Node
 	statementNode()
@@ -56,12 +112,48 @@ type VarDef struct {
 	Value   Expression
 }
 func (d *VarDef) statementNode() {}
+func (d *VarDef) Span() token.Span {
+	if d.Value == nil {
+		return d.VarType.Span().Join(d.Name.Span())
+	}
+	return d.VarType.Span().Join(d.Value.Span())
+}
 func (d *VarDef) String() string {
 	var out bytes.Buffer 
 	out.WriteString(d.VarType.String())
 	out.WriteString(d.Name.String())
-	out.WriteString(" = ")
-	out.WriteString(d.Value.String())
+	if d.Value != nil {
+		out.WriteString(" = ")
+		out.WriteString(d.Value.String())
+	}
+	return out.String()
+}
+
+// ArrayDef is a local array, `int a[3][3] = {{1, 2, 3}, ...};`
+type ArrayDef struct {
+	VarType *Type // element type
+	Name    *Identifier
+	Dims    []int
+	Value   *ArrayLiteral // nil if not initialised
+}
+func (ad *ArrayDef) statementNode() {}
+func (ad *ArrayDef) Span() token.Span {
+	if ad.Value == nil {
+		return ad.VarType.Span().Join(ad.Name.Span())
+	}
+	return ad.VarType.Span().Join(ad.Value.Span())
+}
+func (ad *ArrayDef) String() string {
+	var out bytes.Buffer
+	out.WriteString(ad.VarType.String())
+	out.WriteString(ad.Name.String())
+	for _, v := range ad.Dims {
+		out.WriteString("[" + strconv.Itoa(v) + "]")
+	}
+	if ad.Value != nil {
+		out.WriteString(" = ")
+		out.WriteString(ad.Value.String())
+	}
 	return out.String()
 }
 
@@ -70,6 +162,7 @@ type VarAssign struct {
 	Right Expression
 }
 func (va *VarAssign) statementNode() {}
+func (va *VarAssign) Span() token.Span { return va.Left.Span().Join(va.Right.Span()) }
 func (va *VarAssign) String() string {
 	var out bytes.Buffer 
 	out.WriteString(va.Left.String())
@@ -79,9 +172,16 @@ func (va *VarAssign) String() string {
 }
 
 type ReturnStatement struct {
+	Token       token.Token // return
 	ReturnValue Expression 
 }
 func (rs *ReturnStatement) statementNode() {}
+func (rs *ReturnStatement) Span() token.Span {
+	if rs.ReturnValue == nil {
+		return rs.Token.Span
+	}
+	return rs.Token.Span.Join(rs.ReturnValue.Span())
+}
 func (rs *ReturnStatement) String() string {
 	var out bytes.Buffer 
 	out.WriteString("return ")
@@ -92,11 +192,18 @@ func (rs *ReturnStatement) String() string {
 }
 
 type IfStatement struct {
+	Token       token.Token // if
 	Condition   Expression 
 	Consequence *BlockStatement
 	Alternative *BlockStatement
 }
 func (is *IfStatement) statementNode() {}
+func (is *IfStatement) Span() token.Span {
+	if is.Alternative != nil {
+		return is.Token.Span.Join(is.Alternative.Span())
+	}
+	return is.Token.Span.Join(is.Consequence.Span())
+}
 func (is *IfStatement) String() string {
 	var out bytes.Buffer 
 	out.WriteString("if (")
@@ -112,10 +219,14 @@ func (is *IfStatement) String() string {
 }
 
 type WhileStatement struct {
+	Token       token.Token // while
 	Condition   Expression 
 	Consequence *BlockStatement 
 }
 func (ws *WhileStatement) statementNode() {}
+func (ws *WhileStatement) Span() token.Span {
+	return ws.Token.Span.Join(ws.Consequence.Span())
+}
 func (ws *WhileStatement) String() string {
 	var out bytes.Buffer 
 	out.WriteString("while (")
@@ -129,13 +240,16 @@ type CallStatement struct {
 	Value *CallExpression
 }
 func (cs *CallStatement) statementNode() {}
+func (cs *CallStatement) Span() token.Span { return cs.Value.Span() }
 func (cs *CallStatement) String() string { return cs.Value.String() }
 
 type BlockStatement struct {
-	Token      token.Token
+	Token      token.Token // {
 	Statements []Statement
+	Rbrace     token.Token // }
 }
 func (bs *BlockStatement) statementNode() {}
+func (bs *BlockStatement) Span() token.Span { return bs.Token.Span.Join(bs.Rbrace.Span) }
 func (bs *BlockStatement) String() string {
 	var out bytes.Buffer 
 	out.WriteString(identFunc())
@@ -161,24 +275,30 @@ type Identifier struct {
 	Value token.Token
 }
 func (i *Identifier) expressionNode() {}
+func (i *Identifier) Span() token.Span { return i.Value.Span }
 func (i *Identifier) String() string  { return i.Value.Literal }
 
 type IntegerLiteral struct {
 	Value token.Token
 }
 func (il *IntegerLiteral) expressionNode() {}
+func (il *IntegerLiteral) Span() token.Span { return il.Value.Span }
 func (il *IntegerLiteral) String() string  { return il.Value.Literal }
 
 type StringLiteral struct {
 	Value token.Token
 }
 func (sl *StringLiteral) expressionNode() {}
-func (sl *StringLiteral) String() string { return "\"" + sl.Value.Literal + "\"" }
+func (sl *StringLiteral) Span() token.Span { return sl.Value.Span }
+func (sl *StringLiteral) String() string { return strconv.Quote(sl.Value.Literal) }
 
 type ArrayLiteral struct {
+	Token    token.Token // {
 	Elements []Expression
+	Rbrace   token.Token // }
 }
 func (al *ArrayLiteral) expressionNode() {}
+func (al *ArrayLiteral) Span() token.Span { return al.Token.Span.Join(al.Rbrace.Span) }
 func (al *ArrayLiteral) String() string  {
 	var out bytes.Buffer 
 	elements := []string{}
@@ -196,6 +316,9 @@ type PrefixExpression struct {
 	Right    Expression
 }
 func (pe *PrefixExpression) expressionNode() {}
+func (pe *PrefixExpression) Span() token.Span {
+	return pe.Operator.Span.Join(pe.Right.Span())
+}
 func (pe *PrefixExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("(")
@@ -211,6 +334,7 @@ type InfixExpression struct {
 	Right 	 Expression 
 }
 func (ie *InfixExpression) expressionNode() {}
+func (ie *InfixExpression) Span() token.Span { return ie.Left.Span().Join(ie.Right.Span()) }
 func (ie *InfixExpression) String() string {
 	var out bytes.Buffer 
 	out.WriteString("(")
@@ -221,15 +345,18 @@ func (ie *InfixExpression) String() string {
 	return out.String()
 }
 
+// IndexExpression is a[i]; a[i][j] is an IndexExpression whose Left is a[i]
 type IndexExpression struct {
-	Name *Identifier
-	Index Expression
+	Left     Expression
+	Index    Expression
+	Rbracket token.Token // ]
 }
 func (ie *IndexExpression) expressionNode() {}
+func (ie *IndexExpression) Span() token.Span { return ie.Left.Span().Join(ie.Rbracket.Span) }
 func (ie *IndexExpression) String() string {
 	var out bytes.Buffer 
 	out.WriteString("(")
-	out.WriteString(ie.Name.String())
+	out.WriteString(ie.Left.String())
 	out.WriteString("[")
 	out.WriteString(ie.Index.String())
 	out.WriteString("]")
@@ -238,10 +365,12 @@ func (ie *IndexExpression) String() string {
 }
 
 type CallExpression struct {
-	Name *Identifier
+	Name   *Identifier
 	Params []Expression 
+	Rparen token.Token // )
 }
 func (ce *CallExpression) expressionNode() {}
+func (ce *CallExpression) Span() token.Span { return ce.Name.Span().Join(ce.Rparen.Span) }
 func (ce *CallExpression) String() string {
 	var out bytes.Buffer 
 	out.WriteString(ce.Name.String())
@@ -257,13 +386,14 @@ func (ce *CallExpression) String() string {
 
 
 type Type struct {
-	Dtype     token.Token 
-	Dimension int
+	Dtype   token.Token 
+	Pointer int         // levels of indirection, 2 for int**
+	Last    token.Token // last token of the type
 }
+func (t *Type) Span() token.Span { return t.Dtype.Span.Join(t.Last.Span) }
 func (t *Type) String() string {
 	var out bytes.Buffer
-	out.WriteString(t.Dtype.Literal + " ")
-	out.WriteString("[" + strconv.Itoa(t.Dimension) + "] ")
+	out.WriteString(t.Dtype.Literal + strings.Repeat("*", t.Pointer) + " ")
 	return out.String()
 }
 
@@ -271,6 +401,9 @@ type TypeIdentifierPair struct {
 	TypeLiteral       *Type 
 	IdentifierLiteral *Identifier
 }
+func (tip *TypeIdentifierPair) Span() token.Span {
+	return tip.TypeLiteral.Span().Join(tip.IdentifierLiteral.Span())
+}
 func (tip *TypeIdentifierPair) String() string {
 	var out bytes.Buffer 
 	out.WriteString(tip.TypeLiteral.String())
@@ -0,0 +1,68 @@
+package diag
+
+// Code is a stable identifier of a kind of diagnostic. Codes are never
+// reused; the hundreds digit tells which stage reports it. Errors start
+// with E, warnings, which do not stop the compilation, with W.
+type Code string
+
+// lexer
+const (
+	UnknownCharacter Code = "E0001"
+	UnterminatedComment Code = "E0002"
+	UnterminatedString Code = "E0003"
+	UnknownEscape Code = "E0004"
+)
+
+// parser
+const (
+	UnexpectedToken Code = "E0101"
+	ExpectedStatement Code = "E0102"
+	ExpectedExpression Code = "E0103"
+)
+
+// sema
+const (
+	Undeclared Code = "E0301"
+	Redeclared Code = "E0302"
+	UnknownFunction Code = "E0303"
+	NotAFunction Code = "E0304"
+	NotAVariable Code = "E0305"
+	ArgumentCount Code = "E0306"
+)
+
+// type checker
+const (
+	TypeMismatch Code = "E0401"
+	InvalidOperands Code = "E0402"
+	InvalidOperand Code = "E0403"
+	NotAssignable Code = "E0404"
+	ReturnType Code = "E0405"
+	ArgumentType Code = "E0406"
+	VoidVariable Code = "E0407"
+	IntegerOverflow Code = "E0409"
+)
+
+// type checker warnings
+const (
+	DivisionByZero Code = "W0401" // the division may never run
+)
+
+// ir_translator
+const (
+	UnsupportedExpression Code = "E0501"
+	UnsupportedStatement Code = "E0502"
+	UnsupportedOperator Code = "E0503"
+	NonConstantInitializer Code = "E0504"
+	ArrayInitializerTooLong Code = "E0505"
+	ArrayInitializerShape Code = "E0506"
+)
+
+// asm
+const (
+	UnsupportedInstruction Code = "E0601"
+)
+
+// ir/parse
+const (
+	MalformedIR Code = "E0701"
+)
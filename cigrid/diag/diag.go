@@ -0,0 +1,114 @@
+package diag
+
+import "cigrid/token"
+import "fmt"
+import "sort"
+
+type Severity int
+
+// Severity
+const (
+	Error Severity = iota
+	Warning
+	Note
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Error:
+		return "error"
+	case Warning:
+		return "warning"
+	}
+	return "note"
+}
+
+// Diagnostic is one message of a compiler stage. A zero Span means the
+// message has no source location (e.g. it comes from the backend).
+type Diagnostic struct {
+	Severity Severity
+	Code     Code
+	Span     token.Span
+	Message  string
+	Notes    []*Diagnostic // extra notes printed under the main message
+}
+
+// Note attaches a note to d and returns d, so calls can be chained.
+func (d *Diagnostic) Note(span token.Span, format string, args ...interface{}) *Diagnostic {
+	d.Notes = append(d.Notes, &Diagnostic{
+		Severity: Note,
+		Span: span,
+		Message: fmt.Sprintf(format, args...),
+	})
+	return d
+}
+
+// List collects the diagnostics of one stage. The zero value is ready to use.
+type List struct {
+	items []*Diagnostic
+}
+
+func (l *List) add(severity Severity, code Code, span token.Span,
+				   format string, args []interface{}) *Diagnostic {
+	d := &Diagnostic{
+		Severity: severity,
+		Code: code,
+		Span: span,
+		Message: fmt.Sprintf(format, args...),
+	}
+	l.items = append(l.items, d)
+	return d
+}
+
+func (l *List) Errorf(code Code, span token.Span, format string, args ...interface{}) *Diagnostic {
+	return l.add(Error, code, span, format, args)
+}
+
+func (l *List) Warnf(code Code, span token.Span, format string, args ...interface{}) *Diagnostic {
+	return l.add(Warning, code, span, format, args)
+}
+
+// Append copies all diagnostics of other into l.
+func (l *List) Append(other *List) {
+	l.items = append(l.items, other.items...)
+}
+
+func (l *List) Items() []*Diagnostic {
+	return l.items
+}
+
+func (l *List) Len() int {
+	return len(l.items)
+}
+
+func (l *List) HasErrors() bool {
+	return l.ErrorCount() > 0
+}
+
+func (l *List) ErrorCount() int {
+	count := 0
+	for _, v := range l.items {
+		if v.Severity == Error {
+			count++
+		}
+	}
+	return count
+}
+
+// Sort orders the diagnostics by file, line and column; diagnostics
+// without a location keep their relative order and go last.
+func (l *List) Sort() {
+	sort.SliceStable(l.items, func(i, j int) bool {
+		a, b := l.items[i].Span.Start, l.items[j].Span.Start
+		if a.Line == 0 || b.Line == 0 {
+			return a.Line != 0 && b.Line == 0
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
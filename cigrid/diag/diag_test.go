@@ -0,0 +1,27 @@
+package diag
+
+import "cigrid/token"
+import "testing"
+
+func at(file string, line int, column int) token.Span {
+	p := token.Position{File: file, Line: line, Column: column}
+	return token.Span{Start: p, End: p}
+}
+
+func TestSort(t *testing.T) {
+	var l List
+	l.Errorf(TypeMismatch, at("b.c", 1, 1), "4")
+	l.Errorf(TypeMismatch, token.Span{}, "5")
+	l.Warnf(DivisionByZero, at("a.c", 3, 9), "3")
+	l.Errorf(TypeMismatch, at("a.c", 3, 2), "2")
+	l.Errorf(TypeMismatch, token.Span{}, "6")
+	l.Errorf(TypeMismatch, at("a.c", 1, 7), "1")
+	l.Sort()
+	got := ""
+	for _, v := range l.Items() {
+		got += v.Message
+	}
+	if got != "123456" {
+		t.Errorf("sorted as %s, want 123456", got)
+	}
+}
@@ -0,0 +1,105 @@
+package diag
+
+import "cigrid/token"
+import "fmt"
+import "io"
+import "strconv"
+import "strings"
+
+const tabWidth = 4
+
+// Render prints d in the style of rustc:
+//
+//	error[E0101]: expected `;`, found `}`
+//	 --> main.c:4:12
+//	  |
+//	4 |     int x = 1
+//	  |              ^
+//
+// sources maps a file name to its content; if the file of d is unknown
+// only the header and the location are printed.
+func Render(w io.Writer, d *Diagnostic, sources map[string]string) {
+	header := d.Severity.String()
+	if d.Code != "" {
+		header += "[" + string(d.Code) + "]"
+	}
+	fmt.Fprintf(w, "%s: %s\n", header, d.Message)
+	renderSpan(w, d.Span, sources)
+	for _, note := range d.Notes {
+		if note.Span.Start.Line == 0 {
+			fmt.Fprintf(w, "  = note: %s\n", note.Message)
+			continue
+		}
+		fmt.Fprintf(w, "note: %s\n", note.Message)
+		renderSpan(w, note.Span, sources)
+	}
+}
+
+// RenderAll prints every diagnostic of l followed by an error summary.
+func RenderAll(w io.Writer, l *List, sources map[string]string) {
+	for _, d := range l.Items() {
+		Render(w, d, sources)
+		fmt.Fprintln(w)
+	}
+	if count := l.ErrorCount(); count == 1 {
+		fmt.Fprintln(w, "error: aborting due to previous error")
+	} else if count > 1 {
+		fmt.Fprintf(w, "error: aborting due to %d previous errors\n", count)
+	}
+}
+
+func renderSpan(w io.Writer, span token.Span, sources map[string]string) {
+	start := span.Start
+	if start.Line == 0 {
+		return
+	}
+	lineNo := strconv.Itoa(start.Line)
+	gutter := strings.Repeat(" ", len(lineNo))
+	fmt.Fprintf(w, "%s--> %s\n", gutter, start)
+	source, ok := sources[start.File]
+	if !ok {
+		return
+	}
+	line, ok := sourceLine(source, start.Line)
+	if !ok {
+		return
+	}
+	// caret up to the end of the span, but never past the first line
+	width := 1
+	if span.End.Line == start.Line && span.End.Column > start.Column {
+		width = span.End.Column - start.Column
+	} else if span.End.Line > start.Line && len(line) >= start.Column {
+		width = len(line) - start.Column + 1
+	}
+	prefix := ""
+	if start.Column - 1 <= len(line) {
+		prefix = line[:start.Column - 1]
+	}
+	marked := line
+	if start.Column - 1 + width <= len(line) {
+		marked = line[:start.Column - 1 + width]
+	}
+	caretStart := expandedWidth(prefix)
+	caretWidth := expandedWidth(marked) - caretStart
+	if caretWidth < 1 {
+		caretWidth = 1
+	}
+	fmt.Fprintf(w, "%s |\n", gutter)
+	fmt.Fprintf(w, "%s | %s\n", lineNo, strings.ReplaceAll(line, "\t", strings.Repeat(" ", tabWidth)))
+	fmt.Fprintf(w, "%s | %s%s\n", gutter, strings.Repeat(" ", caretStart),
+		strings.Repeat("^", caretWidth))
+}
+
+// sourceLine returns line n (1-based) of source without the line break.
+func sourceLine(source string, n int) (string, bool) {
+	lines := strings.Split(source, "\n")
+	if n < 1 || n > len(lines) {
+		return "", false
+	}
+	return strings.TrimRight(lines[n - 1], "\r"), true
+}
+
+// expandedWidth is the display width of s with tabs expanded.
+func expandedWidth(s string) int {
+	return len(s) + strings.Count(s, "\t") * (tabWidth - 1)
+}
@@ -0,0 +1,307 @@
+package cfg
+
+import "cigrid/ir"
+import "bytes"
+import "strconv"
+import "strings"
+
+// Block is a basic block: a run of instructions that is only entered at
+// the top and only left at the bottom. A leading label is part of Insts,
+// so the instructions of all blocks in order give back the function.
+type Block struct {
+	Index int    // position in Graph.Blocks
+	Label string // label the block starts with, "" if it has none
+	Insts []ir.IntermediateRepresentation
+	Succs []*Block
+	Preds []*Block
+}
+
+func (b *Block) Name() string {
+	return "B" + strconv.Itoa(b.Index)
+}
+
+// Graph is the control-flow graph of one function
+type Graph struct {
+	Entry    *Block
+	Blocks   []*Block // in program order
+	labels   map[string]*Block
+	rpo      []*Block // reachable blocks in reverse postorder
+	order    map[*Block]int // position in rpo
+	idom     map[*Block]*Block
+	frontier map[*Block][]*Block
+}
+
+// New splits irList into basic blocks and links them. A block ends
+// after a jump or a ret, and a label always starts a new one.
+func New(irList []ir.IntermediateRepresentation) *Graph {
+	g := &Graph{labels: make(map[string]*Block)}
+	var current *Block
+	for _, v := range irList {
+		label, isLabel := v.(ir.Label)
+		if current == nil || isLabel {
+			current = &Block{Index: len(g.Blocks)}
+			if isLabel {
+				current.Label = string(label)
+				g.labels[current.Label] = current
+			}
+			g.Blocks = append(g.Blocks, current)
+		}
+		current.Insts = append(current.Insts, v)
+		if isTerminator(v) {
+			current = nil
+		}
+	}
+	if len(g.Blocks) == 0 || g.Blocks[0].Label != "" {
+		// the entry must not be a jump target, so that it has no
+		// predecessors; give it an empty block of its own
+		g.Blocks = append([]*Block{{}}, g.Blocks...)
+		for k, v := range g.Blocks {
+			v.Index = k
+		}
+	}
+	g.Entry = g.Blocks[0]
+	g.link()
+	g.computeOrder()
+	g.computeDominators()
+	g.computeFrontier()
+	return g
+}
+
+func isTerminator(v ir.IntermediateRepresentation) bool {
+	switch v.(type) {
+	case ir.JumpInst, ir.Ret:
+		return true
+	}
+	return false
+}
+
+// Block returns the block starting with label, nil if there is none
+func (g *Graph) Block(label string) *Block {
+	return g.labels[label]
+}
+
+func addEdge(from *Block, to *Block) {
+	for _, v := range from.Succs {
+		if v == to {
+			return
+		}
+	}
+	from.Succs = append(from.Succs, to)
+	to.Preds = append(to.Preds, from)
+}
+
+// link adds the edges: the target of a jump, and the next block when
+// the last instruction can fall through
+func (g *Graph) link() {
+	for k, b := range g.Blocks {
+		fallthrough_ := true
+		if len(b.Insts) > 0 {
+			switch last := b.Insts[len(b.Insts) - 1].(type) {
+			case ir.JumpInst:
+				if target := g.labels[last.Addr]; target != nil {
+					addEdge(b, target)
+				}
+				fallthrough_ = last.JC != ir.MP
+			case ir.Ret:
+				fallthrough_ = false
+			}
+		}
+		if fallthrough_ && k + 1 < len(g.Blocks) {
+			addEdge(b, g.Blocks[k + 1])
+		}
+	}
+}
+
+// computeOrder numbers the blocks reachable from the entry in reverse
+// postorder, the order in which forward dataflow converges fastest
+func (g *Graph) computeOrder() {
+	visited := map[*Block]bool{}
+	post := []*Block{}
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		visited[b] = true
+		for _, v := range b.Succs {
+			if !visited[v] {
+				visit(v)
+			}
+		}
+		post = append(post, b)
+	}
+	visit(g.Entry)
+	g.rpo = make([]*Block, len(post))
+	g.order = make(map[*Block]int)
+	for k, v := range post {
+		g.rpo[len(post) - 1 - k] = v
+	}
+	for k, v := range g.rpo {
+		g.order[v] = k
+	}
+}
+
+// ReversePostorder returns the reachable blocks, each after all of its
+// predecessors except those reached through a back edge
+func (g *Graph) ReversePostorder() []*Block {
+	return g.rpo
+}
+
+// Reachable tells whether b can be reached from the entry
+func (g *Graph) Reachable(b *Block) bool {
+	_, ok := g.order[b]
+	return ok
+}
+
+// computeDominators finds the immediate dominators with the iterative
+// algorithm of Cooper, Harvey and Kennedy ("A Simple, Fast Dominance
+// Algorithm")
+func (g *Graph) computeDominators() {
+	g.idom = map[*Block]*Block{g.Entry: g.Entry}
+	intersect := func(a *Block, b *Block) *Block {
+		for a != b {
+			for g.order[a] > g.order[b] {
+				a = g.idom[a]
+			}
+			for g.order[b] > g.order[a] {
+				b = g.idom[b]
+			}
+		}
+		return a
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, b := range g.rpo[1:] {
+			var newIdom *Block
+			for _, p := range b.Preds {
+				if g.idom[p] == nil {
+					// not processed yet, or unreachable
+					continue
+				}
+				if newIdom == nil {
+					newIdom = p
+				} else {
+					newIdom = intersect(p, newIdom)
+				}
+			}
+			if g.idom[b] != newIdom {
+				g.idom[b] = newIdom
+				changed = true
+			}
+		}
+	}
+}
+
+// Idom returns the immediate dominator of b. The entry and unreachable
+// blocks have none.
+func (g *Graph) Idom(b *Block) *Block {
+	if b == g.Entry {
+		return nil
+	}
+	return g.idom[b]
+}
+
+// Dominates tells whether every path from the entry to b goes through a.
+// A block dominates itself.
+func (g *Graph) Dominates(a *Block, b *Block) bool {
+	if !g.Reachable(b) {
+		return false
+	}
+	for ; b != nil; b = g.Idom(b) {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
+
+// DominatorTree returns the children of every block in the dominator tree
+func (g *Graph) DominatorTree() map[*Block][]*Block {
+	children := map[*Block][]*Block{}
+	for _, b := range g.rpo {
+		if idom := g.Idom(b); idom != nil {
+			children[idom] = append(children[idom], b)
+		}
+	}
+	return children
+}
+
+// computeFrontier finds the dominance frontiers, also from Cooper,
+// Harvey and Kennedy: a join point is in the frontier of every block on
+// the dominator tree path from each predecessor up to its idom.
+func (g *Graph) computeFrontier() {
+	g.frontier = map[*Block][]*Block{}
+	for _, b := range g.rpo {
+		if len(b.Preds) < 2 {
+			continue
+		}
+		for _, p := range b.Preds {
+			if !g.Reachable(p) {
+				continue
+			}
+			for runner := p; runner != g.idom[b]; runner = g.idom[runner] {
+				if !contains(g.frontier[runner], b) {
+					g.frontier[runner] = append(g.frontier[runner], b)
+				}
+			}
+		}
+	}
+}
+
+func contains(list []*Block, b *Block) bool {
+	for _, v := range list {
+		if v == b {
+			return true
+		}
+	}
+	return false
+}
+
+// Frontier returns the dominance frontier of b: the blocks where the
+// dominance of b ends
+func (g *Graph) Frontier(b *Block) []*Block {
+	return g.frontier[b]
+}
+
+// Linearize returns the instructions of all blocks in program order
+func (g *Graph) Linearize() []ir.IntermediateRepresentation {
+	result := []ir.IntermediateRepresentation{}
+	for _, b := range g.Blocks {
+		result = append(result, b.Insts...)
+	}
+	return result
+}
+
+func names(list []*Block) string {
+	result := []string{}
+	for _, v := range list {
+		result = append(result, v.Name())
+	}
+	return strings.Join(result, " ")
+}
+
+// String prints every block with its edges, immediate dominator and
+// dominance frontier, followed by its instructions
+func (g *Graph) String() string {
+	var out bytes.Buffer
+	for _, b := range g.Blocks {
+		out.WriteString(b.Name())
+		if b.Label != "" {
+			out.WriteString(" (" + b.Label + ")")
+		}
+		if !g.Reachable(b) {
+			out.WriteString(" unreachable")
+		}
+		out.WriteString("\n")
+		out.WriteString("  preds: " + names(b.Preds) + "\n")
+		out.WriteString("  succs: " + names(b.Succs) + "\n")
+		if idom := g.Idom(b); idom != nil {
+			out.WriteString("  idom: " + idom.Name() + "\n")
+		}
+		out.WriteString("  frontier: " + names(g.Frontier(b)) + "\n")
+		for _, v := range b.Insts {
+			if _, ok := v.(ir.Label); ok {
+				continue
+			}
+			out.WriteString("    " + v.IrString() + "\n")
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,63 @@
+package cfg
+
+import "cigrid/ir"
+import "testing"
+
+// summary describes b on one line: its edges, immediate dominator and
+// dominance frontier
+func summary(g *Graph, b *Block) string {
+	idom := "-"
+	if d := g.Idom(b); d != nil {
+		idom = d.Name()
+	}
+	return b.Name() + " preds [" + names(b.Preds) + "] succs [" + names(b.Succs) +
+		"] idom " + idom + " frontier [" + names(g.Frontier(b)) + "]"
+}
+
+func TestGraph(t *testing.T) {
+	mov := ir.CalcInst{Operation: ir.MOV, Operand1: ir.Temp(0), Operand2: ir.Imm(1)}
+	cmp := ir.CmpInst{Left: ir.Temp(0), Right: ir.Imm(0)}
+	tests := []struct {
+		name string
+		list []ir.IntermediateRepresentation
+		want []string
+	}{
+		{"diamond", []ir.IntermediateRepresentation{
+			cmp, ir.JumpInst{JC: ir.E, Addr: ".L1"},
+			mov, ir.JumpInst{JC: ir.MP, Addr: ".L2"},
+			ir.Label(".L1"), mov,
+			ir.Label(".L2"), ir.Ret(""),
+		}, []string{
+			"B0 preds [] succs [B2 B1] idom - frontier []",
+			"B1 preds [B0] succs [B3] idom B0 frontier [B3]",
+			"B2 preds [B0] succs [B3] idom B0 frontier [B3]",
+			"B3 preds [B1 B2] succs [] idom B0 frontier []",
+		}},
+		{"loop", []ir.IntermediateRepresentation{
+			mov,
+			ir.Label(".L0"), cmp, ir.JumpInst{JC: ir.GE, Addr: ".L2"},
+			mov, ir.JumpInst{JC: ir.MP, Addr: ".L0"},
+			// never reached
+			mov, ir.JumpInst{JC: ir.MP, Addr: ".L0"},
+			ir.Label(".L2"), ir.Ret(""),
+		}, []string{
+			"B0 preds [] succs [B1] idom - frontier []",
+			"B1 preds [B0 B2 B3] succs [B4 B2] idom B0 frontier [B1]",
+			"B2 preds [B1] succs [B1] idom B1 frontier [B1]",
+			"B3 preds [] succs [B1] idom - frontier []",
+			"B4 preds [B1] succs [] idom B1 frontier []",
+		}},
+	}
+	for _, test := range tests {
+		g := New(test.list)
+		if len(g.Blocks) != len(test.want) {
+			t.Errorf("%s: %d blocks, want %d\n%s", test.name, len(g.Blocks), len(test.want), g)
+			continue
+		}
+		for k, b := range g.Blocks {
+			if got := summary(g, b); got != test.want[k] {
+				t.Errorf("%s:\ngot  %s\nwant %s", test.name, got, test.want[k])
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package ir
+
+// IsLocal tells whether o is a temp, a variable or an SSA value, the
+// operands whose definitions and uses are tracked
+func IsLocal(o Operand) bool {
+	switch o.(type) {
+	case Temp, Var, Value:
+		return true
+	}
+	return false
+}
+
+func locals(list ...Operand) []Operand {
+	result := []Operand{}
+	for _, v := range list {
+		if v != nil && IsLocal(v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// Defs returns the locals inst writes
+func Defs(inst IntermediateRepresentation) []Operand {
+	switch inst := inst.(type) {
+	case CalcInst:
+		return locals(inst.Operand1)
+	case OneInst:
+		if inst.Operation == PUSH {
+			return nil
+		}
+		return locals(inst.Operand1)
+	case LoadInst:
+		return locals(inst.Dest)
+	case ThreeInst:
+		return locals(inst.Dest)
+	case PhiInst:
+		return locals(inst.Dest)
+	}
+	return nil
+}
+
+// Uses returns the locals inst reads. The operand of lea is not read,
+// only its address is taken. The arguments of a phi are read at the
+// end of the predecessors, they are returned all the same.
+func Uses(inst IntermediateRepresentation) []Operand {
+	switch inst := inst.(type) {
+	case CalcInst:
+		switch inst.Operation {
+		case MOV:
+			return locals(inst.Operand2)
+		case LEA:
+			return nil
+		}
+		return locals(inst.Operand1, inst.Operand2)
+	case OneInst:
+		if inst.Operation == POP {
+			return nil
+		}
+		return locals(inst.Operand1)
+	case CmpInst:
+		return locals(inst.Left, inst.Right)
+	case LoadInst:
+		return locals(inst.Addr)
+	case StoreInst:
+		return locals(inst.Addr, inst.Value)
+	case ThreeInst:
+		return locals(inst.Left, inst.Right)
+	case PhiInst:
+		result := []Operand{}
+		for _, v := range inst.Args {
+			result = append(result, locals(v.Value)...)
+		}
+		return result
+	}
+	return nil
+}
+
+// MapOperands returns inst with every local operand o replaced by
+// f(o, def), def telling whether inst writes o. The first operand of a
+// two-address instruction is both read and written and comes with def
+// set; the operand of lea, whose address is taken, is left alone.
+func MapOperands(inst IntermediateRepresentation,
+				 f func(o Operand, def bool) Operand) IntermediateRepresentation {
+	use := func(o Operand) Operand {
+		if o == nil || !IsLocal(o) {
+			return o
+		}
+		return f(o, false)
+	}
+	def := func(o Operand) Operand {
+		if !IsLocal(o) {
+			return o
+		}
+		return f(o, true)
+	}
+	switch inst := inst.(type) {
+	case CalcInst:
+		if inst.Operation != LEA {
+			inst.Operand2 = use(inst.Operand2)
+		}
+		inst.Operand1 = def(inst.Operand1)
+		return inst
+	case OneInst:
+		if inst.Operation == PUSH {
+			inst.Operand1 = use(inst.Operand1)
+		} else {
+			inst.Operand1 = def(inst.Operand1)
+		}
+		return inst
+	case CmpInst:
+		inst.Left = use(inst.Left)
+		inst.Right = use(inst.Right)
+		return inst
+	case LoadInst:
+		inst.Addr = use(inst.Addr)
+		inst.Dest = def(inst.Dest)
+		return inst
+	case StoreInst:
+		inst.Addr = use(inst.Addr)
+		inst.Value = use(inst.Value)
+		return inst
+	case ThreeInst:
+		inst.Left = use(inst.Left)
+		inst.Right = use(inst.Right)
+		inst.Dest = def(inst.Dest)
+		return inst
+	case PhiInst:
+		args := make([]PhiArg, len(inst.Args))
+		for k, v := range inst.Args {
+			args[k] = PhiArg{Pred: v.Pred, Value: use(v.Value)}
+		}
+		inst.Args = args
+		inst.Dest = def(inst.Dest)
+		return inst
+	}
+	return inst
+}
+
+// Registers returns the machine registers inst names, either as operands
+// or as the base of a memory operand like [%r12 + 8]. Registers a call or
+// a division touch without naming them are not included.
+func Registers(inst IntermediateRepresentation) []PhysReg {
+	result := []PhysReg{}
+	add := func(list ...Operand) {
+		for _, v := range list {
+			if m, ok := v.(Mem); ok {
+				v = m.Base
+			}
+			if r, ok := v.(PhysReg); ok {
+				result = append(result, r)
+			}
+		}
+	}
+	switch inst := inst.(type) {
+	case CalcInst:
+		add(inst.Operand1, inst.Operand2)
+	case OneInst:
+		add(inst.Operand1)
+	case CmpInst:
+		add(inst.Left, inst.Right)
+	case LoadInst:
+		add(inst.Dest, inst.Addr)
+	case StoreInst:
+		add(inst.Addr, inst.Value)
+	case ThreeInst:
+		add(inst.Dest, inst.Left, inst.Right)
+	case PhiInst:
+		add(inst.Dest)
+		for _, v := range inst.Args {
+			add(v.Value)
+		}
+	}
+	return result
+}
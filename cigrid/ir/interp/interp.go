@@ -0,0 +1,594 @@
+// Package interp runs the IR of a program without an assembler. It
+// simulates the machine the backend targets: the registers, one byte
+// addressed memory holding the strings, the globals and the stack, and
+// frames laid out as package asm lays them out, so taking addresses,
+// push/pop pairs and arguments passed on the stack all behave as they do
+// in the compiled program. printf is provided by a built-in formatter.
+package interp
+
+import "cigrid/ir"
+import "cigrid/ir_translator"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "strconv"
+
+const (
+	dataStart = 0x1000   // addresses below it are never valid, so NULL faults
+	stackSize = 1 << 20  // bytes
+	returnAddress = 0x0badc0de // pushed by call, only checked on ret
+	scrambled = 0x5ca1ab1e     // caller-saved registers after a built-in call
+)
+
+// calleeSaved are preserved across calls, see package asm
+var calleeSaved = []string{"rbx", "rbp", "rsp", "r12", "r13", "r14", "r15"}
+
+var callerSaved = []string{"rax", "rcx", "rdx", "rsi", "rdi", "r8", "r9", "r10", "r11"}
+
+var argumentRegisters = []string{"rdi", "rsi", "rdx", "rcx", "r8", "r9"}
+
+// ErrDivisionByZero is the Err of a RuntimeError for a zero divisor, the
+// one error the compiled program can trap
+var ErrDivisionByZero = errors.New("division by zero")
+
+// RuntimeError is an error of the interpreted program, e.g. a division
+// by zero or a bad memory access
+type RuntimeError struct {
+	Function string
+	Inst     string // the instruction that failed, "" if none
+	Message  string
+	Err      error  // ErrDivisionByZero or nil
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Inst == "" {
+		return e.Function + ": " + e.Message
+	}
+	return e.Function + ": " + e.Inst + ": " + e.Message
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// function is an IrFunction prepared for running
+type function struct {
+	ir     *ir_translator.IrFunction
+	labels map[string]int // label -> index in the IR list
+	depth  int            // bytes below rbp taken by slots and temps
+	saves  []string       // callee-saved registers the prologue pushes
+}
+
+type Machine struct {
+	functions map[string]*function
+	symbols   map[string]int64 // address of every string and global
+	memory    []byte
+	registers map[string]int64
+	left      int64 // operands of the last cmp
+	right     int64
+	out       io.Writer
+	steps     int
+	limit     int // 0: no limit
+}
+
+// New loads the program held by t. The output of printf goes to out.
+func New(t *ir_translator.IrTranslator, out io.Writer) *Machine {
+	m := &Machine{
+		functions: make(map[string]*function),
+		symbols: make(map[string]int64),
+		registers: make(map[string]int64),
+		out: out,
+	}
+	for _, v := range t.ReadIrFunctionList() {
+		f := &function{ir: v, labels: make(map[string]int)}
+		for k, inst := range v.ReadIrList() {
+			if label, ok := inst.(ir.Label); ok {
+				f.labels[string(label)] = k
+			}
+		}
+		f.depth = (v.ReadMaxRegister() + v.ReadFrameSize()) * 8
+		used := map[string]bool{}
+		for _, inst := range v.ReadIrList() {
+			for _, r := range ir.Registers(inst) {
+				used[string(r)] = true
+			}
+		}
+		for _, r := range calleeSaved {
+			if used[r] && r != "rbp" && r != "rsp" {
+				f.saves = append(f.saves, r)
+			}
+		}
+		m.functions[v.ReadName()] = f
+	}
+	m.load(t)
+	return m
+}
+
+// Limit stops the program with an error after n instructions, so that
+// an endless loop cannot hang a test. 0 means no limit.
+func (m *Machine) Limit(n int) {
+	m.limit = n
+}
+
+// load lays out the strings and globals and makes room for the stack
+func (m *Machine) load(t *ir_translator.IrTranslator) {
+	data := []byte{}
+	align := func() {
+		for len(data) % 8 != 0 {
+			data = append(data, 0)
+		}
+	}
+	for k, v := range t.ReadStringList() {
+		m.symbols["str" + strconv.Itoa(k + 1)] = int64(dataStart + len(data))
+		data = append(data, v...)
+		data = append(data, 0)
+		align()
+	}
+	globals := t.ReadGlobalList()
+	for _, v := range globals {
+		m.symbols[v.Name] = int64(dataStart + len(data))
+		data = append(data, make([]byte, v.Size * 8)...)
+	}
+	m.memory = make([]byte, dataStart + len(data) + stackSize)
+	copy(m.memory[dataStart:], data)
+	// initialisers may name a string or another global, so they are
+	// written once every symbol has its address
+	for _, g := range globals {
+		for k, v := range g.Values {
+			value, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				value = m.symbols[v]
+			}
+			m.write(m.symbols[g.Name] + int64(k * 8), value)
+		}
+	}
+	m.registers["rsp"] = int64(len(m.memory))
+}
+
+func (m *Machine) valid(addr int64, size int64) bool {
+	return addr >= dataStart && addr + size <= int64(len(m.memory))
+}
+
+func (m *Machine) read(addr int64) int64 {
+	return int64(binary.LittleEndian.Uint64(m.memory[addr:]))
+}
+
+func (m *Machine) write(addr int64, value int64) {
+	binary.LittleEndian.PutUint64(m.memory[addr:], uint64(value))
+}
+
+// Run calls main and returns its exit status as the shell would see it,
+// the low byte of the return value
+func (m *Machine) Run() (int, error) {
+	if _, ok := m.functions["main"]; !ok {
+		return 0, &RuntimeError{Function: "main", Message: "no function main"}
+	}
+	if err := m.call("main", "main"); err != nil {
+		return 0, err
+	}
+	return int(m.registers["rax"] & 0xff), nil
+}
+
+// frame is the function being run
+type frame struct {
+	m    *Machine
+	f    *function
+	inst ir.IntermediateRepresentation
+}
+
+func (fr *frame) fail(format string, args ...interface{}) error {
+	e := &RuntimeError{Function: fr.f.ir.ReadName(), Message: fmt.Sprintf(format, args...)}
+	if fr.inst != nil {
+		e.Inst = fr.inst.IrString()
+	}
+	return e
+}
+
+// divisionByZero fails with ErrDivisionByZero
+func (fr *frame) divisionByZero() error {
+	e := fr.fail("%v", ErrDivisionByZero).(*RuntimeError)
+	e.Err = ErrDivisionByZero
+	return e
+}
+
+func (fr *frame) push(value int64) error {
+	m := fr.m
+	rsp := m.registers["rsp"] - 8
+	if rsp < int64(len(m.memory) - stackSize) {
+		return fr.fail("stack overflow")
+	}
+	m.registers["rsp"] = rsp
+	m.write(rsp, value)
+	return nil
+}
+
+func (fr *frame) pop() (int64, error) {
+	m := fr.m
+	rsp := m.registers["rsp"]
+	if rsp + 8 > int64(len(m.memory)) {
+		return 0, fr.fail("pop from an empty stack")
+	}
+	m.registers["rsp"] = rsp + 8
+	return m.read(rsp), nil
+}
+
+// address gives the location of a Var, Temp or Mem operand, as package
+// asm places them
+func (fr *frame) address(o ir.Operand) (int64, error) {
+	m := fr.m
+	frameSize := fr.f.ir.ReadFrameSize()
+	switch o := o.(type) {
+	case ir.Var:
+		slot, ok := fr.f.ir.ReadAddressMap()[string(o)]
+		if !ok {
+			return 0, fr.fail("unknown variable `%s`", string(o))
+		}
+		return m.registers["rbp"] - int64((frameSize - slot) * 8), nil
+	case ir.Temp:
+		return m.registers["rbp"] - int64((int(o) + frameSize + 1) * 8), nil
+	case ir.Mem:
+		base, err := fr.value(o.Base)
+		if err != nil {
+			return 0, err
+		}
+		return base + int64(o.Offset), nil
+	}
+	return 0, fr.fail("`%s` has no address", o.OperandString())
+}
+
+func (fr *frame) value(o ir.Operand) (int64, error) {
+	m := fr.m
+	switch o := o.(type) {
+	case ir.Imm:
+		return int64(o), nil
+	case ir.PhysReg:
+		return m.registers[string(o)], nil
+	case ir.Global:
+		addr, ok := m.symbols[string(o)]
+		if !ok {
+			return 0, fr.fail("unknown label `%s`", string(o))
+		}
+		return addr, nil
+	}
+	addr, err := fr.address(o)
+	if err != nil {
+		return 0, err
+	}
+	return fr.load(addr)
+}
+
+func (fr *frame) load(addr int64) (int64, error) {
+	if !fr.m.valid(addr, 8) {
+		return 0, fr.fail("read from invalid address %#x", addr)
+	}
+	return fr.m.read(addr), nil
+}
+
+func (fr *frame) store(addr int64, value int64) error {
+	if !fr.m.valid(addr, 8) {
+		return fr.fail("write to invalid address %#x", addr)
+	}
+	fr.m.write(addr, value)
+	return nil
+}
+
+func (fr *frame) set(o ir.Operand, value int64) error {
+	if reg, ok := o.(ir.PhysReg); ok {
+		fr.m.registers[string(reg)] = value
+		return nil
+	}
+	addr, err := fr.address(o)
+	if err != nil {
+		return err
+	}
+	return fr.store(addr, value)
+}
+
+// call runs the function name like a call instruction: it pushes the
+// return address, and the callee sets up and tears down its frame and
+// restores the callee-saved registers it uses. Afterwards the other
+// caller-saved registers but rax hold garbage.
+func (m *Machine) call(caller string, name string) error {
+	f, ok := m.functions[name]
+	if !ok {
+		return m.builtin(caller, name)
+	}
+	fr := &frame{m: m, f: f}
+	saved := map[string]int64{}
+	for _, v := range calleeSaved {
+		saved[v] = m.registers[v]
+	}
+	// call; push rbp; mov rbp, rsp; sub rsp, depth
+	if err := fr.push(returnAddress); err != nil {
+		return err
+	}
+	if err := fr.push(m.registers["rbp"]); err != nil {
+		return err
+	}
+	m.registers["rbp"] = m.registers["rsp"]
+	m.registers["rsp"] -= int64(f.depth)
+	if m.registers["rsp"] < int64(len(m.memory) - stackSize) {
+		return fr.fail("stack overflow")
+	}
+	if err := fr.run(); err != nil {
+		return err
+	}
+	// pop the saved registers; leave; ret
+	for _, v := range f.saves {
+		m.registers[v] = saved[v]
+	}
+	m.registers["rsp"] = m.registers["rbp"]
+	rbp, err := fr.pop()
+	if err != nil {
+		return err
+	}
+	m.registers["rbp"] = rbp
+	if ret, err := fr.pop(); err != nil {
+		return err
+	} else if ret != returnAddress {
+		return fr.fail("return address overwritten")
+	}
+	for _, v := range calleeSaved {
+		if m.registers[v] != saved[v] {
+			return fr.fail("callee-saved register %s not restored", v)
+		}
+	}
+	rax := m.registers["rax"]
+	m.scramble()
+	m.registers["rax"] = rax
+	return nil
+}
+
+// run executes the instructions of the frame up to a ret
+func (fr *frame) run() error {
+	m := fr.m
+	list := fr.f.ir.ReadIrList()
+	for pc := 0; pc < len(list); pc++ {
+		fr.inst = list[pc]
+		m.steps++
+		if m.limit > 0 && m.steps > m.limit {
+			return fr.fail("stopped after %d instructions", m.limit)
+		}
+		switch inst := list[pc].(type) {
+		case ir.Label:
+		case ir.Ret:
+			return nil
+		case ir.CalcInst:
+			if err := fr.calc(inst); err != nil {
+				return err
+			}
+		case ir.OneInst:
+			if err := fr.one(inst); err != nil {
+				return err
+			}
+		case ir.CmpInst:
+			left, err := fr.value(inst.Left)
+			if err != nil {
+				return err
+			}
+			right, err := fr.value(inst.Right)
+			if err != nil {
+				return err
+			}
+			m.left, m.right = left, right
+		case ir.JumpInst:
+			if !taken(inst.JC, m.left, m.right) {
+				continue
+			}
+			target, ok := fr.f.labels[inst.Addr]
+			if !ok {
+				return fr.fail("unknown label `%s`", inst.Addr)
+			}
+			pc = target
+		case ir.CallInst:
+			if err := fr.call(inst); err != nil {
+				return err
+			}
+		case ir.LoadInst:
+			addr, err := fr.value(inst.Addr)
+			if err != nil {
+				return err
+			}
+			value, err := fr.load(addr)
+			if err != nil {
+				return err
+			}
+			if err := fr.set(inst.Dest, value); err != nil {
+				return err
+			}
+		case ir.StoreInst:
+			addr, err := fr.value(inst.Addr)
+			if err != nil {
+				return err
+			}
+			value, err := fr.value(inst.Value)
+			if err != nil {
+				return err
+			}
+			if err := fr.store(addr + int64(inst.Offset), value); err != nil {
+				return err
+			}
+		default:
+			return fr.fail("unsupported instruction")
+		}
+	}
+	fr.inst = nil
+	return fr.fail("end of function reached without ret")
+}
+
+// call makes a call, keeping the registers it saves in the top temp
+// slots meanwhile
+func (fr *frame) call(inst ir.CallInst) error {
+	m := fr.m
+	top := fr.f.ir.ReadMaxRegister() - 1
+	for k, r := range inst.Saved {
+		if err := fr.set(ir.Temp(top - k), m.registers[string(r)]); err != nil {
+			return err
+		}
+	}
+	if err := m.call(fr.f.ir.ReadName(), inst.FuntionName); err != nil {
+		return err
+	}
+	for k, r := range inst.Saved {
+		value, err := fr.value(ir.Temp(top - k))
+		if err != nil {
+			return err
+		}
+		m.registers[string(r)] = value
+	}
+	return nil
+}
+
+func taken(jc ir.JumpType, left int64, right int64) bool {
+	switch jc {
+	case ir.MP:
+		return true
+	case ir.E:
+		return left == right
+	case ir.NE:
+		return left != right
+	case ir.G:
+		return left > right
+	case ir.L:
+		return left < right
+	case ir.GE:
+		return left >= right
+	case ir.LE:
+		return left <= right
+	}
+	return false
+}
+
+func (fr *frame) calc(inst ir.CalcInst) error {
+	m := fr.m
+	if inst.Operation == ir.LEA {
+		addr, err := fr.address(inst.Operand2)
+		if err != nil {
+			return err
+		}
+		return fr.set(inst.Operand1, addr)
+	}
+	a, err := fr.value(inst.Operand1)
+	if err != nil {
+		return err
+	}
+	b, err := fr.value(inst.Operand2)
+	if err != nil {
+		return err
+	}
+	var result int64
+	switch inst.Operation {
+	case ir.ADD:
+		result = a + b
+	case ir.SUB:
+		result = a - b
+	case ir.MOV:
+		result = b
+	case ir.XOR:
+		result = a ^ b
+	case ir.MUL:
+		// lowered through rax, rdx gets the high half
+		result = a * b
+		m.registers["rdx"] = 0
+		if (a < 0) != (b < 0) && result != 0 {
+			m.registers["rdx"] = -1
+		}
+		m.registers["rax"] = result
+	case ir.DIV:
+		if b == 0 {
+			return fr.divisionByZero()
+		}
+		// lowered through rax, rdx gets the remainder
+		result = a / b
+		m.registers["rax"] = result
+		m.registers["rdx"] = a % b
+	case ir.MOD:
+		if b == 0 {
+			return fr.divisionByZero()
+		}
+		result = a % b
+		m.registers["rax"] = a / b
+		m.registers["rdx"] = result
+	default:
+		return fr.fail("unsupported operation")
+	}
+	return fr.set(inst.Operand1, result)
+}
+
+func (fr *frame) one(inst ir.OneInst) error {
+	switch inst.Operation {
+	case ir.NEG:
+		value, err := fr.value(inst.Operand1)
+		if err != nil {
+			return err
+		}
+		return fr.set(inst.Operand1, -value)
+	case ir.PUSH:
+		value, err := fr.value(inst.Operand1)
+		if err != nil {
+			return err
+		}
+		return fr.push(value)
+	case ir.POP:
+		value, err := fr.pop()
+		if err != nil {
+			return err
+		}
+		return fr.set(inst.Operand1, value)
+	}
+	return fr.fail("unsupported operation")
+}
+
+// argument returns argument k (from 0) of a call being made: the
+// registers first, then the stack above the return address
+func (m *Machine) argument(k int) (int64, bool) {
+	if k < len(argumentRegisters) {
+		return m.registers[argumentRegisters[k]], true
+	}
+	addr := m.registers["rsp"] + int64((k - len(argumentRegisters)) * 8)
+	if !m.valid(addr, 8) {
+		return 0, false
+	}
+	return m.read(addr), true
+}
+
+// builtin runs a library function, printf being the only one sema
+// declares. Afterwards the caller-saved
+// registers hold garbage, as a real call may leave them.
+func (m *Machine) builtin(caller string, name string) error {
+	var err error
+	switch name {
+	case "printf":
+		var n int
+		n, err = m.printf()
+		m.scramble()
+		m.registers["rax"] = int64(n)
+	default:
+		err = fmt.Errorf("call to unknown function `%s`", name)
+	}
+	if err != nil {
+		return &RuntimeError{Function: caller, Inst: "call " + name, Message: err.Error()}
+	}
+	return nil
+}
+
+func (m *Machine) scramble() {
+	for _, v := range callerSaved {
+		m.registers[v] = scrambled
+	}
+}
+
+// cString reads the NUL terminated string at addr
+func (m *Machine) cString(addr int64) (string, error) {
+	end := addr
+	for {
+		if !m.valid(end, 1) {
+			return "", fmt.Errorf("string at invalid address %#x", addr)
+		}
+		if m.memory[end] == 0 {
+			return string(m.memory[addr:end]), nil
+		}
+		end++
+	}
+}
@@ -0,0 +1,161 @@
+package interp
+
+import "bytes"
+import "cigrid/diag"
+import "cigrid/ir_translator"
+import "cigrid/lexer"
+import "cigrid/parser"
+import "cigrid/sema"
+import "errors"
+import "strings"
+import "testing"
+
+// translate takes source through the front end, as the driver does
+func translate(t *testing.T, source string) *ir_translator.IrTranslator {
+	var diags diag.List
+	l := lexer.New("test.c", source)
+	tokList := l.Scan()
+	diags.Append(l.Diagnostics())
+	p := parser.New(tokList)
+	tree := p.ParseProgram()
+	diags.Append(p.Diagnostics())
+	a := sema.New(tree)
+	info := a.Analyze()
+	diags.Append(a.Diagnostics())
+	c := sema.NewChecker(tree, info)
+	c.Check()
+	diags.Append(c.Diagnostics())
+	tr := ir_translator.New(tree, info)
+	tr.Translate()
+	diags.Append(tr.Diagnostics())
+	for _, d := range diags.Items() {
+		if d.Severity == diag.Error {
+			t.Fatalf("%d:%d: %s", d.Span.Start.Line, d.Span.Start.Column, d.Message)
+		}
+	}
+	return tr
+}
+
+// limit is far more than any of the programs below needs
+const limit = 100000
+
+var programs = []struct {
+	name   string
+	source string
+	out    string
+	code   int
+}{
+	{"arrays", `
+int main() {
+	int a[5];
+	int i = 0;
+	while (i < 5) {
+		a[i] = i * i;
+		i = i + 1;
+	}
+	int m[2][3] = {{1, 2, 3}, {4, 5, 6}};
+	printf("%d %d %d\n", a[4], a[2] + a[3], m[1][2] - m[0][1]);
+	return a[3];
+}`, "16 13 4\n", 9},
+	{"pointers", `
+void swap(int *x, int *y) {
+	int t = *x;
+	*x = *y;
+	*y = t;
+	return;
+}
+int main() {
+	int a = 3;
+	int b = 4;
+	int *p = &a;
+	swap(p, &b);
+	*p = *p * 10;
+	printf("%d %d\n", a, b);
+	return 0;
+}`, "40 3\n", 0},
+	{"stack arguments", `
+int f(int a, int b, int c, int d, int e, int g, int h, int i) {
+	return a - b + c - d + e - g + h * 100 + i * 1000;
+}
+int main() {
+	printf("%d\n", f(1, 2, 3, 4, 5, 6, 7, 8));
+	return f(0, 0, 0, 0, 0, 0, 0, 0);
+}`, "8697\n", 0},
+	{"short circuit", `
+int calls = 0;
+int touch(int v) {
+	calls = calls + 1;
+	return v;
+}
+int main() {
+	int n = 0;
+	if (touch(0) && touch(1)) { n = n + 1; }
+	if (touch(1) || touch(0)) { n = n + 10; }
+	if (!(touch(1) && touch(0)) && (touch(0) || touch(1))) { n = n + 100; }
+	printf("%d %d\n", n, calls);
+	return 0;
+}`, "110 6\n", 0},
+	{"remainder", `
+int main() {
+	int a = 17;
+	int b = -5;
+	printf("%d %d %d %d\n", a / b, a % b, -a % 5, a % 4);
+	return a % 6;
+}`, "-3 2 -2 1\n", 5},
+}
+
+func TestRun(t *testing.T) {
+	for _, test := range programs {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			m := New(translate(t, test.source), &out)
+			m.Limit(limit)
+			code, err := m.Run()
+			if err != nil {
+				t.Fatalf("runtime error: %v", err)
+			}
+			if out.String() != test.out {
+				t.Errorf("printed %q, want %q", out.String(), test.out)
+			}
+			if code != test.code {
+				t.Errorf("exit status %d, want %d", code, test.code)
+			}
+		})
+	}
+}
+
+func TestRuntimeError(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		message string
+		cause   error
+	}{
+		{"endless loop", `
+int main() {
+	int i = 0;
+	while (1) {
+		i = i + 1;
+	}
+	return i;
+}`, "stopped after", nil},
+		{"division by zero", `
+int main() {
+	int z = 0;
+	return 5 / z;
+}`, "division by zero", ErrDivisionByZero},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := New(translate(t, test.source), &bytes.Buffer{})
+			m.Limit(limit)
+			_, err := m.Run()
+			if e, ok := err.(*RuntimeError); !ok || !strings.Contains(e.Message, test.message) {
+				t.Errorf("got %v, want a runtime error saying %q", err, test.message)
+			}
+			if errors.Is(err, ErrDivisionByZero) != (test.cause == ErrDivisionByZero) {
+				t.Errorf("%v: cause %v, want %v", err, errors.Unwrap(err), test.cause)
+			}
+		})
+	}
+}
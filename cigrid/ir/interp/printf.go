@@ -0,0 +1,105 @@
+package interp
+
+import "bytes"
+import "fmt"
+import "strings"
+
+// printf formats like C printf for the conversions cigrid programs use:
+// d i u x X o c s p and %%, with flags, width, precision and the l, ll,
+// h and hh length modifiers. Without a length modifier an int is 32 bits,
+// as in C. It returns the number of bytes written.
+func (m *Machine) printf() (int, error) {
+	format, err := m.cString(m.registers["rdi"])
+	if err != nil {
+		return 0, err
+	}
+	var out bytes.Buffer
+	next := 1
+	argument := func() (int64, error) {
+		value, ok := m.argument(next)
+		if !ok {
+			return 0, fmt.Errorf("printf argument %d is missing", next)
+		}
+		next++
+		return value, nil
+	}
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			out.WriteByte(format[i])
+			continue
+		}
+		start := i
+		i++
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		for i < len(format) && (format[i] >= '0' && format[i] <= '9' || format[i] == '.') {
+			i++
+		}
+		spec := format[start:i] // % flags width precision
+		length := ""
+		for i < len(format) && strings.IndexByte("lhzjt", format[i]) >= 0 {
+			length += string(format[i])
+			i++
+		}
+		if i >= len(format) {
+			return 0, fmt.Errorf("printf format ends inside a conversion")
+		}
+		conversion := format[i]
+		if conversion == '%' {
+			out.WriteByte('%')
+			continue
+		}
+		value, err := argument()
+		if err != nil {
+			return 0, err
+		}
+		switch conversion {
+		case 'd', 'i':
+			fmt.Fprintf(&out, spec + "d", signed(value, length))
+		case 'u':
+			fmt.Fprintf(&out, spec + "d", unsigned(value, length))
+		case 'x', 'X', 'o':
+			fmt.Fprintf(&out, spec + string(conversion), unsigned(value, length))
+		case 'c':
+			fmt.Fprintf(&out, strings.Split(spec, ".")[0] + "c", rune(byte(value)))
+		case 's':
+			s, err := m.cString(value)
+			if err != nil {
+				return 0, err
+			}
+			fmt.Fprintf(&out, spec + "s", s)
+		case 'p':
+			fmt.Fprintf(&out, "%#x", uint64(value))
+		default:
+			return 0, fmt.Errorf("printf conversion %%%c is not supported", conversion)
+		}
+	}
+	n, err := m.out.Write(out.Bytes())
+	return n, err
+}
+
+// signed truncates a register to the size named by a length modifier
+func signed(value int64, length string) int64 {
+	switch length {
+	case "hh":
+		return int64(int8(value))
+	case "h":
+		return int64(int16(value))
+	case "":
+		return int64(int32(value))
+	}
+	return value
+}
+
+func unsigned(value int64, length string) uint64 {
+	switch length {
+	case "hh":
+		return uint64(uint8(value))
+	case "h":
+		return uint64(uint16(value))
+	case "":
+		return uint64(uint32(value))
+	}
+	return uint64(value)
+}
@@ -13,6 +13,7 @@ const (
 	XOR = "xor"
 	MUL = "imul"
 	DIV = "idiv"
+	MOD = "mod" // idiv too, keeping the remainder
 	NEG = "neg"
 	PUSH = "push"
 	POP = "pop"
@@ -27,43 +28,67 @@ type Operand interface {
 	OperandString() string 
 }
 
+// Temp is temp register N of a function. The translator numbers them
+// per statement; the backend gives each a stack slot.
+type Temp int
+func (t Temp) OperandString() string { return "temp" + strconv.Itoa(int(t)) }
+
+// Var is a local variable or parameter by its unique name, like x.1
+type Var string
+func (v Var) OperandString() string { return string(v) }
+
+// Imm is an immediate integer
+type Imm int64
+func (i Imm) OperandString() string { return strconv.FormatInt(int64(i), 10) }
+
+// PhysReg is a machine register, like rax
+type PhysReg string
+func (p PhysReg) OperandString() string { return "%" + string(p) }
+
+// Global is the address of a label in the data section, a global
+// variable like g_x or a string like str1
+type Global string
+func (g Global) OperandString() string { return "@" + string(g) }
+
+// Value is version N of a temp or variable in SSA form, printed temp3#2.
+// Version 0 is the value on entry, i.e. undefined for a temp.
+type Value struct {
+	Of Operand // Temp or Var
+	N  int
+}
+func (v Value) OperandString() string { return v.Of.OperandString() + "#" + strconv.Itoa(v.N) }
+
+// Mem is the qword at Base + Offset. Base is a PhysReg or a Global.
+type Mem struct {
+	Base   Operand
+	Offset int
+}
+func (m Mem) OperandString() string {
+	out := "[" + m.Base.OperandString()
+	if m.Offset > 0 {
+		out += " + " + strconv.Itoa(m.Offset)
+	} else if m.Offset < 0 {
+		out += " - " + strconv.Itoa(-m.Offset)
+	}
+	return out + "]"
+}
+
 type CalcInst struct {
 	Operation Op
-	Operand1 interface{}
-	Operand2 interface{}
+	Operand1  Operand // destination
+	Operand2  Operand
 }
 func (ci CalcInst) IrString() string {
-	var out bytes.Buffer 
-	out.WriteString(string(ci.Operation))
-	out.WriteString(" ")
-	if temp, ok := ci.Operand1.(int); ok {
-		out.WriteString("temp" + strconv.Itoa(temp))
-	} else if temp, ok := ci.Operand1.(string); ok {
-		out.WriteString(temp)
-	}
-	out.WriteString(" ")
-	if temp, ok := ci.Operand2.(int); ok {
-		out.WriteString("temp" + strconv.Itoa(temp))
-	} else if temp, ok := ci.Operand2.(string); ok {
-		out.WriteString(temp)
-	}
-	return out.String()
+	return string(ci.Operation) + " " + ci.Operand1.OperandString() + " " + 
+		ci.Operand2.OperandString()
 }
 
 type OneInst struct {
 	Operation Op
-	Operand1 interface{}
+	Operand1  Operand
 }
 func (oi OneInst) IrString() string {
-	var out bytes.Buffer
-	out.WriteString(string(oi.Operation))
-	out.WriteString(" ")
-	if temp, ok := oi.Operand1.(int); ok {
-		out.WriteString("temp" + strconv.Itoa(temp))
-	} else if temp, ok := oi.Operand1.(string); ok {
-		out.WriteString(temp)
-	}
-	return out.String()
+	return string(oi.Operation) + " " + oi.Operand1.OperandString()
 }
 
 type Label string 
@@ -95,24 +120,95 @@ func (ji JumpInst) IrString() string {
 }
 
 type CmpInst struct {
-	Left int 
-	Right int 
+	Left  Operand
+	Right Operand
 }
 func (ci CmpInst) IrString() string {
-	var out bytes.Buffer 
-	out.WriteString("cmp ")
-	out.WriteString("temp" + strconv.Itoa(ci.Left))
-	out.WriteString(" ")
-	out.WriteString("temp" + strconv.Itoa(ci.Right))
-	return out.String()
+	return "cmp " + ci.Left.OperandString() + " " + ci.Right.OperandString()
 }
 
+// CallInst calls a function with Args of its arguments in registers,
+// printed "call f 2 %rcx %rsi". Saved are the caller-saved registers
+// live across the call; the call keeps Saved[i] in the i-th temp slot
+// from the top of the frame, temp maxRegister - 1 - i, while it runs.
 type CallInst struct {
 	FuntionName string 
+	Args        int
+	Saved       []PhysReg
 }
 func (ci CallInst) IrString() string {
 	var out bytes.Buffer 
 	out.WriteString("call ")
 	out.WriteString(ci.FuntionName)
+	out.WriteString(" " + strconv.Itoa(ci.Args))
+	for _, v := range ci.Saved {
+		out.WriteString(" " + v.OperandString())
+	}
+	return out.String()
+}
+// LoadInst reads the qword at the address held by Addr into Dest
+type LoadInst struct {
+	Dest Operand
+	Addr Operand
+}
+func (li LoadInst) IrString() string {
+	return "load " + li.Dest.OperandString() + " [" + li.Addr.OperandString() + "]"
+}
+
+// StoreInst writes Value to the address held by Addr plus Offset bytes
+type StoreInst struct {
+	Addr   Operand
+	Offset int
+	Value  Operand
+}
+func (si StoreInst) IrString() string {
+	var out bytes.Buffer
+	out.WriteString("store [" + si.Addr.OperandString())
+	if si.Offset != 0 {
+		out.WriteString(" + " + strconv.Itoa(si.Offset))
+	}
+	out.WriteString("] " + si.Value.OperandString())
 	return out.String()
-}
\ No newline at end of file
+}
+
+// ThreeInst is the three-address form of an arithmetic instruction used
+// in SSA form: Dest = Left op Right. Right is nil for neg.
+type ThreeInst struct {
+	Operation Op
+	Dest      Operand
+	Left      Operand
+	Right     Operand
+}
+func (ti ThreeInst) IrString() string {
+	out := ti.Dest.OperandString() + " = " + string(ti.Operation) + " " +
+		ti.Left.OperandString()
+	if ti.Right != nil {
+		out += " " + ti.Right.OperandString()
+	}
+	return out
+}
+
+// PhiArg is the value a phi takes when control comes from the block
+// starting with label Pred
+type PhiArg struct {
+	Pred  string
+	Value Operand
+}
+
+// PhiInst chooses between the values reaching a join point in SSA form.
+// The phis of a block come right after its label.
+type PhiInst struct {
+	Dest Operand
+	Args []PhiArg
+}
+func (pi PhiInst) IrString() string {
+	var out bytes.Buffer
+	out.WriteString(pi.Dest.OperandString() + " = phi")
+	for k, v := range pi.Args {
+		if k > 0 {
+			out.WriteString(",")
+		}
+		out.WriteString(" " + v.Pred + ": " + v.Value.OperandString())
+	}
+	return out.String()
+}
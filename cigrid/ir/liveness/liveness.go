@@ -0,0 +1,266 @@
+// Package liveness finds what is live before and after every instruction
+// of a function: the temps, variables and SSA values, and the machine
+// registers but rsp and rbp, which hold the frame. Calls, returns and
+// the lowering of imul and idiv read and write registers the IR does not
+// name; Defs and Uses include those. A call writes the caller-saved
+// registers but those it saves.
+package liveness
+
+import "cigrid/ir"
+import "cigrid/ir/cfg"
+
+// Set is a set of locals and registers
+type Set map[ir.Operand]bool
+
+func (s Set) copy() Set {
+	result := Set{}
+	for k := range s {
+		result[k] = true
+	}
+	return result
+}
+
+var argumentRegisters = []ir.PhysReg{"rdi", "rsi", "rdx", "rcx", "r8", "r9"}
+
+// CallerSaved are the registers a call may change, System V AMD64 ABI
+var CallerSaved = []ir.PhysReg{"rax", "rcx", "rdx", "rsi", "rdi", "r8", "r9", "r10", "r11"}
+
+// tracked tells whether o is followed: locals and the registers but the
+// ones of the frame
+func tracked(o ir.Operand) bool {
+	if r, ok := o.(ir.PhysReg); ok {
+		return r != "rsp" && r != "rbp"
+	}
+	return ir.IsLocal(o)
+}
+
+// Defs returns the locals and registers inst writes
+func Defs(inst ir.IntermediateRepresentation) []ir.Operand {
+	result := ir.Defs(inst)
+	switch inst := inst.(type) {
+	case ir.CalcInst:
+		if inst.Operation == ir.MUL || inst.Operation == ir.DIV ||
+		   inst.Operation == ir.MOD {
+			// lowered through rax, rdx gets the high half or the remainder
+			result = append(result, ir.PhysReg("rax"), ir.PhysReg("rdx"))
+		}
+		if r, ok := inst.Operand1.(ir.PhysReg); ok && tracked(r) {
+			result = append(result, r)
+		}
+	case ir.OneInst:
+		if r, ok := inst.Operand1.(ir.PhysReg); ok && tracked(r) && inst.Operation != ir.PUSH {
+			result = append(result, r)
+		}
+	case ir.LoadInst:
+		if r, ok := inst.Dest.(ir.PhysReg); ok && tracked(r) {
+			result = append(result, r)
+		}
+	case ir.CallInst:
+		// but those it saves
+		for _, v := range CallerSaved {
+			saved := false
+			for _, r := range inst.Saved {
+				saved = saved || r == v
+			}
+			if !saved {
+				result = append(result, v)
+			}
+		}
+	}
+	return result
+}
+
+// Uses returns the locals and registers inst reads. `xor r r` only
+// writes r, whatever it held before.
+func Uses(inst ir.IntermediateRepresentation) []ir.Operand {
+	result := ir.Uses(inst)
+	registers := ir.Registers(inst)
+	switch inst := inst.(type) {
+	case ir.CalcInst:
+		if inst.Operation == ir.XOR && inst.Operand1 == inst.Operand2 {
+			return nil
+		}
+		if r, ok := inst.Operand1.(ir.PhysReg); ok && (inst.Operation == ir.MOV ||
+		   inst.Operation == ir.LEA) {
+			// written, not read
+			registers = without(registers, r)
+		}
+	case ir.OneInst:
+		if r, ok := inst.Operand1.(ir.PhysReg); ok && inst.Operation == ir.POP {
+			registers = without(registers, r)
+		}
+	case ir.LoadInst:
+		if r, ok := inst.Dest.(ir.PhysReg); ok {
+			registers = without(registers, r)
+		}
+	case ir.CallInst:
+		// rax holds the number of vector registers of a variadic call
+		result = append(result, ir.PhysReg("rax"))
+		for k := 0; k < inst.Args && k < len(argumentRegisters); k++ {
+			result = append(result, argumentRegisters[k])
+		}
+	case ir.Ret:
+		result = append(result, ir.PhysReg("rax"))
+	}
+	for _, v := range registers {
+		if tracked(v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// without removes one occurrence of r, the one the instruction writes
+func without(list []ir.PhysReg, r ir.PhysReg) []ir.PhysReg {
+	for k, v := range list {
+		if v == r {
+			return append(append([]ir.PhysReg{}, list[:k]...), list[k + 1:]...)
+		}
+	}
+	return list
+}
+
+// Info holds what is live around each instruction of a list
+type Info struct {
+	in  []Set
+	out []Set
+}
+
+// LiveIn returns what is live right before instruction k
+func (l *Info) LiveIn(k int) Set {
+	return l.in[k]
+}
+
+// LiveOut returns what is live right after instruction k
+func (l *Info) LiveOut(k int) Set {
+	return l.out[k]
+}
+
+// Analyze solves the liveness of list per block, then walks every block
+// backwards to find it around each instruction. The arguments of a phi
+// are live at the end of the predecessor they come from, not before the
+// phi.
+func Analyze(list []ir.IntermediateRepresentation) *Info {
+	g := cfg.New(list)
+	start := map[*cfg.Block]int{} // index of the first instruction in list
+	n := 0
+	for _, b := range g.Blocks {
+		start[b] = n
+		n += len(b.Insts)
+	}
+	// the uses before any definition and the definitions of each block,
+	// and what the phis of a block read from each predecessor
+	gen := map[*cfg.Block]Set{}
+	kill := map[*cfg.Block]Set{}
+	phiUses := map[*cfg.Block]Set{}
+	for _, b := range g.Blocks {
+		gen[b], kill[b] = Set{}, Set{}
+		for _, inst := range b.Insts {
+			if phi, ok := inst.(ir.PhiInst); ok {
+				for _, arg := range phi.Args {
+					if pred := g.Block(arg.Pred); pred != nil && tracked(arg.Value) {
+						if phiUses[pred] == nil {
+							phiUses[pred] = Set{}
+						}
+						phiUses[pred][arg.Value] = true
+					}
+				}
+			} else {
+				for _, v := range Uses(inst) {
+					if !kill[b][v] {
+						gen[b][v] = true
+					}
+				}
+			}
+			for _, v := range Defs(inst) {
+				kill[b][v] = true
+			}
+		}
+	}
+	in := map[*cfg.Block]Set{}
+	out := map[*cfg.Block]Set{}
+	for _, b := range g.Blocks {
+		in[b], out[b] = Set{}, Set{}
+	}
+	for changed := true; changed; {
+		changed = false
+		for k := len(g.Blocks) - 1; k >= 0; k-- {
+			b := g.Blocks[k]
+			for v := range phiUses[b] {
+				out[b][v] = true
+			}
+			for _, s := range b.Succs {
+				for v := range in[s] {
+					out[b][v] = true
+				}
+			}
+			for v := range out[b] {
+				if !kill[b][v] && !in[b][v] {
+					in[b][v] = true
+					changed = true
+				}
+			}
+			for v := range gen[b] {
+				if !in[b][v] {
+					in[b][v] = true
+					changed = true
+				}
+			}
+		}
+	}
+	info := &Info{in: make([]Set, n), out: make([]Set, n)}
+	for _, b := range g.Blocks {
+		live := out[b].copy()
+		for k := len(b.Insts) - 1; k >= 0; k-- {
+			inst := b.Insts[k]
+			info.out[start[b] + k] = live.copy()
+			for _, v := range Defs(inst) {
+				delete(live, v)
+			}
+			if _, ok := inst.(ir.PhiInst); !ok {
+				for _, v := range Uses(inst) {
+					live[v] = true
+				}
+			}
+			info.in[start[b] + k] = live.copy()
+		}
+	}
+	return info
+}
+
+// AcrossCalls returns, by the index of each call in list, the
+// caller-saved registers the code after it reads before writing them,
+// so that the call has to save them. rax, which holds the result, is
+// left out. A register may be read after several calls, so each call is
+// taken to save all the others while finding out.
+func AcrossCalls(list []ir.IntermediateRepresentation) map[int][]ir.PhysReg {
+	all := []ir.PhysReg{}
+	for _, v := range CallerSaved {
+		if v != "rax" {
+			all = append(all, v)
+		}
+	}
+	saving := make([]ir.IntermediateRepresentation, len(list))
+	for k, inst := range list {
+		if call, ok := inst.(ir.CallInst); ok {
+			call.Saved = all
+			inst = call
+		}
+		saving[k] = inst
+	}
+	info := Analyze(saving)
+	result := map[int][]ir.PhysReg{}
+	for k, inst := range list {
+		if _, ok := inst.(ir.CallInst); !ok {
+			continue
+		}
+		saved := []ir.PhysReg{}
+		for _, v := range CallerSaved {
+			if v != "rax" && info.LiveOut(k)[v] {
+				saved = append(saved, v)
+			}
+		}
+		result[k] = saved
+	}
+	return result
+}
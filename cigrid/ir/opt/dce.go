@@ -0,0 +1,234 @@
+package opt
+
+import "cigrid/ir"
+import "cigrid/ir/cfg"
+import "cigrid/ir_translator"
+import "fmt"
+
+// Stats counts what DCE and SCCP removed
+type Stats struct {
+	Instructions int // whose results were never read
+	Blocks       int // unreachable or never executed
+	Jumps        int // to the next instruction
+	Labels       int // never jumped to
+	Branches     int // on a constant comparison
+}
+
+func (s *Stats) Add(other Stats) {
+	s.Instructions += other.Instructions
+	s.Blocks += other.Blocks
+	s.Jumps += other.Jumps
+	s.Labels += other.Labels
+	s.Branches += other.Branches
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d instructions, %d blocks, %d jumps, %d labels, %d branches",
+		s.Instructions, s.Blocks, s.Jumps, s.Labels, s.Branches)
+}
+
+// DCE removes dead code until there is none left: blocks that cannot be
+// reached, instructions defining SSA values that are never read, jumps
+// to the instruction right after them and labels nothing jumps to. It
+// works on SSA and on two-address form; only SSA values are known well
+// enough to remove their definitions. Labels named by a phi stay.
+func DCE(f *ir_translator.IrFunction) (*ir_translator.IrFunction, Stats) {
+	var stats Stats
+	list := f.ReadIrList()
+	for {
+		before := stats
+		list = unreachable(list, &stats)
+		list = deadValues(list, &stats)
+		list = jumpsToNext(list, &stats)
+		list = unusedLabels(list, &stats)
+		if stats == before {
+			break
+		}
+	}
+	return ir_translator.NewIrFunction(f.ReadName(), f.ReadSpan(), list, f.ReadAddressMap(),
+		f.ReadFrameSize(), f.ReadMaxRegister()), stats
+}
+
+// unreachable drops the blocks that cannot be reached from the entry and
+// the phi arguments coming from them
+func unreachable(list []ir.IntermediateRepresentation,
+				 stats *Stats) []ir.IntermediateRepresentation {
+	g := cfg.New(list)
+	removed := map[string]bool{}
+	result := []ir.IntermediateRepresentation{}
+	for _, b := range g.Blocks {
+		if g.Reachable(b) {
+			result = append(result, b.Insts...)
+			continue
+		}
+		if b.Label != "" {
+			removed[b.Label] = true
+		}
+		if len(b.Insts) > 0 {
+			stats.Blocks++
+		}
+	}
+	if len(removed) == 0 {
+		return result
+	}
+	for k, v := range result {
+		phi, ok := v.(ir.PhiInst)
+		if !ok {
+			continue
+		}
+		args := []ir.PhiArg{}
+		for _, arg := range phi.Args {
+			if !removed[arg.Pred] {
+				args = append(args, arg)
+			}
+		}
+		phi.Args = args
+		result[k] = phi
+	}
+	return result
+}
+
+// flagsRead tells whether the flags set by the cmp at k are read by a
+// conditional jump before the block ends
+func flagsRead(list []ir.IntermediateRepresentation, k int) bool {
+	for _, v := range list[k + 1:] {
+		switch v := v.(type) {
+		case ir.JumpInst:
+			return v.JC != ir.MP
+		case ir.Label, ir.Ret, ir.CmpInst, ir.CallInst:
+			return false
+		}
+	}
+	return false
+}
+
+// removable tells whether inst has no effect but defining SSA values.
+// A division stays unless it cannot trap.
+func removable(list []ir.IntermediateRepresentation, k int) bool {
+	switch inst := list[k].(type) {
+	case ir.Label, ir.Ret, ir.JumpInst, ir.CallInst, ir.StoreInst:
+		return false
+	case ir.CmpInst:
+		return !flagsRead(list, k)
+	case ir.OneInst:
+		if inst.Operation == ir.PUSH || inst.Operation == ir.POP {
+			return false
+		}
+	case ir.ThreeInst:
+		divides := inst.Operation == ir.DIV || inst.Operation == ir.MOD
+		if divisor, ok := inst.Right.(ir.Imm); divides && (!ok || divisor == 0) {
+			return false
+		}
+	case ir.CalcInst:
+		if inst.Operation == ir.DIV || inst.Operation == ir.MUL ||
+		   inst.Operation == ir.MOD {
+			// lowered through rax and rdx
+			return false
+		}
+	}
+	defs := ir.Defs(list[k])
+	if len(defs) == 0 {
+		// writes memory or a machine register
+		return false
+	}
+	for _, v := range defs {
+		if _, ok := v.(ir.Value); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// deadValues removes the instructions whose only effect is defining SSA
+// values that nothing needed reads, marking from the instructions that
+// have other effects
+func deadValues(list []ir.IntermediateRepresentation,
+				stats *Stats) []ir.IntermediateRepresentation {
+	defs := map[ir.Value]int{}
+	for k, inst := range list {
+		for _, v := range ir.Defs(inst) {
+			if value, ok := v.(ir.Value); ok {
+				defs[value] = k
+			}
+		}
+	}
+	live := make([]bool, len(list))
+	work := []int{}
+	for k := range list {
+		if !removable(list, k) {
+			live[k] = true
+			work = append(work, k)
+		}
+	}
+	for len(work) > 0 {
+		k := work[len(work) - 1]
+		work = work[:len(work) - 1]
+		for _, v := range ir.Uses(list[k]) {
+			value, ok := v.(ir.Value)
+			if !ok {
+				continue
+			}
+			if d, ok := defs[value]; ok && !live[d] {
+				live[d] = true
+				work = append(work, d)
+			}
+		}
+	}
+	result := []ir.IntermediateRepresentation{}
+	for k, inst := range list {
+		if live[k] {
+			result = append(result, inst)
+		} else {
+			stats.Instructions++
+		}
+	}
+	return result
+}
+
+// jumpsToNext removes the jumps to the label right after them. Jumping
+// over other labels is not the same: in SSA form the phis would see the
+// control coming from another block. Once those labels are found unused
+// the next round removes the jump.
+func jumpsToNext(list []ir.IntermediateRepresentation,
+				 stats *Stats) []ir.IntermediateRepresentation {
+	result := []ir.IntermediateRepresentation{}
+	for k, inst := range list {
+		if jump, ok := inst.(ir.JumpInst); ok && k + 1 < len(list) &&
+		   list[k + 1] == ir.Label(jump.Addr) {
+			stats.Jumps++
+			continue
+		}
+		result = append(result, inst)
+	}
+	return result
+}
+
+// unusedLabels removes the labels no jump or phi refers to. A block with
+// phis keeps its label, the phis are found by it.
+func unusedLabels(list []ir.IntermediateRepresentation,
+				  stats *Stats) []ir.IntermediateRepresentation {
+	used := map[string]bool{}
+	current := ""
+	for _, inst := range list {
+		switch inst := inst.(type) {
+		case ir.Label:
+			current = string(inst)
+		case ir.JumpInst:
+			used[inst.Addr] = true
+		case ir.PhiInst:
+			used[current] = true
+			for _, arg := range inst.Args {
+				used[arg.Pred] = true
+			}
+		}
+	}
+	result := []ir.IntermediateRepresentation{}
+	for _, inst := range list {
+		if l, ok := inst.(ir.Label); ok && !used[string(l)] {
+			stats.Labels++
+			continue
+		}
+		result = append(result, inst)
+	}
+	return result
+}
@@ -0,0 +1,43 @@
+package opt
+
+import "testing"
+
+// TestFlags checks that DCE keeps a cmp only while a conditional jump
+// reads its flags
+func TestFlags(t *testing.T) {
+	in := `function main frame 0 temps 2
+	mov temp0#1 %rdi
+	mov temp1#1 %rsi
+	cmp temp0#1 temp1#1
+	cmp temp1#1 temp0#1
+	jl .L0
+	cmp temp0#1 temp1#1
+	jmp .L1
+.L1:
+	mov %rax temp0#1
+	ret
+.L0:
+	mov %rax temp1#1
+	ret
+end
+`
+	want := `function main frame 0 temps 2
+	mov temp0#1 %rdi
+	mov temp1#1 %rsi
+	cmp temp1#1 temp0#1
+	jl .L0
+	mov %rax temp0#1
+	ret
+.L0:
+	mov %rax temp1#1
+	ret
+end
+`
+	got, stats := apply(t, in, DCE)
+	if got != want {
+		t.Errorf("got\n%swant\n%s", got, want)
+	}
+	if stats != (Stats{Instructions: 2, Jumps: 1, Labels: 1}) {
+		t.Errorf("removed %v", stats)
+	}
+}
@@ -0,0 +1,378 @@
+// Package opt holds the optimisations on the SSA form built by package
+// ir/ssa.
+package opt
+
+import "cigrid/ir"
+import "cigrid/ir/cfg"
+import "cigrid/ir_translator"
+import "math"
+
+// lattice is what SCCP knows about a value: nothing yet (top), that it
+// is always constant, or that it varies (bottom)
+type lattice struct {
+	state int
+	value int64
+}
+
+const (
+	top = iota
+	constant
+	bottom
+)
+
+func meet(a lattice, b lattice) lattice {
+	if a.state == top {
+		return b
+	} else if b.state == top {
+		return a
+	} else if a.state == constant && b.state == constant && a.value == b.value {
+		return a
+	}
+	return lattice{state: bottom}
+}
+
+// known makes a constant. Constants the backend cannot use as an
+// immediate, outside 32 bits, are treated as varying.
+func known(value int64) lattice {
+	if value < math.MinInt32 || value > math.MaxInt32 {
+		return lattice{state: bottom}
+	}
+	return lattice{state: constant, value: value}
+}
+
+type edge struct {
+	from *cfg.Block
+	to   *cfg.Block
+}
+
+type use struct {
+	block *cfg.Block
+	index int
+}
+
+type sccp struct {
+	g          *cfg.Graph
+	values     map[ir.Value]lattice
+	uses       map[ir.Value][]use
+	executable map[*cfg.Block]bool
+	edges      map[edge]bool
+	flowWork   []edge
+	ssaWork    []ir.Value
+	stats      Stats
+}
+
+// SCCP is sparse conditional constant propagation (Wegman and Zadeck):
+// it finds the values that are constant on every executable path,
+// assuming optimistically that a branch is not taken until some constant
+// or varying value shows that it is. Uses of constants are replaced by
+// immediates, arithmetic on them is folded, branches on a constant
+// comparison become jumps and blocks that are never executed are
+// removed. f must be in SSA form.
+func SCCP(f *ir_translator.IrFunction) (*ir_translator.IrFunction, Stats) {
+	s := &sccp{
+		g: cfg.New(f.ReadIrList()),
+		values: map[ir.Value]lattice{},
+		uses: map[ir.Value][]use{},
+		executable: map[*cfg.Block]bool{},
+		edges: map[edge]bool{},
+	}
+	for _, b := range s.g.Blocks {
+		for k, inst := range b.Insts {
+			for _, v := range ir.Uses(inst) {
+				if value, ok := v.(ir.Value); ok {
+					s.uses[value] = append(s.uses[value], use{b, k})
+				}
+			}
+		}
+	}
+	s.run()
+	list := s.rewrite()
+	return ir_translator.NewIrFunction(f.ReadName(), f.ReadSpan(), list, f.ReadAddressMap(),
+		f.ReadFrameSize(), f.ReadMaxRegister()), s.stats
+}
+
+func (s *sccp) run() {
+	s.flowWork = append(s.flowWork, edge{nil, s.g.Entry})
+	for len(s.flowWork) > 0 || len(s.ssaWork) > 0 {
+		for len(s.flowWork) > 0 {
+			e := s.flowWork[len(s.flowWork) - 1]
+			s.flowWork = s.flowWork[:len(s.flowWork) - 1]
+			if s.edges[e] {
+				continue
+			}
+			s.edges[e] = true
+			b := e.to
+			// the phis see one more incoming edge; the rest of the block
+			// only needs a visit the first time
+			first := !s.executable[b]
+			s.executable[b] = true
+			for k, inst := range b.Insts {
+				if _, ok := inst.(ir.PhiInst); ok || first {
+					s.visit(b, k)
+				}
+			}
+			if first {
+				s.branch(b)
+			}
+		}
+		for len(s.ssaWork) > 0 {
+			v := s.ssaWork[len(s.ssaWork) - 1]
+			s.ssaWork = s.ssaWork[:len(s.ssaWork) - 1]
+			for _, u := range s.uses[v] {
+				if s.executable[u.block] {
+					s.visit(u.block, u.index)
+				}
+			}
+		}
+	}
+}
+
+func (s *sccp) get(o ir.Operand) lattice {
+	switch o := o.(type) {
+	case ir.Imm:
+		return known(int64(o))
+	case ir.Value:
+		if o.N == 0 {
+			// never defined
+			return lattice{state: bottom}
+		}
+		return s.values[o]
+	}
+	return lattice{state: bottom}
+}
+
+func (s *sccp) set(o ir.Operand, l lattice) {
+	v, ok := o.(ir.Value)
+	if !ok || s.values[v] == l {
+		return
+	}
+	s.values[v] = l
+	s.ssaWork = append(s.ssaWork, v)
+}
+
+// visit evaluates instruction k of b
+func (s *sccp) visit(b *cfg.Block, k int) {
+	switch inst := b.Insts[k].(type) {
+	case ir.PhiInst:
+		result := lattice{state: top}
+		for _, arg := range inst.Args {
+			if s.edges[edge{s.g.Block(arg.Pred), b}] {
+				result = meet(result, s.get(arg.Value))
+			}
+		}
+		s.set(inst.Dest, result)
+	case ir.CalcInst:
+		if inst.Operation == ir.MOV {
+			s.set(inst.Operand1, s.get(inst.Operand2))
+		} else {
+			s.set(inst.Operand1, lattice{state: bottom})
+		}
+	case ir.ThreeInst:
+		s.set(inst.Dest, s.fold(inst))
+	case ir.CmpInst, ir.JumpInst:
+		s.branch(b)
+	default:
+		for _, v := range ir.Defs(inst) {
+			s.set(v, lattice{state: bottom})
+		}
+	}
+}
+
+func (s *sccp) fold(inst ir.ThreeInst) lattice {
+	left := s.get(inst.Left)
+	if inst.Right == nil {
+		if left.state == constant {
+			return known(-left.value)
+		}
+		return left
+	}
+	right := s.get(inst.Right)
+	if left.state == bottom || right.state == bottom {
+		return lattice{state: bottom}
+	} else if left.state == top || right.state == top {
+		return lattice{state: top}
+	}
+	a, b := left.value, right.value
+	switch inst.Operation {
+	case ir.ADD:
+		return known(a + b)
+	case ir.SUB:
+		return known(a - b)
+	case ir.XOR:
+		return known(a ^ b)
+	case ir.MUL:
+		return known(a * b)
+	case ir.DIV:
+		if b != 0 {
+			return known(a / b)
+		}
+	case ir.MOD:
+		if b != 0 {
+			return known(a % b)
+		}
+	}
+	return lattice{state: bottom}
+}
+
+// condition finds the cmp deciding the conditional jump ending b, -1 if
+// it is not in b
+func condition(b *cfg.Block) int {
+	for k := len(b.Insts) - 2; k >= 0; k-- {
+		if _, ok := b.Insts[k].(ir.CmpInst); ok {
+			return k
+		}
+	}
+	return -1
+}
+
+// outcome tells whether the conditional jump ending b is taken: 1 if
+// always, 0 if never, -1 if either may happen, -2 if nothing is known yet
+func (s *sccp) outcome(b *cfg.Block) int {
+	k := condition(b)
+	if k < 0 {
+		return -1
+	}
+	cmp := b.Insts[k].(ir.CmpInst)
+	left, right := s.get(cmp.Left), s.get(cmp.Right)
+	if left.state == top || right.state == top {
+		return -2
+	} else if left.state == bottom || right.state == bottom {
+		return -1
+	}
+	jump := b.Insts[len(b.Insts) - 1].(ir.JumpInst)
+	a, c := left.value, right.value
+	taken := false
+	switch jump.JC {
+	case ir.E:
+		taken = a == c
+	case ir.NE:
+		taken = a != c
+	case ir.G:
+		taken = a > c
+	case ir.L:
+		taken = a < c
+	case ir.GE:
+		taken = a >= c
+	case ir.LE:
+		taken = a <= c
+	}
+	if taken {
+		return 1
+	}
+	return 0
+}
+
+func (s *sccp) next(b *cfg.Block) *cfg.Block {
+	if b.Index + 1 < len(s.g.Blocks) {
+		return s.g.Blocks[b.Index + 1]
+	}
+	return nil
+}
+
+func (s *sccp) follow(from *cfg.Block, to *cfg.Block) {
+	if to != nil && !s.edges[edge{from, to}] {
+		s.flowWork = append(s.flowWork, edge{from, to})
+	}
+}
+
+// branch adds the edges leaving b that can be taken
+func (s *sccp) branch(b *cfg.Block) {
+	var last ir.IntermediateRepresentation
+	if len(b.Insts) > 0 {
+		last = b.Insts[len(b.Insts) - 1]
+	}
+	switch last := last.(type) {
+	case ir.Ret:
+	case ir.JumpInst:
+		target := s.g.Block(last.Addr)
+		if last.JC == ir.MP {
+			s.follow(b, target)
+			break
+		}
+		switch s.outcome(b) {
+		case 1:
+			s.follow(b, target)
+		case 0:
+			s.follow(b, s.next(b))
+		case -1:
+			s.follow(b, target)
+			s.follow(b, s.next(b))
+		}
+	default:
+		s.follow(b, s.next(b))
+	}
+}
+
+// rewrite puts the constants in and drops what is never executed
+func (s *sccp) rewrite() []ir.IntermediateRepresentation {
+	result := []ir.IntermediateRepresentation{}
+	for _, b := range s.g.Blocks {
+		if !s.executable[b] {
+			if len(b.Insts) > 0 {
+				s.stats.Blocks++
+			}
+			continue
+		}
+		decided := -1 // the cmp of a jump that became unconditional
+		outcome := -1
+		if len(b.Insts) == 0 {
+			continue
+		}
+		if jump, ok := b.Insts[len(b.Insts) - 1].(ir.JumpInst); ok && jump.JC != ir.MP {
+			if outcome = s.outcome(b); outcome >= 0 {
+				decided = condition(b)
+				s.stats.Branches++
+			}
+		}
+		folded := []ir.IntermediateRepresentation{} // constant phis
+		for k, inst := range b.Insts {
+			if k == decided {
+				continue
+			}
+			switch v := inst.(type) {
+			case ir.PhiInst:
+				if l := s.get(v.Dest); l.state == constant {
+					folded = append(folded, ir.CalcInst{Operation: ir.MOV,
+						Operand1: v.Dest, Operand2: ir.Imm(l.value)})
+					continue
+				}
+				args := []ir.PhiArg{}
+				for _, arg := range v.Args {
+					if s.edges[edge{s.g.Block(arg.Pred), b}] {
+						args = append(args, arg)
+					}
+				}
+				v.Args = args
+				inst = v
+			case ir.ThreeInst:
+				if l := s.get(v.Dest); l.state == constant {
+					inst = ir.CalcInst{Operation: ir.MOV, Operand1: v.Dest,
+						Operand2: ir.Imm(l.value)}
+				}
+			case ir.JumpInst:
+				if k == len(b.Insts) - 1 && outcome == 0 {
+					continue
+				} else if k == len(b.Insts) - 1 && outcome == 1 {
+					inst = ir.JumpInst{JC: ir.MP, Addr: v.Addr}
+				}
+			}
+			if _, ok := inst.(ir.PhiInst); !ok && len(folded) > 0 {
+				result = append(result, folded...)
+				folded = nil
+			}
+			result = append(result, s.constants(inst))
+		}
+		result = append(result, folded...)
+	}
+	return result
+}
+
+// constants replaces the uses of constant values in inst by immediates
+func (s *sccp) constants(inst ir.IntermediateRepresentation) ir.IntermediateRepresentation {
+	return ir.MapOperands(inst, func(o ir.Operand, def bool) ir.Operand {
+		if l := s.get(o); !def && l.state == constant {
+			return ir.Imm(l.value)
+		}
+		return o
+	})
+}
@@ -0,0 +1,103 @@
+package opt
+
+import "cigrid/ir/parse"
+import "cigrid/ir_translator"
+import "testing"
+
+// apply reads the functions in text, runs pass on each and prints them
+// back with what it removed
+func apply(t *testing.T, text string,
+		   pass func(*ir_translator.IrFunction) (*ir_translator.IrFunction, Stats)) (string, Stats) {
+	p := parse.New("test.ir", text)
+	program := p.Parse()
+	for _, d := range p.Diagnostics().Items() {
+		t.Fatalf("%d:%d: %s", d.Span.Start.Line, d.Span.Start.Column, d.Message)
+	}
+	var stats Stats
+	functions := []*ir_translator.IrFunction{}
+	for _, v := range program.ReadIrFunctionList() {
+		f, more := pass(v)
+		stats.Add(more)
+		functions = append(functions, f)
+	}
+	return ir_translator.NewFromIr(functions, nil, nil).String(), stats
+}
+
+// TestSCCP checks that a branch on constants becomes a jump, or none, and
+// its dead arm goes, and that nothing is folded into a trap or into an
+// immediate the backend cannot encode
+func TestSCCP(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		want  string
+		stats Stats
+	}{
+		{"constant branch", `function main frame 0 temps 3
+	mov temp0#1 1
+	mov temp1#1 3
+	cmp temp0#1 temp1#1
+	jg .L0_if
+.B1:
+	mov temp2#1 7
+	jmp .L0_end
+.L0_if:
+	mov temp2#2 9
+.L0_end:
+	temp2#3 = phi .B1: temp2#1, .L0_if: temp2#2
+	mov %rax temp2#3
+	ret
+end
+`, `function main frame 0 temps 3
+	mov temp0#1 1
+	mov temp1#1 3
+.B1:
+	mov temp2#1 7
+	jmp .L0_end
+.L0_end:
+	mov temp2#3 7
+	mov %rax 7
+	ret
+end
+`, Stats{Blocks: 1, Branches: 1}},
+		{"division by zero", `function main frame 0 temps 3
+	mov temp0#1 5
+	mov temp1#1 0
+	temp2#1 = idiv temp0#1 temp1#1
+	mov %rax temp2#1
+	ret
+end
+`, `function main frame 0 temps 3
+	mov temp0#1 5
+	mov temp1#1 0
+	temp2#1 = idiv 5 0
+	mov %rax temp2#1
+	ret
+end
+`, Stats{}},
+		{"outside 32 bits", `function main frame 0 temps 3
+	mov temp0#1 65536
+	temp1#1 = imul temp0#1 temp0#1
+	temp2#1 = sub temp1#1 1
+	mov %rax temp2#1
+	ret
+end
+`, `function main frame 0 temps 3
+	mov temp0#1 65536
+	temp1#1 = imul 65536 65536
+	temp2#1 = sub temp1#1 1
+	mov %rax temp2#1
+	ret
+end
+`, Stats{}},
+	}
+	for _, test := range tests {
+		got, stats := apply(t, test.in, SCCP)
+		if got != test.want {
+			t.Errorf("%s: got\n%swant\n%s", test.name, got, test.want)
+		}
+		if stats != test.stats {
+			t.Errorf("%s: removed %v, want %v", test.name, stats, test.stats)
+		}
+	}
+}
@@ -0,0 +1,587 @@
+// Package parse reads the textual IR printed by IrTranslator.String back
+// into IrFunction values, so IR can be written by hand, fed straight to
+// the backend and kept in golden files.
+//
+// The format is line based; ";" starts a comment.
+//
+//	string str1 "hi %d\n"             string constant, Go quoted, numbered from 1
+//	global g_x 1 = 5                  initialised global of 1 qword
+//	global g_buf 4                    zero filled global of 4 qwords
+//	function main frame 2 temps 3     frame: variable slots, temps: temp registers
+//		var x.1 0                     variable and its first slot
+//		mov temp0 5
+//	.L0:                              label
+//		jl .L0
+//	end
+//
+// Operands:
+//
+//	temp3          temp register
+//	x.1            variable, declared with var
+//	-5             immediate
+//	%rax           machine register
+//	@g_x           address of a label
+//	[%rbp + 16]    qword in memory at a register or label plus an offset
+//
+// Instructions are those of package ir: add, sub, mov, xor, imul, idiv,
+// mod and lea take two operands (destination first); neg, push and pop one;
+// cmp two; jmp, je, jne, jg, jl, jge and jle a label; call a function
+// name, the number of arguments passed in registers, all six if it is
+// left out, and the registers saved in the top temp slots around it;
+// ret none; "load temp1 [temp0]" and "store [temp0 + 8] temp1"
+// access memory through an address held in a temp.
+//
+// SSA form adds versioned operands, written temp3#2 or x.1#2, whose
+// variables need no var line, and two instructions:
+//
+//	temp0#3 = add temp0#2 temp1#1     three-address arithmetic, also neg
+//	x.1#3 = phi .L0: x.1#1, .L2: x.1#2
+package parse
+
+import "cigrid/ir"
+import "cigrid/ir_translator"
+import "cigrid/diag"
+import "cigrid/token"
+import "strconv"
+import "strings"
+
+// word is a piece of a line: a quoted string, a [...] group, a comma or
+// a run of other non-blank characters
+type word struct {
+	text   string
+	line   int
+	column int
+}
+
+var twoOperand = map[string]ir.Op{
+	"add": ir.ADD, "sub": ir.SUB, "mov": ir.MOV, "xor": ir.XOR,
+	"imul": ir.MUL, "idiv": ir.DIV, "mod": ir.MOD, "lea": ir.LEA,
+}
+
+var oneOperand = map[string]ir.Op{
+	"neg": ir.NEG, "push": ir.PUSH, "pop": ir.POP,
+}
+
+var jumps = map[string]ir.JumpType{
+	"jmp": ir.MP, "je": ir.E, "jne": ir.NE, "jg": ir.G, "jl": ir.L,
+	"jge": ir.GE, "jle": ir.LE,
+}
+
+// function is the function being read
+type function struct {
+	name        string
+	line        int // line of the header
+	span        token.Span // of the name in the header
+	irList      []ir.IntermediateRepresentation
+	addressMap  map[string]int
+	frameSize   int
+	maxRegister int
+	labels      map[string]bool
+	jumps       []word // jump targets, checked at the end
+	vars        []word // variable operands, checked at the end
+}
+
+type Parser struct {
+	file      string
+	lines     []string
+	line      int // current line, from 1
+	functions []*ir_translator.IrFunction
+	strings   []string
+	globals   []*ir_translator.GlobalData
+	current   *function
+	diags     diag.List
+}
+
+func New(file string, input string) *Parser {
+	return &Parser{file: file, lines: strings.Split(input, "\n")}
+}
+
+// Diagnostics returns the syntax errors found by Parse
+func (p *Parser) Diagnostics() *diag.List {
+	return &p.diags
+}
+
+func (p *Parser) span(w word) token.Span {
+	start := token.Position{File: p.file, Line: w.line, Column: w.column}
+	end := start
+	end.Column += len(w.text)
+	return token.Span{Start: start, End: end}
+}
+
+func (p *Parser) errorf(w word, format string, args ...interface{}) {
+	p.diags.Errorf(diag.MalformedIR, p.span(w), format, args...)
+}
+
+// Parse reads the whole input. The result holds everything that could be
+// read, check Diagnostics before using it.
+func (p *Parser) Parse() *ir_translator.IrTranslator {
+	for k, v := range p.lines {
+		p.line = k + 1
+		words, ok := p.split(v)
+		if !ok || len(words) == 0 {
+			continue
+		}
+		if p.current != nil {
+			p.parseFunctionLine(words)
+		} else {
+			p.parseTopLevel(words)
+		}
+	}
+	if p.current != nil {
+		p.errorf(word{"function", p.current.line, 1}, "function `%s` has no `end`", p.current.name)
+		p.finishFunction()
+	}
+	return ir_translator.NewFromIr(p.functions, p.strings, p.globals)
+}
+
+// split breaks a line into words and drops the comment
+func (p *Parser) split(line string) ([]word, bool) {
+	words := []word{}
+	for i := 0; i < len(line); {
+		ch := line[i]
+		start := i
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			i++
+			continue
+		case ch == ';':
+			return words, true
+		case ch == ',':
+			i++
+		case ch == '"':
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(line) {
+				p.errorf(word{line[start:], p.line, start + 1}, "unterminated string")
+				return nil, false
+			}
+			i++
+		case ch == '[':
+			for i < len(line) && line[i] != ']' {
+				i++
+			}
+			if i >= len(line) {
+				p.errorf(word{line[start:], p.line, start + 1}, "missing `]`")
+				return nil, false
+			}
+			i++
+		default:
+			for i < len(line) && !strings.ContainsRune(" \t\r,;\"[", rune(line[i])) {
+				i++
+			}
+		}
+		words = append(words, word{line[start:i], p.line, start + 1})
+	}
+	return words, true
+}
+
+// number reads a decimal integer
+func (p *Parser) number(w word) (int, bool) {
+	value, err := strconv.Atoi(w.text)
+	if err != nil {
+		p.errorf(w, "expected a number, found `%s`", w.text)
+		return 0, false
+	}
+	return value, true
+}
+
+// expect checks that words has exactly n words after the first
+func (p *Parser) expect(words []word, n int, form string) bool {
+	if len(words) != n + 1 {
+		p.errorf(words[0], "expected `%s`", form)
+		return false
+	}
+	return true
+}
+
+func (p *Parser) parseTopLevel(words []word) {
+	switch words[0].text {
+	case "string":
+		if !p.expect(words, 2, "string strN \"text\"") {
+			return
+		}
+		want := "str" + strconv.Itoa(len(p.strings) + 1)
+		if words[1].text != want {
+			p.errorf(words[1], "expected string `%s`, strings are numbered in order", want)
+			return
+		}
+		value, err := strconv.Unquote(words[2].text)
+		if err != nil {
+			p.errorf(words[2], "invalid string literal")
+			return
+		}
+		p.strings = append(p.strings, value)
+	case "global":
+		if len(words) < 3 {
+			p.errorf(words[0], "expected `global name size [= values]`")
+			return
+		}
+		size, ok := p.number(words[2])
+		if !ok {
+			return
+		}
+		g := &ir_translator.GlobalData{Name: words[1].text, Size: size}
+		if len(words) > 3 {
+			if words[3].text != "=" || len(words) == 4 {
+				p.errorf(words[3], "expected `= values`")
+				return
+			}
+			g.Initialized = true
+			for k, v := range words[4:] {
+				if (k % 2 == 1) != (v.text == ",") {
+					p.errorf(v, "values must be separated by commas")
+					return
+				}
+				if v.text != "," {
+					g.Values = append(g.Values, v.text)
+				}
+			}
+		}
+		p.globals = append(p.globals, g)
+	case "function":
+		if !p.expect(words, 5, "function name frame N temps N") {
+			return
+		}
+		if words[2].text != "frame" || words[4].text != "temps" {
+			p.errorf(words[0], "expected `function name frame N temps N`")
+			return
+		}
+		frameSize, ok1 := p.number(words[3])
+		maxRegister, ok2 := p.number(words[5])
+		if !ok1 || !ok2 {
+			return
+		}
+		p.current = &function{
+			name: words[1].text,
+			line: p.line,
+			span: p.span(words[1]),
+			addressMap: make(map[string]int),
+			frameSize: frameSize,
+			maxRegister: maxRegister,
+			labels: make(map[string]bool),
+		}
+	default:
+		p.errorf(words[0], "expected `string`, `global` or `function`, found `%s`", words[0].text)
+	}
+}
+
+func (p *Parser) parseFunctionLine(words []word) {
+	f := p.current
+	first := words[0].text
+	if first == "end" {
+		p.expect(words, 0, "end")
+		p.finishFunction()
+		return
+	} else if first == "var" {
+		if !p.expect(words, 2, "var name slot") {
+			return
+		}
+		slot, ok := p.number(words[2])
+		if ok && (slot < 0 || slot >= f.frameSize) {
+			p.errorf(words[2], "slot %d is outside the frame of %d slots", slot, f.frameSize)
+		} else if ok {
+			f.addressMap[words[1].text] = slot
+		}
+		return
+	} else if len(words) == 1 && strings.HasSuffix(first, ":") {
+		label := strings.TrimSuffix(first, ":")
+		if f.labels[label] {
+			p.errorf(words[0], "label `%s` is defined twice", label)
+		}
+		f.labels[label] = true
+		f.irList = append(f.irList, ir.Label(label))
+		return
+	}
+	if inst := p.parseInstruction(words); inst != nil {
+		f.irList = append(f.irList, inst)
+	}
+}
+
+func (p *Parser) parseInstruction(words []word) ir.IntermediateRepresentation {
+	f := p.current
+	name := words[0].text
+	if len(words) > 1 && words[1].text == "=" {
+		return p.parseSsa(words)
+	}
+	if op, ok := twoOperand[name]; ok {
+		if !p.expect(words, 2, name + " dest src") {
+			return nil
+		}
+		o1, ok1 := p.operand(words[1])
+		o2, ok2 := p.operand(words[2])
+		if !ok1 || !ok2 {
+			return nil
+		}
+		return ir.CalcInst{Operation: op, Operand1: o1, Operand2: o2}
+	} else if op, ok := oneOperand[name]; ok {
+		if !p.expect(words, 1, name + " operand") {
+			return nil
+		}
+		o1, ok := p.operand(words[1])
+		if !ok {
+			return nil
+		}
+		return ir.OneInst{Operation: op, Operand1: o1}
+	} else if jc, ok := jumps[name]; ok {
+		if !p.expect(words, 1, name + " label") {
+			return nil
+		}
+		f.jumps = append(f.jumps, words[1])
+		return ir.JumpInst{JC: jc, Addr: words[1].text}
+	}
+	switch name {
+	case "cmp":
+		if !p.expect(words, 2, "cmp left right") {
+			return nil
+		}
+		left, ok1 := p.operand(words[1])
+		right, ok2 := p.operand(words[2])
+		if !ok1 || !ok2 {
+			return nil
+		}
+		return ir.CmpInst{Left: left, Right: right}
+	case "call":
+		if len(words) == 2 {
+			// without a count all argument registers may be read
+			return ir.CallInst{FuntionName: words[1].text, Args: 6}
+		} else if len(words) < 3 {
+			p.errorf(words[0], "expected `call function [register arguments [saved registers]]`")
+			return nil
+		}
+		args, ok := p.number(words[2])
+		if !ok || args < 0 || args > 6 {
+			p.errorf(words[2], "a call passes 0 to 6 arguments in registers")
+			return nil
+		}
+		call := ir.CallInst{FuntionName: words[1].text, Args: args}
+		for _, w := range words[3:] {
+			reg, ok := p.operand(w)
+			if _, isReg := reg.(ir.PhysReg); ok && !isReg {
+				p.errorf(w, "a call saves registers, not `%s`", w.text)
+				return nil
+			} else if !ok {
+				return nil
+			}
+			call.Saved = append(call.Saved, reg.(ir.PhysReg))
+		}
+		if len(call.Saved) > p.current.maxRegister {
+			p.errorf(words[0], "saving %d registers needs as many temps, the function has %d",
+				len(call.Saved), p.current.maxRegister)
+			return nil
+		}
+		return call
+	case "ret":
+		if !p.expect(words, 0, "ret") {
+			return nil
+		}
+		return ir.Ret("")
+	case "load":
+		if !p.expect(words, 2, "load dest [addr]") {
+			return nil
+		}
+		dest, ok1 := p.operand(words[1])
+		addr, offset, ok2 := p.bracket(words[2])
+		if !ok1 || !ok2 {
+			return nil
+		} else if offset != 0 {
+			p.errorf(words[2], "load takes no offset")
+			return nil
+		}
+		return ir.LoadInst{Dest: dest, Addr: addr}
+	case "store":
+		if !p.expect(words, 2, "store [addr + offset] value") {
+			return nil
+		}
+		addr, offset, ok1 := p.bracket(words[1])
+		value, ok2 := p.operand(words[2])
+		if !ok1 || !ok2 {
+			return nil
+		}
+		return ir.StoreInst{Addr: addr, Offset: offset, Value: value}
+	}
+	p.errorf(words[0], "unknown instruction `%s`", name)
+	return nil
+}
+
+// parseSsa reads "dest = op left [right]" and "dest = phi label: value, ..."
+func (p *Parser) parseSsa(words []word) ir.IntermediateRepresentation {
+	if len(words) < 4 {
+		p.errorf(words[0], "expected `dest = op operands`")
+		return nil
+	}
+	dest, ok := p.operand(words[0])
+	if !ok {
+		return nil
+	}
+	name := words[2].text
+	if name == "phi" {
+		phi := ir.PhiInst{Dest: dest}
+		args := words[3:]
+		for k := 0; k < len(args); k += 3 {
+			if k + 1 >= len(args) || !strings.HasSuffix(args[k].text, ":") ||
+			   (k + 2 < len(args) && args[k + 2].text != ",") {
+				p.errorf(args[k], "expected `label: value`")
+				return nil
+			}
+			label := word{strings.TrimSuffix(args[k].text, ":"), args[k].line, args[k].column}
+			value, ok := p.operand(args[k + 1])
+			if !ok {
+				return nil
+			}
+			p.current.jumps = append(p.current.jumps, label)
+			phi.Args = append(phi.Args, ir.PhiArg{Pred: label.text, Value: value})
+		}
+		return phi
+	}
+	op, ok := twoOperand[name]
+	if name == "neg" {
+		op, ok = ir.NEG, true
+	}
+	if !ok || op == ir.MOV || op == ir.LEA {
+		p.errorf(words[2], "`%s` has no three-address form", name)
+		return nil
+	}
+	operands := 2
+	if op == ir.NEG {
+		operands = 1
+	}
+	if len(words) != 3 + operands {
+		p.errorf(words[2], "`%s` takes %d operands", name, operands)
+		return nil
+	}
+	inst := ir.ThreeInst{Operation: op, Dest: dest}
+	if inst.Left, ok = p.operand(words[3]); !ok {
+		return nil
+	}
+	if operands == 2 {
+		if inst.Right, ok = p.operand(words[4]); !ok {
+			return nil
+		}
+	}
+	return inst
+}
+
+// bracket reads [base], [base + n] or [base - n]
+func (p *Parser) bracket(w word) (ir.Operand, int, bool) {
+	if !strings.HasPrefix(w.text, "[") {
+		p.errorf(w, "expected `[...]`, found `%s`", w.text)
+		return nil, 0, false
+	}
+	fields := strings.Fields(strings.TrimSuffix(strings.TrimPrefix(w.text, "["), "]"))
+	if len(fields) != 1 && len(fields) != 3 {
+		p.errorf(w, "expected `[base]` or `[base + offset]`")
+		return nil, 0, false
+	}
+	base, ok := p.operand(word{fields[0], w.line, w.column + 1})
+	if !ok {
+		return nil, 0, false
+	}
+	if len(fields) == 1 {
+		return base, 0, true
+	}
+	offset, err := strconv.Atoi(fields[2])
+	if err != nil || (fields[1] != "+" && fields[1] != "-") {
+		p.errorf(w, "expected `[base]` or `[base + offset]`")
+		return nil, 0, false
+	}
+	if fields[1] == "-" {
+		offset = -offset
+	}
+	return base, offset, true
+}
+
+func isName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' ||
+			 ch >= '0' && ch <= '9' || ch == '_' || ch == '.') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// operand reads one operand, see the package documentation
+func (p *Parser) operand(w word) (ir.Operand, bool) {
+	text := w.text
+	if k := strings.LastIndex(text, "#"); k >= 0 {
+		return p.value(w, k)
+	}
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return ir.Imm(n), true
+	} else if strings.HasPrefix(text, "temp") {
+		if n, err := strconv.Atoi(text[4:]); err == nil && n >= 0 {
+			if n >= p.current.maxRegister {
+				p.errorf(w, "`%s` is outside the %d temps of the function",
+					text, p.current.maxRegister)
+				return nil, false
+			}
+			return ir.Temp(n), true
+		}
+	} else if strings.HasPrefix(text, "%") && isName(text[1:]) {
+		return ir.PhysReg(text[1:]), true
+	} else if strings.HasPrefix(text, "@") && isName(text[1:]) {
+		return ir.Global(text[1:]), true
+	} else if strings.HasPrefix(text, "[") {
+		base, offset, ok := p.bracket(w)
+		if !ok {
+			return nil, false
+		}
+		switch base.(type) {
+		case ir.PhysReg, ir.Global:
+			return ir.Mem{Base: base, Offset: offset}, true
+		}
+		p.errorf(w, "the base of a memory operand must be a register or a label")
+		return nil, false
+	}
+	if isName(text) {
+		p.current.vars = append(p.current.vars, w)
+		return ir.Var(text), true
+	}
+	p.errorf(w, "invalid operand `%s`", text)
+	return nil, false
+}
+
+// finishFunction checks the labels and variables a function refers to
+// and adds it to the result
+func (p *Parser) finishFunction() {
+	f := p.current
+	p.current = nil
+	for _, v := range f.jumps {
+		if !f.labels[v.text] {
+			p.errorf(v, "label `%s` is not defined in `%s`", v.text, f.name)
+		}
+	}
+	for _, v := range f.vars {
+		if _, ok := f.addressMap[v.text]; !ok {
+			p.errorf(v, "variable `%s` is not declared with `var`", v.text)
+		}
+	}
+	p.functions = append(p.functions, ir_translator.NewIrFunction(
+		f.name, f.span, f.irList, f.addressMap, f.frameSize, f.maxRegister))
+}
+
+// value reads the SSA value temp3#2 or x.1#2, with the # at k
+func (p *Parser) value(w word, k int) (ir.Operand, bool) {
+	n, err := strconv.Atoi(w.text[k + 1:])
+	if err != nil || n < 0 {
+		p.errorf(w, "invalid version in `%s`", w.text)
+		return nil, false
+	}
+	base := w.text[:k]
+	if !strings.HasPrefix(base, "temp") && isName(base) {
+		// promoted variables live in no slot
+		return ir.Value{Of: ir.Var(base), N: n}, true
+	}
+	of, ok := p.operand(word{base, w.line, w.column})
+	if !ok {
+		return nil, false
+	} else if _, isTemp := of.(ir.Temp); !isTemp {
+		p.errorf(w, "only temps and variables have versions")
+		return nil, false
+	}
+	return ir.Value{Of: of, N: n}, true
+}
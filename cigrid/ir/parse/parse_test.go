@@ -0,0 +1,96 @@
+package parse
+
+import "bytes"
+import "cigrid/diag"
+import "cigrid/ir/interp"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "testing"
+
+// TestGolden reads every testdata/*.ir, checks that printing it gives the
+// file back and, if there is a matching .out, runs it and compares what
+// it prints and its exit status. SSA files have no .out, the interpreter
+// does not run SSA form.
+func TestGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.ir"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no testdata: %v", err)
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			input, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := New(file, string(input))
+			program := p.Parse()
+			for _, d := range p.Diagnostics().Items() {
+				t.Errorf("%d:%d: %s", d.Span.Start.Line, d.Span.Start.Column, d.Message)
+			}
+			if got := program.String(); got != string(input) {
+				t.Errorf("printed back differently:\n%s", got)
+			}
+			want, err := os.ReadFile(strings.TrimSuffix(file, ".ir") + ".out")
+			if os.IsNotExist(err) {
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			code, err := interp.New(program, &out).Run()
+			if err != nil {
+				t.Fatalf("runtime error: %v", err)
+			}
+			out.WriteString("exit " + strconv.Itoa(code) + "\n")
+			if out.String() != string(want) {
+				t.Errorf("got\n%swant\n%s", out.String(), want)
+			}
+		})
+	}
+}
+
+// TestMalformed checks that bad input is reported as MalformedIR at the
+// word at fault
+func TestMalformed(t *testing.T) {
+	tests := []struct {
+		input   string
+		line    int
+		column  int
+		message string
+	}{
+		{"function main frame 0 temps 1\n\tfoo temp0\nend\n", 2, 2, "unknown instruction `foo`"},
+		{"function main frame 0 temps 1\n\tmov temp0 temp1\nend\n", 2, 12, "outside the 1 temps"},
+		{"function main frame 0 temps 0\n\tjmp .L9\nend\n", 2, 6, "label `.L9` is not defined"},
+		{"function main frame 1 temps 0\n\tmov x.1 5\nend\n", 2, 6, "not declared with `var`"},
+		{"function main frame 1 temps 0\n\tvar x.1 3\nend\n", 2, 10, "outside the frame"},
+		{"function main frame 0 temps 1\n\tmov temp0 [%rbp + 8\nend\n", 2, 12, "missing `]`"},
+		{"function main frame 0 temps 1\n\tcall f 2 %rcx %rsi\nend\n", 2, 2, "needs as many temps"},
+		{"function main frame 0 temps 0\n\tcall f 7\nend\n", 2, 9, "0 to 6 arguments"},
+		{"string str2 \"x\"\n", 1, 8, "expected string `str1`"},
+		{"global g 2 = 1 2\n", 1, 16, "separated by commas"},
+		{"function main frame 0 temps 0\n\tret\n", 1, 1, "has no `end`"},
+		{"ret\n", 1, 1, "expected `string`, `global` or `function`"},
+	}
+	for _, test := range tests {
+		p := New("bad.ir", test.input)
+		p.Parse()
+		items := p.Diagnostics().Items()
+		if len(items) == 0 {
+			t.Errorf("%q: no error", test.input)
+			continue
+		}
+		d := items[0]
+		if d.Code != diag.MalformedIR {
+			t.Errorf("%q: code %s, want %s", test.input, d.Code, diag.MalformedIR)
+		}
+		if d.Span.Start.Line != test.line || d.Span.Start.Column != test.column {
+			t.Errorf("%q: at %d:%d, want %d:%d", test.input,
+				d.Span.Start.Line, d.Span.Start.Column, test.line, test.column)
+		}
+		if !strings.Contains(d.Message, test.message) {
+			t.Errorf("%q: %q does not say %q", test.input, d.Message, test.message)
+		}
+	}
+}
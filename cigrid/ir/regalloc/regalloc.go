@@ -0,0 +1,406 @@
+// Package regalloc puts the temps and variables of a function in machine
+// registers. Variables whose address is taken with lea stay in their
+// slots. What does not get a register is spilled: it stays in memory,
+// where the backend reaches it through r10 and r11 as before, so no spill
+// code is needed.
+//
+// The pool leaves out rax and rdx, which imul, idiv, calls and returns
+// use, r10 and r11, the scratch registers of the backend, and rsp and
+// rbp. A value live across a call preferably gets a callee-saved
+// register, which the prologue saves once; if it gets a caller-saved
+// one instead the call saves it in a frame slot, see ir.CallInst.
+package regalloc
+
+import "cigrid/ir"
+import "cigrid/ir/liveness"
+import "cigrid/ir_translator"
+import "sort"
+
+// Method chooses how registers are assigned
+type Method int
+
+const (
+	LinearScan     Method = iota // Poletto and Sarkar, on live intervals
+	GraphColouring               // Chaitin and Briggs, on the interference graph
+)
+
+// pool are the registers handed out, caller-saved first as they cost no
+// save in the prologue
+var pool = []ir.PhysReg{"rcx", "rsi", "rdi", "r8", "r9", "rbx", "r12", "r13", "r14", "r15"}
+
+// acrossCallPool is the order for values live across a call, which
+// would have to be saved at every call in a caller-saved register
+var acrossCallPool = []ir.PhysReg{"rbx", "r12", "r13", "r14", "r15", "rcx", "rsi", "rdi", "r8", "r9"}
+
+// allocator holds what both methods need to know about a function
+type allocator struct {
+	list       []ir.IntermediateRepresentation
+	live       *liveness.Info
+	candidates []ir.Operand // in order of first appearance
+	interfere  map[ir.Operand]map[ir.Operand]bool
+	moves      map[ir.Operand][]ir.Operand // partners of mov instructions
+	acrossCall map[ir.Operand]bool
+	assigned   map[ir.Operand]ir.PhysReg
+}
+
+// Allocate returns f with its temps and variables in registers where
+// they fit and with the registers each call saves
+func Allocate(f *ir_translator.IrFunction, method Method) *ir_translator.IrFunction {
+	return SaveAcrossCalls(allocate(f, method).rewrite(f))
+}
+
+// Assignment returns the registers Allocate gives the temps and
+// variables of f; those missing are spilled
+func Assignment(f *ir_translator.IrFunction, method Method) map[ir.Operand]ir.PhysReg {
+	return allocate(f, method).assigned
+}
+
+func allocate(f *ir_translator.IrFunction, method Method) *allocator {
+	a := &allocator{
+		list: f.ReadIrList(),
+		live: liveness.Analyze(f.ReadIrList()),
+		interfere: map[ir.Operand]map[ir.Operand]bool{},
+		moves: map[ir.Operand][]ir.Operand{},
+		acrossCall: map[ir.Operand]bool{},
+		assigned: map[ir.Operand]ir.PhysReg{},
+	}
+	a.findCandidates()
+	a.buildInterference()
+	if method == GraphColouring {
+		a.colour()
+	} else {
+		a.linearScan()
+	}
+	return a
+}
+
+// findCandidates collects the temps and variables but those whose
+// address is taken
+func (a *allocator) findCandidates() {
+	seen := map[ir.Operand]bool{}
+	taken := map[ir.Operand]bool{}
+	for _, inst := range a.list {
+		if ci, ok := inst.(ir.CalcInst); ok && ci.Operation == ir.LEA {
+			taken[ci.Operand2] = true
+		}
+		ir.MapOperands(inst, func(o ir.Operand, def bool) ir.Operand {
+			if !seen[o] {
+				seen[o] = true
+				a.candidates = append(a.candidates, o)
+			}
+			return o
+		})
+	}
+	candidates := []ir.Operand{}
+	for _, v := range a.candidates {
+		switch v.(type) {
+		case ir.Temp, ir.Var:
+			if !taken[v] {
+				candidates = append(candidates, v)
+			}
+		}
+	}
+	a.candidates = candidates
+}
+
+func (a *allocator) addEdge(x ir.Operand, y ir.Operand) {
+	if x == y {
+		return
+	}
+	for _, v := range [][2]ir.Operand{{x, y}, {y, x}} {
+		if a.interfere[v[0]] == nil {
+			a.interfere[v[0]] = map[ir.Operand]bool{}
+		}
+		a.interfere[v[0]][v[1]] = true
+	}
+}
+
+// buildInterference links what an instruction writes with everything
+// live after it, but for the source of a mov, which may share the
+// register of its destination. Registers are nodes too, so a candidate
+// does not get one that is in use while it is live. The caller-saved
+// registers of the pool a call writes are left out, the call saves the
+// ones in use.
+func (a *allocator) buildInterference() {
+	for k, inst := range a.list {
+		if _, ok := inst.(ir.CallInst); ok {
+			for v := range a.live.LiveOut(k) {
+				a.acrossCall[v] = true
+			}
+		}
+		var source ir.Operand
+		if ci, ok := inst.(ir.CalcInst); ok && ci.Operation == ir.MOV {
+			source = ci.Operand2
+			if ir.IsLocal(ci.Operand1) || ir.IsLocal(ci.Operand2) {
+				a.moves[ci.Operand1] = append(a.moves[ci.Operand1], ci.Operand2)
+				a.moves[ci.Operand2] = append(a.moves[ci.Operand2], ci.Operand1)
+			}
+		}
+		for _, d := range liveness.Defs(inst) {
+			if r, ok := d.(ir.PhysReg); ok && inPool(r) && isCall(inst) {
+				continue
+			}
+			for v := range a.live.LiveOut(k) {
+				if v != source {
+					a.addEdge(d, v)
+				}
+			}
+		}
+	}
+}
+
+// fixed returns the registers of the pool v cannot have because the
+// IR names them while v is live
+func (a *allocator) fixed(v ir.Operand) map[ir.PhysReg]bool {
+	result := map[ir.PhysReg]bool{}
+	for w := range a.interfere[v] {
+		if r, ok := w.(ir.PhysReg); ok {
+			result[r] = true
+		}
+	}
+	return result
+}
+
+func isCall(inst ir.IntermediateRepresentation) bool {
+	_, ok := inst.(ir.CallInst)
+	return ok
+}
+
+func inPool(r ir.PhysReg) bool {
+	for _, v := range pool {
+		if v == r {
+			return true
+		}
+	}
+	return false
+}
+
+// hint returns the register of a move partner of v that is free, "" if
+// there is none
+func (a *allocator) hint(v ir.Operand, free func(r ir.PhysReg) bool) ir.PhysReg {
+	for _, w := range a.moves[v] {
+		r, ok := w.(ir.PhysReg)
+		if !ok {
+			r, ok = a.assigned[w]
+		}
+		if ok && inPool(r) && free(r) {
+			return r
+		}
+	}
+	return ""
+}
+
+// choose picks the register for v among the free ones: a move partner's
+// if possible, so that the mov goes away, else the first of the pool
+func (a *allocator) choose(v ir.Operand, free func(r ir.PhysReg) bool) (ir.PhysReg, bool) {
+	if r := a.hint(v, free); r != "" {
+		return r, true
+	}
+	order := pool
+	if a.acrossCall[v] {
+		order = acrossCallPool
+	}
+	for _, r := range order {
+		if free(r) {
+			return r, true
+		}
+	}
+	return "", false
+}
+
+// interval is the part of the function where a candidate is live, in
+// points: 2k before instruction k and 2k + 1 after it
+type interval struct {
+	v     ir.Operand
+	start int
+	end   int
+}
+
+func (a *allocator) intervals() []*interval {
+	result := map[ir.Operand]*interval{}
+	extend := func(v ir.Operand, point int) {
+		if i, ok := result[v]; ok {
+			if point < i.start {
+				i.start = point
+			}
+			if point > i.end {
+				i.end = point
+			}
+		} else {
+			result[v] = &interval{v, point, point}
+		}
+	}
+	for k, inst := range a.list {
+		for v := range a.live.LiveIn(k) {
+			extend(v, 2 * k)
+		}
+		for v := range a.live.LiveOut(k) {
+			extend(v, 2 * k + 1)
+		}
+		// written but never read, the register is still written
+		for _, v := range ir.Defs(inst) {
+			extend(v, 2 * k + 1)
+		}
+	}
+	list := []*interval{}
+	for _, v := range a.candidates {
+		if i, ok := result[v]; ok {
+			list = append(list, i)
+		}
+	}
+	sort.SliceStable(list, func(x int, y int) bool {
+		return list[x].start < list[y].start
+	})
+	return list
+}
+
+// linearScan walks the intervals by start, giving each a register no
+// active interval holds. When none is left the interval ending last is
+// spilled, which may be the new one.
+func (a *allocator) linearScan() {
+	active := []*interval{}
+	for _, i := range a.intervals() {
+		kept := []*interval{}
+		for _, j := range active {
+			if j.end >= i.start {
+				kept = append(kept, j)
+			}
+		}
+		active = kept
+		held := map[ir.PhysReg]bool{}
+		for _, j := range active {
+			held[a.assigned[j.v]] = true
+		}
+		forbidden := a.fixed(i.v)
+		r, ok := a.choose(i.v, func(r ir.PhysReg) bool {
+			return !held[r] && !forbidden[r]
+		})
+		if ok {
+			a.assigned[i.v] = r
+			active = append(active, i)
+			continue
+		}
+		// spill the active interval ending last whose register i can take
+		victim := -1
+		for k, j := range active {
+			if j.end > i.end && !forbidden[a.assigned[j.v]] &&
+			   (victim < 0 || j.end > active[victim].end) {
+				victim = k
+			}
+		}
+		if victim < 0 {
+			continue
+		}
+		j := active[victim]
+		a.assigned[i.v] = a.assigned[j.v]
+		delete(a.assigned, j.v)
+		active[victim] = i
+	}
+}
+
+// colour simplifies the graph by taking away the candidates with fewer
+// neighbours than registers, then the ones spilling costs least, and
+// colours them in reverse order. A candidate taken away as a spill may
+// still find a register (Briggs), else it stays in memory.
+func (a *allocator) colour() {
+	degree := map[ir.Operand]int{}
+	uses := map[ir.Operand]int{}
+	removed := map[ir.Operand]bool{}
+	for _, v := range a.candidates {
+		degree[v] = len(a.interfere[v])
+	}
+	for _, inst := range a.list {
+		ir.MapOperands(inst, func(o ir.Operand, def bool) ir.Operand {
+			uses[o]++
+			return o
+		})
+	}
+	stack := []ir.Operand{}
+	for len(stack) < len(a.candidates) {
+		var next ir.Operand
+		for _, v := range a.candidates {
+			if !removed[v] && degree[v] < len(pool) {
+				next = v
+				break
+			}
+		}
+		if next == nil {
+			// the cheapest to spill: few uses, many neighbours
+			for _, v := range a.candidates {
+				if !removed[v] && (next == nil ||
+				   uses[v] * degree[next] < uses[next] * degree[v]) {
+					next = v
+				}
+			}
+		}
+		removed[next] = true
+		stack = append(stack, next)
+		for w := range a.interfere[next] {
+			degree[w]--
+		}
+	}
+	for k := len(stack) - 1; k >= 0; k-- {
+		v := stack[k]
+		forbidden := a.fixed(v)
+		for w := range a.interfere[v] {
+			if r, ok := a.assigned[w]; ok {
+				forbidden[r] = true
+			}
+		}
+		if r, ok := a.choose(v, func(r ir.PhysReg) bool { return !forbidden[r] }); ok {
+			a.assigned[v] = r
+		}
+	}
+}
+
+// rewrite puts the registers in, drops the movs that became `mov r r`,
+// numbers the spilled temps from 0 and takes the variables now in
+// registers out of the address map
+func (a *allocator) rewrite(f *ir_translator.IrFunction) *ir_translator.IrFunction {
+	temps := map[ir.Temp]ir.Temp{}
+	list := []ir.IntermediateRepresentation{}
+	for _, inst := range a.list {
+		inst = ir.MapOperands(inst, func(o ir.Operand, def bool) ir.Operand {
+			if r, ok := a.assigned[o]; ok {
+				return r
+			}
+			if t, ok := o.(ir.Temp); ok {
+				if _, ok := temps[t]; !ok {
+					temps[t] = ir.Temp(len(temps))
+				}
+				return temps[t]
+			}
+			return o
+		})
+		if ci, ok := inst.(ir.CalcInst); ok && ci.Operation == ir.MOV &&
+		   ci.Operand1 == ci.Operand2 {
+			continue
+		}
+		list = append(list, inst)
+	}
+	addressMap := map[string]int{}
+	for k, v := range f.ReadAddressMap() {
+		if _, ok := a.assigned[ir.Var(k)]; !ok {
+			addressMap[k] = v
+		}
+	}
+	return ir_translator.NewIrFunction(f.ReadName(), f.ReadSpan(), list, addressMap,
+		f.ReadFrameSize(), len(temps))
+}
+
+// SaveAcrossCalls records in each call of f the caller-saved registers
+// live across it and makes room for them above the temps
+func SaveAcrossCalls(f *ir_translator.IrFunction) *ir_translator.IrFunction {
+	list := append([]ir.IntermediateRepresentation{}, f.ReadIrList()...)
+	most := 0
+	for k, saved := range liveness.AcrossCalls(list) {
+		call := list[k].(ir.CallInst)
+		call.Saved = saved
+		list[k] = call
+		if len(saved) > most {
+			most = len(saved)
+		}
+	}
+	return ir_translator.NewIrFunction(f.ReadName(), f.ReadSpan(), list, f.ReadAddressMap(),
+		f.ReadFrameSize(), f.ReadMaxRegister() + most)
+}
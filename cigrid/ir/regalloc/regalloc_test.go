@@ -0,0 +1,153 @@
+package regalloc
+
+import "bytes"
+import "cigrid/ir"
+import "cigrid/ir/interp"
+import "cigrid/ir/liveness"
+import "cigrid/ir/parse"
+import "cigrid/ir_translator"
+import "sort"
+import "testing"
+
+func read(t *testing.T, text string) []*ir_translator.IrFunction {
+	p := parse.New("test.ir", text)
+	program := p.Parse()
+	for _, d := range p.Diagnostics().Items() {
+		t.Fatalf("%d:%d: %s", d.Span.Start.Line, d.Span.Start.Column, d.Message)
+	}
+	return program.ReadIrFunctionList()
+}
+
+func calls(list []ir.IntermediateRepresentation) []int {
+	result := []int{}
+	for k, inst := range list {
+		if _, ok := inst.(ir.CallInst); ok {
+			result = append(result, k)
+		}
+	}
+	return result
+}
+
+func names(list []ir.PhysReg) []string {
+	result := []string{}
+	for _, v := range list {
+		result = append(result, string(v))
+	}
+	sort.Strings(result)
+	return result
+}
+
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if a[k] != b[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestSaveAcrossCalls saves what is read after a call, also after a
+// second one, but not a register written again first
+func TestSaveAcrossCalls(t *testing.T) {
+	f := read(t, `function main frame 0 temps 0
+	mov %rcx 1
+	mov %rsi 2
+	mov %rdi 3
+	call f 0
+	mov %rax %rcx
+	mov %rsi 5
+	call f 0
+	add %rax %rsi
+	add %rax %rdi
+	ret
+end
+`)[0]
+	g := SaveAcrossCalls(f)
+	want := [][]string{{"rcx", "rdi"}, {"rdi", "rsi"}}
+	for n, k := range calls(g.ReadIrList()) {
+		got := names(g.ReadIrList()[k].(ir.CallInst).Saved)
+		if !equal(got, want[n]) {
+			t.Errorf("call %d saves %v, want %v", n, got, want[n])
+		}
+	}
+	if g.ReadMaxRegister() != 2 {
+		t.Errorf("%d temps, want 2 to hold the saved registers", g.ReadMaxRegister())
+	}
+}
+
+// program keeps seven temps live across the first call, more than there
+// are callee-saved registers, and only temp7 across the second
+const program = `function g frame 0 temps 0
+	mov %rcx -1
+	mov %rsi -1
+	mov %rdi -1
+	mov %rax 0
+	ret
+end
+function main frame 0 temps 8
+	mov temp0 1
+	mov temp1 2
+	mov temp2 3
+	mov temp3 4
+	mov temp4 5
+	mov temp5 6
+	mov temp6 7
+	xor %rax %rax
+	call g 0
+	mov temp7 temp0
+	add temp7 temp1
+	add temp7 temp2
+	add temp7 temp3
+	add temp7 temp4
+	add temp7 temp5
+	add temp7 temp6
+	xor %rax %rax
+	call g 0
+	mov %rax temp7
+	ret
+end
+`
+
+// TestAllocateSaved checks that each call saves exactly the caller-saved
+// registers holding a value live across it, and that the values survive
+// in the interpreter, which scrambles the others after a call
+func TestAllocateSaved(t *testing.T) {
+	callerSaved := map[ir.PhysReg]bool{}
+	for _, v := range liveness.CallerSaved {
+		callerSaved[v] = true
+	}
+	for _, method := range []Method{LinearScan, GraphColouring} {
+		functions := read(t, program)
+		f := functions[1]
+		assigned := Assignment(f, method)
+		live := liveness.Analyze(f.ReadIrList())
+		g := Allocate(f, method)
+		before, after := calls(f.ReadIrList()), calls(g.ReadIrList())
+		if len(before) != len(after) {
+			t.Fatalf("method %d: %d calls, want %d", method, len(after), len(before))
+		}
+		for n := range before {
+			want := []ir.PhysReg{}
+			for v := range live.LiveOut(before[n]) {
+				if r, ok := assigned[v]; ok && callerSaved[r] {
+					want = append(want, r)
+				}
+			}
+			got := names(g.ReadIrList()[after[n]].(ir.CallInst).Saved)
+			if !equal(got, names(want)) {
+				t.Errorf("method %d: call %d saves %v, want %v", method, n, got, names(want))
+			}
+		}
+		if len(g.ReadIrList()[after[0]].(ir.CallInst).Saved) == 0 {
+			t.Errorf("method %d: seven values cannot all be in callee-saved registers", method)
+		}
+		functions[1] = g
+		code, err := interp.New(ir_translator.NewFromIr(functions, nil, nil), &bytes.Buffer{}).Run()
+		if err != nil || code != 28 {
+			t.Errorf("method %d: exit status %d, %v, want 28", method, code, err)
+		}
+	}
+}
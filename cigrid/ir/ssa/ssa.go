@@ -0,0 +1,485 @@
+// Package ssa converts the IR of a function into static single
+// assignment form and back.
+//
+// Build gives every block a label, turns arithmetic on temps and
+// variables into ThreeInst, places phis at the dominance frontiers of the
+// definitions (semi-pruned: only for names live across blocks) and
+// renames every definition to a new Value. Variables whose address is
+// taken with lea live in memory and are left alone. Unreachable blocks
+// are dropped.
+//
+// Destruct turns each Value into a temp of its own, replaces the phis by
+// copies at the end of the predecessors, splitting critical edges, and
+// lowers ThreeInst back to two-address form.
+package ssa
+
+import "cigrid/ir"
+import "cigrid/ir/cfg"
+import "cigrid/ir_translator"
+import "strconv"
+
+// arithmetic are the two-address operations that become a ThreeInst
+var arithmetic = map[ir.Op]bool{
+	ir.ADD: true, ir.SUB: true, ir.XOR: true, ir.MUL: true, ir.DIV: true,
+	ir.MOD: true,
+}
+
+// IsSSA tells whether f is in SSA form already, as a function read from
+// the textual IR may be: it has phis, three-address instructions or
+// versioned values. Build must not be run on it again.
+func IsSSA(f *ir_translator.IrFunction) bool {
+	for _, v := range f.ReadIrList() {
+		switch v.(type) {
+		case ir.PhiInst, ir.ThreeInst:
+			return true
+		}
+		for _, o := range append(ir.Defs(v), ir.Uses(v)...) {
+			if _, ok := o.(ir.Value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Build returns f in SSA form. f must not be in SSA form already, see
+// IsSSA.
+func Build(f *ir_translator.IrFunction) *ir_translator.IrFunction {
+	g := cfg.New(f.ReadIrList())
+	labels := blockLabels(g)
+	promoted := promotable(f.ReadIrList())
+
+	// three-address form, per reachable block, without the labels
+	body := map[*cfg.Block][]ir.IntermediateRepresentation{}
+	for _, b := range g.ReversePostorder() {
+		for _, v := range b.Insts {
+			if _, ok := v.(ir.Label); ok {
+				continue
+			}
+			body[b] = append(body[b], threeAddress(v, promoted))
+		}
+	}
+
+	phis := placePhis(g, body, promoted)
+	r := &renamer{
+		g: g,
+		labels: labels,
+		body: body,
+		phis: phis,
+		tree: g.DominatorTree(),
+		stacks: map[ir.Operand][]int{},
+		counter: map[ir.Operand]int{},
+		promoted: promoted,
+	}
+	r.rename(g.Entry)
+
+	result := []ir.IntermediateRepresentation{}
+	for _, b := range g.Blocks {
+		if !g.Reachable(b) {
+			continue
+		}
+		result = append(result, ir.Label(labels[b]))
+		for _, v := range phis[b] {
+			result = append(result, *v)
+		}
+		result = append(result, body[b]...)
+	}
+	addressMap := map[string]int{}
+	for k, v := range f.ReadAddressMap() {
+		if !promoted[ir.Var(k)] {
+			addressMap[k] = v
+		}
+	}
+	return ir_translator.NewIrFunction(f.ReadName(), f.ReadSpan(), result, addressMap,
+		f.ReadFrameSize(), f.ReadMaxRegister())
+}
+
+// blockLabels names every block, by its own label if it has one
+func blockLabels(g *cfg.Graph) map[*cfg.Block]string {
+	labels := map[*cfg.Block]string{}
+	for _, b := range g.Blocks {
+		if b.Label != "" {
+			labels[b] = b.Label
+		}
+	}
+	for _, b := range g.Blocks {
+		if b.Label != "" {
+			continue
+		}
+		label := "." + b.Name()
+		for g.Block(label) != nil {
+			label += "_"
+		}
+		labels[b] = label
+	}
+	return labels
+}
+
+// promotable finds the temps and variables that can be renamed: all but
+// the variables whose address is taken
+func promotable(list []ir.IntermediateRepresentation) map[ir.Operand]bool {
+	result := map[ir.Operand]bool{}
+	taken := map[ir.Operand]bool{}
+	for _, inst := range list {
+		if ci, ok := inst.(ir.CalcInst); ok && ci.Operation == ir.LEA {
+			taken[ci.Operand2] = true
+		}
+		ir.MapOperands(inst, func(o ir.Operand, def bool) ir.Operand {
+			result[o] = true
+			return o
+		})
+	}
+	for k := range taken {
+		delete(result, k)
+	}
+	return result
+}
+
+// threeAddress rewrites arithmetic that writes a promoted name, the only
+// instructions that read and write the same operand
+func threeAddress(inst ir.IntermediateRepresentation,
+				  promoted map[ir.Operand]bool) ir.IntermediateRepresentation {
+	switch inst := inst.(type) {
+	case ir.CalcInst:
+		if arithmetic[inst.Operation] && promoted[inst.Operand1] {
+			return ir.ThreeInst{Operation: inst.Operation, Dest: inst.Operand1,
+				Left: inst.Operand1, Right: inst.Operand2}
+		}
+	case ir.OneInst:
+		if inst.Operation == ir.NEG && promoted[inst.Operand1] {
+			return ir.ThreeInst{Operation: ir.NEG, Dest: inst.Operand1,
+				Left: inst.Operand1}
+		}
+	}
+	return inst
+}
+
+// placePhis inserts empty phis for the names used in more than one block
+// at the iterated dominance frontier of their definitions
+func placePhis(g *cfg.Graph, body map[*cfg.Block][]ir.IntermediateRepresentation,
+			   promoted map[ir.Operand]bool) map[*cfg.Block][]*ir.PhiInst {
+	global := map[ir.Operand]bool{}
+	defsites := map[ir.Operand][]*cfg.Block{}
+	names := []ir.Operand{} // in order of first definition, for stable output
+	for _, b := range g.ReversePostorder() {
+		defined := map[ir.Operand]bool{}
+		for _, inst := range body[b] {
+			for _, v := range ir.Uses(inst) {
+				if promoted[v] && !defined[v] {
+					global[v] = true
+				}
+			}
+			for _, v := range ir.Defs(inst) {
+				if !promoted[v] || defined[v] {
+					continue
+				}
+				defined[v] = true
+				if defsites[v] == nil {
+					names = append(names, v)
+				}
+				defsites[v] = append(defsites[v], b)
+			}
+		}
+	}
+	phis := map[*cfg.Block][]*ir.PhiInst{}
+	for _, name := range names {
+		if !global[name] {
+			continue
+		}
+		has := map[*cfg.Block]bool{}
+		work := append([]*cfg.Block{}, defsites[name]...)
+		for len(work) > 0 {
+			b := work[len(work) - 1]
+			work = work[:len(work) - 1]
+			for _, d := range g.Frontier(b) {
+				if has[d] {
+					continue
+				}
+				has[d] = true
+				phis[d] = append(phis[d], &ir.PhiInst{Dest: name})
+				work = append(work, d)
+			}
+		}
+	}
+	return phis
+}
+
+// renamer gives every definition a new version, walking the dominator
+// tree with a stack of the current versions of each name
+type renamer struct {
+	g        *cfg.Graph
+	labels   map[*cfg.Block]string
+	body     map[*cfg.Block][]ir.IntermediateRepresentation
+	phis     map[*cfg.Block][]*ir.PhiInst
+	tree     map[*cfg.Block][]*cfg.Block
+	stacks   map[ir.Operand][]int
+	counter  map[ir.Operand]int
+	promoted map[ir.Operand]bool
+}
+
+func (r *renamer) current(name ir.Operand) ir.Operand {
+	stack := r.stacks[name]
+	if len(stack) == 0 {
+		return ir.Value{Of: name, N: 0}
+	}
+	return ir.Value{Of: name, N: stack[len(stack) - 1]}
+}
+
+func (r *renamer) define(name ir.Operand, pushed *[]ir.Operand) ir.Operand {
+	r.counter[name]++
+	r.stacks[name] = append(r.stacks[name], r.counter[name])
+	*pushed = append(*pushed, name)
+	return ir.Value{Of: name, N: r.counter[name]}
+}
+
+func (r *renamer) rename(b *cfg.Block) {
+	pushed := []ir.Operand{}
+	for _, phi := range r.phis[b] {
+		phi.Dest = r.define(phi.Dest, &pushed)
+	}
+	for k, inst := range r.body[b] {
+		r.body[b][k] = ir.MapOperands(inst, func(o ir.Operand, def bool) ir.Operand {
+			if !r.promoted[o] {
+				return o
+			} else if def {
+				return r.define(o, &pushed)
+			}
+			return r.current(o)
+		})
+	}
+	for _, s := range b.Succs {
+		for _, phi := range r.phis[s] {
+			name := phi.Dest
+			if value, ok := name.(ir.Value); ok {
+				name = value.Of
+			}
+			phi.Args = append(phi.Args, ir.PhiArg{Pred: r.labels[b], Value: r.current(name)})
+		}
+	}
+	for _, c := range r.tree[b] {
+		r.rename(c)
+	}
+	for _, v := range pushed {
+		r.stacks[v] = r.stacks[v][:len(r.stacks[v]) - 1]
+	}
+}
+
+// Destruct returns f, in SSA form, in the two-address form the backend
+// takes. Every Value becomes a temp of its own.
+func Destruct(f *ir_translator.IrFunction) *ir_translator.IrFunction {
+	d := &destructor{temps: map[ir.Value]ir.Temp{}}
+	g := cfg.New(f.ReadIrList())
+	phis := map[string][]ir.PhiInst{} // by block label
+	for _, b := range g.Blocks {
+		for _, v := range b.Insts {
+			if phi, ok := v.(ir.PhiInst); ok {
+				phis[b.Label] = append(phis[b.Label], phi)
+			}
+		}
+	}
+	// copies returns the parallel copy on the edge from pred to the block
+	// starting with label
+	copies := func(pred *cfg.Block, label string) []ir.IntermediateRepresentation {
+		moves := []move{}
+		for _, phi := range phis[label] {
+			for _, arg := range phi.Args {
+				if arg.Pred == pred.Label {
+					moves = append(moves, move{dest: d.operand(phi.Dest),
+						src: d.operand(arg.Value)})
+				}
+			}
+		}
+		return d.sequentialize(moves)
+	}
+
+	result := []ir.IntermediateRepresentation{}
+	split := []ir.IntermediateRepresentation{} // blocks for critical edges
+	for k, b := range g.Blocks {
+		insts := []ir.IntermediateRepresentation{}
+		for _, v := range b.Insts {
+			if _, ok := v.(ir.PhiInst); !ok {
+				insts = append(insts, d.lower(v)...)
+			}
+		}
+		next := ""
+		if k + 1 < len(g.Blocks) {
+			next = g.Blocks[k + 1].Label
+		}
+		var last ir.IntermediateRepresentation
+		if len(insts) > 0 {
+			last = insts[len(insts) - 1]
+		}
+		switch last := last.(type) {
+		case ir.Ret:
+			result = append(result, insts...)
+		case ir.JumpInst:
+			if last.JC == ir.MP {
+				result = append(result, insts[:len(insts) - 1]...)
+				result = append(result, copies(b, last.Addr)...)
+				result = append(result, last)
+				break
+			}
+			// a conditional jump leaves on two edges, the copies for the
+			// jump go to a block of their own at the end of the function
+			if edge := copies(b, last.Addr); len(edge) > 0 {
+				label := d.newLabel(g)
+				split = append(split, ir.Label(label))
+				split = append(split, edge...)
+				split = append(split, ir.JumpInst{JC: ir.MP, Addr: last.Addr})
+				last.Addr = label
+				insts[len(insts) - 1] = last
+			}
+			result = append(result, insts...)
+			// and the fallthrough copies only run when falling through
+			result = append(result, copies(b, next)...)
+		default:
+			result = append(result, insts...)
+			result = append(result, copies(b, next)...)
+		}
+	}
+	result = append(result, split...)
+	return ir_translator.NewIrFunction(f.ReadName(), f.ReadSpan(), result, f.ReadAddressMap(),
+		f.ReadFrameSize(), d.next)
+}
+
+type destructor struct {
+	temps  map[ir.Value]ir.Temp
+	next   int // number of temps used
+	labels int
+}
+
+func (d *destructor) newTemp() ir.Temp {
+	d.next++
+	return ir.Temp(d.next - 1)
+}
+
+func (d *destructor) newLabel(g *cfg.Graph) string {
+	for {
+		label := ".E" + strconv.Itoa(d.labels)
+		d.labels++
+		if g.Block(label) == nil {
+			return label
+		}
+	}
+}
+
+// operand maps a Value to its temp
+func (d *destructor) operand(o ir.Operand) ir.Operand {
+	value, ok := o.(ir.Value)
+	if !ok {
+		return o
+	}
+	if t, ok := d.temps[value]; ok {
+		return t
+	}
+	d.temps[value] = d.newTemp()
+	return d.temps[value]
+}
+
+// lower maps the Values of inst to temps and turns a ThreeInst back into
+// two-address instructions
+func (d *destructor) lower(inst ir.IntermediateRepresentation) []ir.IntermediateRepresentation {
+	inst = ir.MapOperands(inst, func(o ir.Operand, def bool) ir.Operand {
+		return d.operand(o)
+	})
+	ti, ok := inst.(ir.ThreeInst)
+	if !ok {
+		return []ir.IntermediateRepresentation{inst}
+	}
+	if ti.Right == nil {
+		result := []ir.IntermediateRepresentation{}
+		if ti.Dest != ti.Left {
+			result = append(result, ir.CalcInst{Operation: ir.MOV, Operand1: ti.Dest, Operand2: ti.Left})
+		}
+		return append(result, ir.OneInst{Operation: ti.Operation, Operand1: ti.Dest})
+	}
+	if ti.Dest == ti.Left {
+		return []ir.IntermediateRepresentation{
+			ir.CalcInst{Operation: ti.Operation, Operand1: ti.Dest, Operand2: ti.Right},
+		}
+	}
+	if ti.Dest == ti.Right {
+		if ti.Operation == ir.ADD || ti.Operation == ir.XOR || ti.Operation == ir.MUL {
+			return []ir.IntermediateRepresentation{
+				ir.CalcInst{Operation: ti.Operation, Operand1: ti.Dest, Operand2: ti.Left},
+			}
+		}
+		// Dest = Left - Dest needs the old Dest after writing Left
+		t := d.newTemp()
+		return []ir.IntermediateRepresentation{
+			ir.CalcInst{Operation: ir.MOV, Operand1: t, Operand2: ti.Left},
+			ir.CalcInst{Operation: ti.Operation, Operand1: t, Operand2: ti.Right},
+			ir.CalcInst{Operation: ir.MOV, Operand1: ti.Dest, Operand2: t},
+		}
+	}
+	return []ir.IntermediateRepresentation{
+		ir.CalcInst{Operation: ir.MOV, Operand1: ti.Dest, Operand2: ti.Left},
+		ir.CalcInst{Operation: ti.Operation, Operand1: ti.Dest, Operand2: ti.Right},
+	}
+}
+
+// move is one copy of a parallel copy
+type move struct {
+	dest ir.Operand
+	src  ir.Operand
+}
+
+// sequentialize orders the copies of a parallel copy so that every copy
+// reads its source before it is overwritten, breaking cycles with a new
+// temp. This is the algorithm of Boissinot et al., "Revisiting Out-of-SSA
+// Translation for Correctness, Code Quality, and Efficiency".
+func (d *destructor) sequentialize(moves []move) []ir.IntermediateRepresentation {
+	result := []ir.IntermediateRepresentation{}
+	emit := func(dest ir.Operand, src ir.Operand) {
+		result = append(result, ir.CalcInst{Operation: ir.MOV, Operand1: dest, Operand2: src})
+	}
+	loc := map[ir.Operand]ir.Operand{}  // where the old value of a source is now
+	pred := map[ir.Operand]ir.Operand{} // the source of a destination
+	todo := []ir.Operand{}
+	constants := []move{}
+	for _, m := range moves {
+		if !ir.IsLocal(m.src) {
+			constants = append(constants, m)
+		} else if m.dest != m.src {
+			loc[m.src] = m.src
+			pred[m.dest] = m.src
+			todo = append(todo, m.dest)
+		}
+	}
+	ready := []ir.Operand{} // destinations that can be written
+	for _, b := range todo {
+		if loc[b] == nil {
+			ready = append(ready, b)
+		}
+	}
+	var spare ir.Operand
+	for len(todo) > 0 {
+		for len(ready) > 0 {
+			b := ready[len(ready) - 1]
+			ready = ready[:len(ready) - 1]
+			a := pred[b]
+			c := loc[a]
+			emit(b, c)
+			loc[a] = b
+			if a == c && pred[a] != nil {
+				ready = append(ready, a)
+			}
+		}
+		b := todo[len(todo) - 1]
+		todo = todo[:len(todo) - 1]
+		if loc[b] == b {
+			// b is in a cycle and still holds its old value
+			if spare == nil {
+				spare = d.newTemp()
+			}
+			emit(spare, b)
+			loc[b] = spare
+			ready = append(ready, b)
+		}
+	}
+	// constants read no location, so they go last
+	for _, m := range constants {
+		emit(m.dest, m.src)
+	}
+	return result
+}
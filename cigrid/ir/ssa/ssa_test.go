@@ -0,0 +1,123 @@
+package ssa
+
+import "bytes"
+import "cigrid/ir/interp"
+import "cigrid/ir/parse"
+import "cigrid/ir_translator"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "testing"
+
+func read(t *testing.T, file string, text string) *ir_translator.IrTranslator {
+	p := parse.New(file, text)
+	program := p.Parse()
+	for _, d := range p.Diagnostics().Items() {
+		t.Fatalf("%s:%d:%d: %s", file, d.Span.Start.Line, d.Span.Start.Column, d.Message)
+	}
+	return program
+}
+
+// each returns program with f applied to every function
+func each(program *ir_translator.IrTranslator,
+		  f func(*ir_translator.IrFunction) *ir_translator.IrFunction) *ir_translator.IrTranslator {
+	functions := []*ir_translator.IrFunction{}
+	for _, v := range program.ReadIrFunctionList() {
+		functions = append(functions, f(v))
+	}
+	return ir_translator.NewFromIr(functions, program.ReadStringList(), program.ReadGlobalList())
+}
+
+// output runs program and returns what it prints and its exit status
+func output(t *testing.T, program *ir_translator.IrTranslator) string {
+	var out bytes.Buffer
+	m := interp.New(program, &out)
+	m.Limit(100000)
+	code, err := m.Run()
+	if err != nil {
+		t.Fatalf("runtime error: %v", err)
+	}
+	return out.String() + "exit " + strconv.Itoa(code) + "\n"
+}
+
+// TestGolden builds the SSA form of every testdata/*.ir and compares it
+// with the .ssa file, then checks that after Destruct it still prints
+// what the .out file holds
+func TestGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.ir"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no testdata: %v", err)
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			input, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			base := strings.TrimSuffix(file, ".ir")
+			want, err := os.ReadFile(base + ".ssa")
+			if err != nil {
+				t.Fatal(err)
+			}
+			program := read(t, file, string(input))
+			built := each(program, Build)
+			if got := built.String(); got != string(want) {
+				t.Errorf("SSA form\n%swant\n%s", got, want)
+			}
+			for _, v := range built.ReadIrFunctionList() {
+				if !IsSSA(v) {
+					t.Errorf("%s: built, but IsSSA says no", v.ReadName())
+				}
+			}
+			for _, v := range program.ReadIrFunctionList() {
+				if IsSSA(v) {
+					t.Errorf("%s: not built, but IsSSA says yes", v.ReadName())
+				}
+			}
+			out, err := os.ReadFile(base + ".out")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := output(t, each(built, Destruct)); got != string(out) {
+				t.Errorf("after Destruct printed\n%swant\n%s", got, out)
+			}
+		})
+	}
+}
+
+// cycle swaps a and b through two phis that read each other, so Destruct
+// has to break the cycle of copies with a temp
+const cycle = `string str1 "%d %d\n"
+function main frame 0 temps 0
+.B0:
+	jmp .L1
+.L1:
+	a#1 = phi .B0: 1, .L2: b#1
+	b#1 = phi .B0: 2, .L2: a#1
+	n#1 = phi .B0: 0, .L2: n#2
+	cmp n#1 3
+	jge .L3
+.L2:
+	n#2 = add n#1 1
+	jmp .L1
+.L3:
+	mov %rdi @str1
+	mov %rsi a#1
+	mov %rdx b#1
+	xor %rax %rax
+	call printf 3
+	mov %rax 0
+	ret
+end
+`
+
+func TestDestructCycle(t *testing.T) {
+	program := read(t, "cycle.ir", cycle)
+	if !IsSSA(program.ReadIrFunctionList()[0]) {
+		t.Fatal("IsSSA does not see the phis")
+	}
+	if got := output(t, each(program, Destruct)); got != "2 1\nexit 0\n" {
+		t.Errorf("printed %q, want the values swapped three times", got)
+	}
+}
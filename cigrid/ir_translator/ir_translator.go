@@ -3,25 +3,29 @@ package ir_translator
 import "cigrid/token"
 import "cigrid/ast"
 import "cigrid/ir"
+import "cigrid/diag"
+import "cigrid/sema"
+import "cigrid/types"
 import "strconv"
 
 type IrFunction struct {
 	functionName string // 记录了当前函数名
+	span         token.Span // of the name in the declaration, for diagnostics
 	irList       []ir.IntermediateRepresentation
 	tempRegister int // how many temp registers have been used
 	maxRegister  int // the maximum one
-	variableMap  map[string]int // 记录是第几个变量
-	addressMap   map[string]int // 记录相应变量的地址
+	addressMap   map[string]int // 记录相应变量的地址 (第几个 slot)
+	frameSize    int // slots used by all variables
 	condition    int
 }
 
-func newIrFunc(fn string) *IrFunction {
+func newIrFunc(fn string, span token.Span) *IrFunction {
 	return &IrFunction{
 		functionName: fn,
+		span: span,
 		irList: []ir.IntermediateRepresentation{},
 		tempRegister: 0,
 		maxRegister: 0,
-		variableMap: make(map[string]int),
 		addressMap: make(map[string]int),
 	}
 }
@@ -30,6 +34,12 @@ func (i *IrFunction) ReadName() string {
 	return i.functionName
 }
 
+// ReadSpan returns where the function is declared, the zero span if it
+// has no source
+func (i *IrFunction) ReadSpan() token.Span {
+	return i.span
+}
+
 func (i *IrFunction) ReadIrList() []ir.IntermediateRepresentation {
 	return i.irList 
 }
@@ -38,24 +48,51 @@ func (i *IrFunction) ReadMaxRegister() int {
 	return i.maxRegister
 }
 
-func (i *IrFunction) ReadVariableMap() map[string]int {
-	return i.variableMap
-}
-
 func (i *IrFunction) ReadAddressMap() map[string]int {
 	return i.addressMap
 }
 
+// ReadFrameSize returns the number of 8 byte slots taken by variables;
+// temp registers are placed after them
+func (i *IrFunction) ReadFrameSize() int {
+	return i.frameSize
+}
+
+// allocate gives the variable v size consecutive slots
+func (i *IrFunction) allocate(v ir.Var, size int) {
+	name := string(v)
+	if _, ok := i.addressMap[name]; ok {
+		return
+	}
+	i.addressMap[name] = i.frameSize
+	i.frameSize += size
+}
+
+// GlobalData is a global variable or array as the backend emits it
+type GlobalData struct {
+	Name        string   // name in the assembly, e.g. g_x
+	Size        int      // number of qwords
+	Values      []string // qword initialisers, numbers or string labels
+	Initialized bool     // false: zero filled, goes to .bss
+	Dims        []int    // dimensions if the global is an array
+}
+
 type IrTranslator struct {
 	tree           *ast.ProgramLiteral // input
 	irFunctionList []*IrFunction
 	string_list    []string // record the string data
+	global_list    []*GlobalData
+	info           *sema.Info // resolved symbols of tree
+	diags          diag.List
 }
 
-func New(tree *ast.ProgramLiteral) *IrTranslator {
+// New creates a translator for tree. info must come from a sema.Analyzer
+// run on the same tree without errors.
+func New(tree *ast.ProgramLiteral, info *sema.Info) *IrTranslator {
 	return &IrTranslator{
 		tree: tree, 
 		irFunctionList: []*IrFunction{}, 
+		info: info,
 	}
 }
 
@@ -67,137 +104,350 @@ func (t *IrTranslator) ReadStringList() []string {
 	return t.string_list
 }
 
+func (t *IrTranslator) ReadGlobalList() []*GlobalData {
+	return t.global_list
+}
+
+// Diagnostics returns the constructs Translate could not lower
+func (t *IrTranslator) Diagnostics() *diag.List {
+	return &t.diags
+}
+
+// variable returns the operand of the variable ident resolves to: a
+// local like x.2, or the memory at a global like g_x
+func (t *IrTranslator) variable(ident *ast.Identifier) ir.Operand {
+	sym := t.info.Symbol(ident)
+	if sym.Kind == sema.Global {
+		return ir.Mem{Base: ir.Global(sym.Unique)}
+	}
+	return ir.Var(sym.Unique)
+}
+
+// local returns the operand of the parameter or local variable ident
+// declares
+func (t *IrTranslator) local(ident *ast.Identifier) ir.Var {
+	return ir.Var(t.info.Symbol(ident).Unique)
+}
+
+// addString adds s to the string table and returns its label
+func (t *IrTranslator) addString(s string) string {
+	t.string_list = append(t.string_list, s)
+	return "str" + strconv.Itoa(len(t.string_list))
+}
+
+// globalValue returns the qword initialiser of a global: a constant
+// integer or the label of a string literal
+func (t *IrTranslator) globalValue(expression ast.Expression) (string, bool) {
+	if exp, ok := expression.(*ast.StringLiteral); ok {
+		return t.addString(exp.Value.Literal), true
+	}
+	value, ok := sema.Constant(expression)
+	if !ok {
+		t.diags.Errorf(diag.NonConstantInitializer, expression.Span(),
+			"initializer of a global must be a constant")
+	}
+	return strconv.FormatInt(value, 10), ok
+}
+
+// flattenArray writes the elements of an array literal row by row into
+// values, which has room for an array of shape dims
+func (t *IrTranslator) flattenArray(al *ast.ArrayLiteral, dims []int, values []string) {
+	if len(al.Elements) > dims[0] {
+		t.diags.Errorf(diag.ArrayInitializerTooLong, al.Span(),
+			"too many initializers: array has %d elements", dims[0])
+		return
+	}
+	stride := len(values) / dims[0]
+	for k, v := range al.Elements {
+		inner, isArray := v.(*ast.ArrayLiteral)
+		if len(dims) > 1 && isArray {
+			t.flattenArray(inner, dims[1:], values[k * stride:(k + 1) * stride])
+		} else if len(dims) > 1 || isArray {
+			t.diags.Errorf(diag.ArrayInitializerShape, v.Span(),
+				"initializer does not match the array dimensions")
+		} else if value, ok := t.globalValue(v); ok {
+			values[k] = value
+		}
+	}
+}
+
+func (t *IrTranslator) translateGlobal(g ast.Global) {
+	gd := &GlobalData{}
+	if v, ok := g.(*ast.GlobalVarDef); ok {
+		gd.Name = t.info.Symbol(v.Name).Unique
+		gd.Size = 1
+		gd.Values = []string{"0"}
+		if v.Value != nil {
+			gd.Values[0], _ = t.globalValue(v.Value)
+			gd.Initialized = true
+		}
+	} else if v, ok := g.(*ast.GlobalArrayDef); ok {
+		gd.Name = t.info.Symbol(v.Name).Unique
+		gd.Size = 1
+		gd.Dims = v.Dims
+		for _, dim := range v.Dims {
+			gd.Size *= dim
+		}
+		gd.Values = make([]string, gd.Size)
+		for k := range gd.Values {
+			gd.Values[k] = "0"
+		}
+		if v.Value != nil && gd.Size > 0 {
+			t.flattenArray(v.Value, v.Dims, gd.Values)
+			gd.Initialized = true
+		}
+	}
+	t.global_list = append(t.global_list, gd)
+}
+
+func (t *IrTranslator) current() *IrFunction {
+	return t.irFunctionList[len(t.irFunctionList) - 1]
+}
+
+func (t *IrTranslator) emit(inst ir.IntermediateRepresentation) {
+	irFunc := t.current()
+	irFunc.irList = append(irFunc.irList, inst)
+}
+
+// newTemp returns a fresh temp register of the current statement
+func (t *IrTranslator) newTemp() int {
+	irFunc := t.current()
+	irFunc.tempRegister++
+	// 更新maxRegister
+	if irFunc.tempRegister > irFunc.maxRegister {
+		irFunc.maxRegister = irFunc.tempRegister
+	}
+	return irFunc.tempRegister - 1
+}
+
+// newLabel returns a fresh label of the current function. Labels start
+// with a dot, so NASM scopes them to the function and two functions may
+// use the same numbers.
+func (t *IrTranslator) newLabel() string {
+	irFunc := t.current()
+	irFunc.condition++
+	return ".L" + strconv.Itoa(irFunc.condition - 1)
+}
+
+// translateBoolean gives a condition the value 1 if it holds and 0
+// otherwise. The condition is translated with branches as in an if
+// statement, so && and || still short-circuit.
+func (t *IrTranslator) translateBoolean(expression ast.Expression) int {
+	result := t.newTemp()
+	label := t.newLabel()
+	t.translateCondition(expression, label, label + "_true", label + "_false")
+	t.emit(ir.Label(label + "_true"))
+	t.emit(ir.CalcInst{Operation: ir.MOV, Operand1: ir.Temp(result), Operand2: ir.Imm(1)})
+	t.emit(ir.JumpInst{JC: ir.MP, Addr: label + "_end"})
+	t.emit(ir.Label(label + "_false"))
+	t.emit(ir.CalcInst{Operation: ir.MOV, Operand1: ir.Temp(result), Operand2: ir.Imm(0)})
+	t.emit(ir.Label(label + "_end"))
+	return result
+}
+
+// loadFrom reads the qword at the address held by temp addr
+func (t *IrTranslator) loadFrom(addr int) int {
+	result := t.newTemp()
+	t.emit(ir.LoadInst{Dest: ir.Temp(result), Addr: ir.Temp(addr)})
+	return result
+}
+
+// storeTo writes temp value to the address held by temp addr plus offset
+func (t *IrTranslator) storeTo(addr int, offset int, value int) {
+	t.emit(ir.StoreInst{Addr: ir.Temp(addr), Offset: offset, Value: ir.Temp(value)})
+}
+
+// scale multiplies temp index by size in place, turning an element
+// count into a byte offset
+func (t *IrTranslator) scale(index int, size int) {
+	if size == 1 {
+		return
+	}
+	factor := t.newTemp()
+	t.emit(ir.CalcInst{Operation: ir.MOV, Operand1: ir.Temp(factor), Operand2: ir.Imm(size)})
+	t.emit(ir.CalcInst{Operation: ir.MUL, Operand1: ir.Temp(index), Operand2: ir.Temp(factor)})
+}
+
+// translateAddress computes the address of an lvalue into a temp.
+//   x       -> lea x
+//   e[i]    -> value of e + i * (size of an element of e)
+//   *e      -> value of e
+// Arrays decay to the address of their first element, so a[i][j] and
+// p[i][j] are handled the same way.
+func (t *IrTranslator) translateAddress(expression ast.Expression) (int, bool) {
+	switch exp := expression.(type) {
+	case *ast.Identifier:
+		result := t.newTemp()
+		t.emit(ir.CalcInst{
+			Operation: ir.LEA,
+			Operand1: ir.Temp(result),
+			Operand2: t.variable(exp),
+		})
+		return result, true
+	case *ast.IndexExpression:
+		base := t.translateExpression(exp.Left)
+		index := t.translateExpression(exp.Index)
+		t.scale(index, t.info.TypeOf(exp).Size())
+		t.emit(ir.CalcInst{Operation: ir.ADD, Operand1: ir.Temp(base), Operand2: ir.Temp(index)})
+		return base, true
+	case *ast.PrefixExpression:
+		if exp.Operator.Type == token.ASTERISK {
+			return t.translateExpression(exp.Right), true
+		}
+	}
+	t.diags.Errorf(diag.UnsupportedExpression, expression.Span(),
+		"cannot take the address of `%s`", expression.String())
+	return t.newTemp(), false
+}
+
+// storeArrayLiteral writes the elements of al into the array of shape
+// dims at the address in temp addr; missing elements become 0
+func (t *IrTranslator) storeArrayLiteral(al *ast.ArrayLiteral, dims []int, addr int, offset int) {
+	if len(al.Elements) > dims[0] {
+		t.diags.Errorf(diag.ArrayInitializerTooLong, al.Span(),
+			"too many initializers: array has %d elements", dims[0])
+		return
+	}
+	stride := 8
+	for _, v := range dims[1:] {
+		stride *= v
+	}
+	for k := 0; k < dims[0]; k++ {
+		var element ast.Expression
+		if k < len(al.Elements) {
+			element = al.Elements[k]
+		}
+		inner, isArray := element.(*ast.ArrayLiteral)
+		if len(dims) > 1 && isArray {
+			t.storeArrayLiteral(inner, dims[1:], addr, offset + k * stride)
+		} else if len(dims) > 1 && element == nil {
+			zero := t.newTemp()
+			t.emit(ir.CalcInst{Operation: ir.MOV, Operand1: ir.Temp(zero), Operand2: ir.Imm(0)})
+			for i := 0; i < stride; i += 8 {
+				t.storeTo(addr, offset + k * stride + i, zero)
+			}
+		} else if len(dims) > 1 || isArray {
+			t.diags.Errorf(diag.ArrayInitializerShape, element.Span(),
+				"initializer does not match the array dimensions")
+		} else if element == nil {
+			zero := t.newTemp()
+			t.emit(ir.CalcInst{Operation: ir.MOV, Operand1: ir.Temp(zero), Operand2: ir.Imm(0)})
+			t.storeTo(addr, offset + k * stride, zero)
+		} else {
+			t.storeTo(addr, offset + k * stride, t.translateExpression(element))
+		}
+	}
+}
+
+// integer_arguments are the registers of the first six arguments in the
+// System V AMD64 calling convention; the rest are passed on the stack
+var integer_arguments = []ir.PhysReg{"rdi", "rsi", "rdx", "rcx", "r8", "r9"}
+
+// incomingArgument returns the operand of parameter k (from 0) of the
+// current function. Stack arguments sit above the saved rbp and the
+// return address, the 7th at [rbp + 16].
+func incomingArgument(k int) ir.Operand {
+	if k < len(integer_arguments) {
+		return integer_arguments[k]
+	}
+	return ir.Mem{
+		Base: ir.PhysReg("rbp"),
+		Offset: 16 + (k - len(integer_arguments)) * 8,
+	}
+}
+
 func (t *IrTranslator) translateFunction(fl *ast.FunctionLiteral) {
-	integer_arguments := []string{"rdi", "rsi", "rdx", "rcx", "r8", "r9"}
-	irFuncTemp := newIrFunc(fl.Name.String())
+	irFuncTemp := newIrFunc(fl.Name.String(), fl.Name.Span())
 	t.irFunctionList = append(t.irFunctionList, irFuncTemp)
 	for k, v := range fl.Param {
-		varName := v.IdentifierLiteral.String()
-		t.irFunctionList[len(t.irFunctionList) - 1].variableMap[varName] = 1
-		varNameNew := varName + strconv.Itoa(
-			t.irFunctionList[len(t.irFunctionList) - 1].variableMap[varName])
-		t.irFunctionList[len(t.irFunctionList) - 1].addressMap[varNameNew] = 
-			len(t.irFunctionList[len(t.irFunctionList) - 1].addressMap)
+		varNameNew := t.local(v.IdentifierLiteral)
+		t.current().allocate(varNameNew, 1)
 		ir_temp := ir.CalcInst{
 			Operation: ir.MOV,
 			Operand1: varNameNew, // 左值
-			Operand2: integer_arguments[k],
+			Operand2: incomingArgument(k),
 		}
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ir_temp)
+		t.emit(ir_temp)
 	}
 	t.translateStatementBlock(fl.Body)
-	for _, v := range fl.Param {
-		varName := v.IdentifierLiteral.String()
-		t.irFunctionList[len(t.irFunctionList) - 1].variableMap[varName] = 0
+	// falling off the end of a function returns 0, as main does in C
+	irList := t.current().irList
+	returned := false
+	if len(irList) > 0 {
+		_, returned = irList[len(irList) - 1].(ir.Ret)
+	}
+	if !returned {
+		t.emit(ir.CalcInst{Operation: ir.XOR, Operand1: ir.PhysReg("rax"), Operand2: ir.PhysReg("rax")})
+		t.emit(ir.Ret(""))
 	}
 }
 
 func (t *IrTranslator) translateStatementBlock(bs *ast.BlockStatement) {
-	tempVariable := []string{}
 	for _, v := range bs.Statements {
-		temp := t.translateStatement(v)
-		if temp != "" {
-			tempVariable = append(tempVariable, temp)
-		}
-	}
-	for _, v := range tempVariable {
-		t.irFunctionList[len(t.irFunctionList) - 1].variableMap[v]--
+		t.translateStatement(v)
 	}
 }
 
-func (t *IrTranslator) translateStatement(statement ast.Statement) string {
+func (t *IrTranslator) translateStatement(statement ast.Statement) {
 	if stmt, ok := statement.(*ast.VarAssign); ok {
 		if id, ok := stmt.Left.(*ast.Identifier); ok {
 			// a = 1;
 			// new statement, temp register reset
-			t.irFunctionList[len(t.irFunctionList) - 1].tempRegister = 0
-			index_temp := t.irFunctionList[len(t.irFunctionList) - 1].
-				variableMap[id.Value.Literal]
+			t.current().tempRegister = 0
 			// e.g. x2
-			op1_temp := id.Value.Literal + strconv.Itoa(index_temp)
+			op1_temp := t.variable(id)
 			ir_temp := ir.CalcInst{
 				Operation: ir.MOV,
 				Operand1: op1_temp, // 左值
-				Operand2: t.translateExpression(stmt.Right),
+				Operand2: ir.Temp(t.translateExpression(stmt.Right)),
 			}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ir_temp)
-		} else if id, ok := stmt.Left.(*ast.PrefixExpression); ok {
-			if id.Operator.Type == token.ASTERISK {
-				// *x = 1;
-				// new statement, temp register reset
-				t.irFunctionList[len(t.irFunctionList) - 1].tempRegister = 0
-				vv, _ := id.Right.(*ast.Identifier)
-				index_temp := t.irFunctionList[len(t.irFunctionList) - 1].
-					variableMap[vv.Value.Literal]
-				variable := vv.Value.Literal + strconv.Itoa(index_temp)
-				ir_temp := ir.CalcInst{
-					Operation: ir.MOV,
-					Operand1: "r8",
-					Operand2: variable,
-				}
-				t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-					append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-					ir_temp)
-				ir_temp = ir.CalcInst{
-					Operation: ir.MOV,
-					Operand1: "[r8]",
-					Operand2: t.translateExpression(stmt.Right),
-				}
-				t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-					append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-					ir_temp)
+			t.emit(ir_temp)
+		} else {
+			// a[i][j] = 1; *p = 1; *(p + 1) = 1; **pp = 1;
+			t.current().tempRegister = 0
+			addr, ok := t.translateAddress(stmt.Left)
+			if ok {
+				value := t.translateExpression(stmt.Right)
+				t.storeTo(addr, 0, value)
 			}
 		}
-		
 	} else if stmt, ok := statement.(*ast.VarDef); ok {
 		// int a = 1;
 		// new statement, temp register reset
-		t.irFunctionList[len(t.irFunctionList) - 1].tempRegister = 0
-		varName := stmt.Name.Value.Literal
-		// 判断该变量是否曾经出现过，如果出现则掩盖
-		// int x = 1;
+		t.current().tempRegister = 0
+		// sema 给每个声明一个唯一的名字，被掩盖的变量不会冲突
+		// int x = 1;       x.1
 		// if (...) {
-		//	  int x = 0;
+		//	  int x = 0;    x.2
 		// }
-		if _, ok := t.irFunctionList[len(t.irFunctionList) - 1].variableMap[varName]; ok {
-			t.irFunctionList[len(t.irFunctionList) - 1].variableMap[varName]++
-		} else {
-			t.irFunctionList[len(t.irFunctionList) - 1].variableMap[varName] = 1
+		varNameNew := t.local(stmt.Name)
+		t.current().allocate(varNameNew, 1)
+		if stmt.Value != nil {
+			ir_temp := ir.CalcInst{
+				Operation: ir.MOV,
+				Operand1: varNameNew, // 左值
+				Operand2: ir.Temp(t.translateExpression(stmt.Value)),
+			}
+			t.emit(ir_temp)
 		}
-		// varName: x
-		// varName: x2
-		varNameNew := varName + strconv.Itoa(
-			t.irFunctionList[len(t.irFunctionList) - 1].variableMap[varName])
-		ir_temp := ir.CalcInst{
-			Operation: ir.MOV,
-			Operand1: varNameNew, // 左值
-			Operand2: t.translateExpression(stmt.Value),
+	} else if stmt, ok := statement.(*ast.ArrayDef); ok {
+		// int a[2][3] = {{1, 2, 3}, {4, 5, 6}};
+		// 数组按行连续存放在 size 个 slot 中
+		t.current().tempRegister = 0
+		varNameNew := t.local(stmt.Name)
+		size := 1
+		for _, v := range stmt.Dims {
+			size *= v
+		}
+		t.current().allocate(varNameNew, size)
+		if stmt.Value != nil && size > 0 {
+			addr := t.newTemp()
+			t.emit(ir.CalcInst{Operation: ir.LEA, Operand1: ir.Temp(addr), Operand2: varNameNew})
+			t.storeArrayLiteral(stmt.Value, stmt.Dims, addr, 0)
 		}
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ir_temp)
-		// 查看该变量是否出现过
-		// if (...) {
-		// 	int x = 1;
-		// }
-		// else {
-		// 	int x = 2;
-		// }
-		// 则if else中的x可以存在一个地址
-		_, ok := t.irFunctionList[len(t.irFunctionList) - 1].addressMap[varNameNew]
-		if !ok {
-			// 如果变量未曾出现，需要另外分配
-			t.irFunctionList[len(t.irFunctionList) - 1].addressMap[varNameNew] = 
-				len(t.irFunctionList[len(t.irFunctionList) - 1].addressMap)
-		}
-		return varName
 	} else if stmt, ok := statement.(*ast.IfStatement); ok {
 		// new statement, temp register reset
-		t.irFunctionList[len(t.irFunctionList) - 1].tempRegister = 0
+		t.current().tempRegister = 0
 		// condition block (cmp, jC, jmp)
 		// if: 
 		// ...
@@ -209,38 +459,26 @@ func (t *IrTranslator) translateStatement(statement ast.Statement) string {
 		// ...
 		
 		// translate condition
-		condition_temp := "label" + 
-			strconv.Itoa(t.irFunctionList[len(t.irFunctionList) - 1].condition)
+		condition_temp := t.newLabel()
 		t.translateCondition(stmt.Condition, condition_temp, 
 			condition_temp + "_if", condition_temp + "_else")
-		t.irFunctionList[len(t.irFunctionList) - 1].condition++
 		// translate if statement block
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ir.Label(condition_temp + "_if"))
+		t.emit(ir.Label(condition_temp + "_if"))
 		t.translateStatementBlock(stmt.Consequence)
 		ji1 := ir.JumpInst{JC: ir.MP, Addr: condition_temp + "_end"}
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ji1)
+		t.emit(ji1)
 		// translate else statement block
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ir.Label(condition_temp + "_else"))
+		t.emit(ir.Label(condition_temp + "_else"))
 		if stmt.Alternative != nil {
 			t.translateStatementBlock(stmt.Alternative)
 		}
 		ji2 := ir.JumpInst{JC: ir.MP, Addr: condition_temp + "_end"}
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ji2)
+		t.emit(ji2)
 		// add end flag
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ir.Label(condition_temp + "_end"))
+		t.emit(ir.Label(condition_temp + "_end"))
 	} else if stmt, ok := statement.(*ast.WhileStatement); ok {
 		// new statement, temp register reset
-		t.irFunctionList[len(t.irFunctionList) - 1].tempRegister = 0
+		t.current().tempRegister = 0
 		// condition:
 		// condition block (cmp, jC, jmp)
 		// while: 
@@ -248,338 +486,199 @@ func (t *IrTranslator) translateStatement(statement ast.Statement) string {
 		// jmp condition
 		// end:
 		
-		condition_temp := "label" + 
-			strconv.Itoa(t.irFunctionList[len(t.irFunctionList) - 1].condition)
-		t.irFunctionList[len(t.irFunctionList) - 1].condition++
+		condition_temp := t.newLabel()
 		// before judging the condition
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ir.Label(condition_temp + "_condition"))
+		t.emit(ir.Label(condition_temp + "_condition"))
 		// translate condition
 		t.translateCondition(stmt.Condition, condition_temp, 
 			condition_temp + "_while", condition_temp + "_end")
 		// translate statement block
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ir.Label(condition_temp + "_while"))
+		t.emit(ir.Label(condition_temp + "_while"))
 		t.translateStatementBlock(stmt.Consequence)
 		ji1 := ir.JumpInst{JC: ir.MP, Addr: condition_temp + "_condition"}
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ji1)
+		t.emit(ji1)
 		// add end flag
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ir.Label(condition_temp + "_end"))
+		t.emit(ir.Label(condition_temp + "_end"))
 	} else if stmt, ok := statement.(*ast.ReturnStatement); ok {
 		// new statement, temp register reset
-		t.irFunctionList[len(t.irFunctionList) - 1].tempRegister = 0
+		t.current().tempRegister = 0
 		if stmt.ReturnValue == nil {
 			ir_temp := ir.CalcInst{
 				Operation: ir.XOR,
-				Operand1: "rax",
-				Operand2: "rax",
+				Operand1: ir.PhysReg("rax"),
+				Operand2: ir.PhysReg("rax"),
 			}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ir_temp)
+			t.emit(ir_temp)
 		} else {
 			reg1 := t.translateExpression(stmt.ReturnValue)
 			ir_temp := ir.CalcInst{
 				Operation: ir.MOV,
-				Operand1: "rax",
-				Operand2: reg1,
+				Operand1: ir.PhysReg("rax"),
+				Operand2: ir.Temp(reg1),
 			}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ir_temp)
+			t.emit(ir_temp)
 		}
 		ir_temp := ir.Ret("")
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ir_temp)
+		t.emit(ir_temp)
 	} else if stmt, ok := statement.(*ast.CallStatement); ok {
 		t.translateExpression(stmt.Value)
+	} else {
+		t.diags.Errorf(diag.UnsupportedStatement, statement.Span(),
+			"statement is not supported by the translator")
 	}
-	return ""
 }
 
 func (t *IrTranslator) translateCondition(expression ast.Expression,
 										  curNode string,
 										  trueNode string, 
 										  falseNode string) {
-	t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-		append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-		ir.Label(curNode))
+	t.emit(ir.Label(curNode))
 	if exp, ok := expression.(*ast.InfixExpression); ok {
-		// label := ir.Label(curNode)
-		// t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-		// 	append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-		// 	label)
 		infix_temp := exp.Operator.Type
 		switch infix_temp {
 		case token.LT: 
 			reg1 := t.translateExpression(exp.Left)
 			reg2 := t.translateExpression(exp.Right)
-			ci := ir.CmpInst{Left: reg1, Right: reg2}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ci)
+			ci := ir.CmpInst{Left: ir.Temp(reg1), Right: ir.Temp(reg2)}
+			t.emit(ci)
 			ji1 := ir.JumpInst{JC: ir.L, Addr: trueNode}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ji1)
+			t.emit(ji1)
 			ji2 := ir.JumpInst{JC: ir.MP, Addr: falseNode}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ji2)
+			t.emit(ji2)
 		case token.GT:
 			reg1 := t.translateExpression(exp.Left)
 			reg2 := t.translateExpression(exp.Right)
-			ci := ir.CmpInst{Left: reg1, Right: reg2}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ci)
+			ci := ir.CmpInst{Left: ir.Temp(reg1), Right: ir.Temp(reg2)}
+			t.emit(ci)
 			ji1 := ir.JumpInst{JC: ir.G, Addr: trueNode}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ji1)
+			t.emit(ji1)
 			ji2 := ir.JumpInst{JC: ir.MP, Addr: falseNode}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ji2)
+			t.emit(ji2)
 		case token.L_EQ:
 			reg1 := t.translateExpression(exp.Left)
 			reg2 := t.translateExpression(exp.Right)
-			ci := ir.CmpInst{Left: reg1, Right: reg2}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ci)
+			ci := ir.CmpInst{Left: ir.Temp(reg1), Right: ir.Temp(reg2)}
+			t.emit(ci)
 			ji1 := ir.JumpInst{JC: ir.LE, Addr: trueNode}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ji1)
+			t.emit(ji1)
 			ji2 := ir.JumpInst{JC: ir.MP, Addr: falseNode}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ji2)
+			t.emit(ji2)
 		case token.G_EQ:
 			reg1 := t.translateExpression(exp.Left)
 			reg2 := t.translateExpression(exp.Right)
-			ci := ir.CmpInst{Left: reg1, Right: reg2}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ci)
+			ci := ir.CmpInst{Left: ir.Temp(reg1), Right: ir.Temp(reg2)}
+			t.emit(ci)
 			ji1 := ir.JumpInst{JC: ir.GE, Addr: trueNode}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ji1)
+			t.emit(ji1)
 			ji2 := ir.JumpInst{JC: ir.MP, Addr: falseNode}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ji2)
+			t.emit(ji2)
 		case token.EQ:
 			reg1 := t.translateExpression(exp.Left)
 			reg2 := t.translateExpression(exp.Right)
-			ci := ir.CmpInst{Left: reg1, Right: reg2}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ci)
+			ci := ir.CmpInst{Left: ir.Temp(reg1), Right: ir.Temp(reg2)}
+			t.emit(ci)
 			ji1 := ir.JumpInst{JC: ir.E, Addr: trueNode}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ji1)
+			t.emit(ji1)
 			ji2 := ir.JumpInst{JC: ir.MP, Addr: falseNode}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ji2)
+			t.emit(ji2)
 		case token.NOT_EQ:
 			reg1 := t.translateExpression(exp.Left)
 			reg2 := t.translateExpression(exp.Right)
-			ci := ir.CmpInst{Left: reg1, Right: reg2}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ci)
+			ci := ir.CmpInst{Left: ir.Temp(reg1), Right: ir.Temp(reg2)}
+			t.emit(ci)
 			ji1 := ir.JumpInst{JC: ir.NE, Addr: trueNode}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ji1)
+			t.emit(ji1)
 			ji2 := ir.JumpInst{JC: ir.MP, Addr: falseNode}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ji2)
+			t.emit(ji2)
 		case token.AND: 
-			leftNode := curNode + "0"
-			rightNode := curNode + "1"
+			leftNode := curNode + "_l"
+			rightNode := curNode + "_r"
 			t.translateCondition(exp.Left, leftNode, rightNode, falseNode)
 			t.translateCondition(exp.Right, rightNode, trueNode, falseNode)
 		case token.OR:
-			leftNode := curNode + "0"
-			rightNode := curNode + "1"
+			leftNode := curNode + "_l"
+			rightNode := curNode + "_r"
 			t.translateCondition(exp.Left, leftNode, trueNode, rightNode)
 			t.translateCondition(exp.Right, rightNode, trueNode, falseNode)
 		default:
 			reg1 := t.translateExpression(exp)
-			ir_temp := ir.CalcInst{
-				Operation: ir.MOV, 
-				Operand1: t.irFunctionList[len(t.irFunctionList) - 1].tempRegister, 
-				Operand2: "0",
-			}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ir_temp)
-			t.irFunctionList[len(t.irFunctionList) - 1].tempRegister++ 
-			// 更新maxRegister
-			if (t.irFunctionList[len(t.irFunctionList) - 1].tempRegister > 
-				t.irFunctionList[len(t.irFunctionList) - 1].maxRegister) {
-				t.irFunctionList[len(t.irFunctionList) - 1].maxRegister = 
-				t.irFunctionList[len(t.irFunctionList) - 1].tempRegister
-			}
+			temp := t.newTemp()
+			t.emit(ir.CalcInst{Operation: ir.MOV, Operand1: ir.Temp(temp), Operand2: ir.Imm(0)})
 			ci := ir.CmpInst{
-				Left: reg1, 
-				Right: t.irFunctionList[len(t.irFunctionList) - 1].tempRegister - 1,
+				Left: ir.Temp(reg1), 
+				Right: ir.Temp(temp),
 			}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ci)
+			t.emit(ci)
 			ji1 := ir.JumpInst{JC: ir.NE, Addr: trueNode}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ji1)
+			t.emit(ji1)
 			ji2 := ir.JumpInst{JC: ir.MP, Addr: falseNode}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ji2)
+			t.emit(ji2)
 		}
 	} else if exp, ok := expression.(*ast.PrefixExpression); ok {
 		if exp.Operator.Type == token.BANG {
-			t.translateCondition(exp.Right, curNode, falseNode, trueNode)
+			// curNode is already placed, the operand needs a label of its own
+			t.translateCondition(exp.Right, curNode + "_n", falseNode, trueNode)
 		} else {
 			reg1 := t.translateExpression(exp.Right)
-			ir_temp := ir.CalcInst{
-				Operation: ir.MOV, 
-				Operand1: t.irFunctionList[len(t.irFunctionList) - 1].tempRegister, 
-				Operand2: "0",
-			}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ir_temp)
-			t.irFunctionList[len(t.irFunctionList) - 1].tempRegister++
-			// 更新maxRegister
-			if (t.irFunctionList[len(t.irFunctionList) - 1].tempRegister > 
-				t.irFunctionList[len(t.irFunctionList) - 1].maxRegister) {
-				t.irFunctionList[len(t.irFunctionList) - 1].maxRegister = 
-				t.irFunctionList[len(t.irFunctionList) - 1].tempRegister
-			} 
+			temp := t.newTemp()
+			t.emit(ir.CalcInst{Operation: ir.MOV, Operand1: ir.Temp(temp), Operand2: ir.Imm(0)})
 			ci := ir.CmpInst{
-				Left: reg1, 
-				Right: t.irFunctionList[len(t.irFunctionList) - 1].tempRegister - 1,
+				Left: ir.Temp(reg1), 
+				Right: ir.Temp(temp),
 			}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ci)
+			t.emit(ci)
 			ji1 := ir.JumpInst{JC: ir.NE, Addr: trueNode}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ji1)
+			t.emit(ji1)
 			ji2 := ir.JumpInst{JC: ir.MP, Addr: falseNode}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ji2)
+			t.emit(ji2)
 		}
 	} else {
 		// like x, 1
 		reg1 := t.translateExpression(expression)
-		ir_temp := ir.CalcInst{
-			Operation: ir.MOV, 
-			Operand1: t.irFunctionList[len(t.irFunctionList) - 1].tempRegister, 
-			Operand2: "0",
-		}
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ir_temp)
-		t.irFunctionList[len(t.irFunctionList) - 1].tempRegister++
-		// 更新maxRegister
-		if (t.irFunctionList[len(t.irFunctionList) - 1].tempRegister > 
-			t.irFunctionList[len(t.irFunctionList) - 1].maxRegister) {
-			t.irFunctionList[len(t.irFunctionList) - 1].maxRegister = 
-			t.irFunctionList[len(t.irFunctionList) - 1].tempRegister
-		} 
+		temp := t.newTemp()
+		t.emit(ir.CalcInst{Operation: ir.MOV, Operand1: ir.Temp(temp), Operand2: ir.Imm(0)})
 		ci := ir.CmpInst{
-			Left: reg1, 
-			Right: t.irFunctionList[len(t.irFunctionList) - 1].tempRegister - 1,
+			Left: ir.Temp(reg1), 
+			Right: ir.Temp(temp),
 		}
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ci)
+		t.emit(ci)
 		ji1 := ir.JumpInst{JC: ir.NE, Addr: trueNode}
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ji1)
+		t.emit(ji1)
 		ji2 := ir.JumpInst{JC: ir.MP, Addr: falseNode}
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ji2)
+		t.emit(ji2)
 	}
 }
 
 func (t *IrTranslator) translateExpression(expression ast.Expression) int {
 	if exp, ok := expression.(*ast.IntegerLiteral); ok {
 		// int字面量，1
-		ir_temp := ir.CalcInst{
-			Operation: ir.MOV, 
-			Operand1: t.irFunctionList[len(t.irFunctionList) - 1].tempRegister, 
-			Operand2: exp.Value.Literal,
-		}
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ir_temp)
-		t.irFunctionList[len(t.irFunctionList) - 1].tempRegister++
-		// 更新maxRegister
-		if (t.irFunctionList[len(t.irFunctionList) - 1].tempRegister > 
-			t.irFunctionList[len(t.irFunctionList) - 1].maxRegister) {
-			t.irFunctionList[len(t.irFunctionList) - 1].maxRegister = 
-			t.irFunctionList[len(t.irFunctionList) - 1].tempRegister
-		}	 
-		return t.irFunctionList[len(t.irFunctionList) - 1].tempRegister - 1
+		value, _ := sema.Constant(exp)
+		temp := t.newTemp()
+		t.emit(ir.CalcInst{Operation: ir.MOV, Operand1: ir.Temp(temp), Operand2: ir.Imm(value)})
+		return temp
 	} else if exp, ok := expression.(*ast.StringLiteral); ok {
 		// string字面量
-		t.string_list = append(t.string_list, exp.Value.Literal)
-		ir_temp := ir.CalcInst{
-			Operation: ir.MOV, 
-			Operand1: t.irFunctionList[len(t.irFunctionList) - 1].tempRegister, 
-			Operand2: "str" + strconv.Itoa(len(t.string_list)),
-		}
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ir_temp)
-		t.irFunctionList[len(t.irFunctionList) - 1].tempRegister++
-		// 更新maxRegister
-		if (t.irFunctionList[len(t.irFunctionList) - 1].tempRegister > 
-			t.irFunctionList[len(t.irFunctionList) - 1].maxRegister) {
-			t.irFunctionList[len(t.irFunctionList) - 1].maxRegister = 
-			t.irFunctionList[len(t.irFunctionList) - 1].tempRegister
-		}	 
-		return t.irFunctionList[len(t.irFunctionList) - 1].tempRegister - 1
+		temp := t.newTemp()
+		t.emit(ir.CalcInst{Operation: ir.MOV, Operand1: ir.Temp(temp), Operand2: ir.Global(t.addString(exp.Value.Literal))})
+		return temp
+	} else if exp, ok := expression.(*ast.Identifier); ok && 
+			  t.info.TypeOf(exp).Kind == types.Array {
+		// an array is used as a pointer to its first element
+		addr, _ := t.translateAddress(exp)
+		return addr
+	} else if exp, ok := expression.(*ast.IndexExpression); ok {
+		// a[i][j], p[i]
+		addr, ok := t.translateAddress(exp)
+		if !ok || t.info.TypeOf(exp).Kind == types.Array {
+			// a[i] of a two dimensional array is the address of row i
+			return addr
+		}
+		return t.loadFrom(addr)
 	} else if exp, ok := expression.(*ast.Identifier); ok {
 		// x
-		ir_temp := ir.CalcInst{
-			Operation: ir.MOV,
-			Operand1: t.irFunctionList[len(t.irFunctionList) - 1].tempRegister,
-			Operand2: exp.Value.Literal + 
-				strconv.Itoa(t.irFunctionList[len(t.irFunctionList) - 1].
-				variableMap[exp.Value.Literal]),
-		}
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, ir_temp)
-		t.irFunctionList[len(t.irFunctionList) - 1].tempRegister++
-		// 更新maxRegister
-		if (t.irFunctionList[len(t.irFunctionList) - 1].tempRegister > 
-			t.irFunctionList[len(t.irFunctionList) - 1].maxRegister) {
-			t.irFunctionList[len(t.irFunctionList) - 1].maxRegister = 
-			t.irFunctionList[len(t.irFunctionList) - 1].tempRegister
-		}
-		return t.irFunctionList[len(t.irFunctionList) - 1].tempRegister - 1
+		temp := t.newTemp()
+		t.emit(ir.CalcInst{Operation: ir.MOV, Operand1: ir.Temp(temp), Operand2: t.variable(exp)})
+		return temp
 	} else if exp, ok := expression.(*ast.InfixExpression); ok {
 		// 1 + 2
 		var infix_temp ir.Op
@@ -592,164 +691,134 @@ func (t *IrTranslator) translateExpression(expression ast.Expression) int {
 			infix_temp = ir.MUL 
 		case token.SLASH: 
 			infix_temp = ir.DIV
+		case token.PERCENT:
+			infix_temp = ir.MOD
+		case token.LT, token.GT, token.L_EQ, token.G_EQ, token.EQ, token.NOT_EQ,
+			 token.AND, token.OR:
+			// x < y, a && b
+			return t.translateBoolean(exp)
 		default:
+			t.diags.Errorf(diag.UnsupportedOperator, exp.Operator.Span,
+				"operator `%s` cannot be used as a value", exp.Operator.Literal)
+			return t.newTemp()
 		}
 		o1 := t.translateExpression(exp.Left)
 		o2 := t.translateExpression(exp.Right)
+		// pointer arithmetic counts in elements: p + 1 is the next element
+		left := t.info.TypeOf(exp.Left).Decay()
+		right := t.info.TypeOf(exp.Right).Decay()
+		if left.Kind == types.Pointer && right.Kind == types.Int {
+			t.scale(o2, left.Elem.Size())
+		} else if left.Kind == types.Int && right.Kind == types.Pointer {
+			t.scale(o1, right.Elem.Size())
+		}
 		ir_temp := ir.CalcInst{
 			Operation: infix_temp, 
-			Operand1: o1,
-			Operand2: o2,
+			Operand1: ir.Temp(o1),
+			Operand2: ir.Temp(o2),
+		}
+		t.emit(ir_temp)
+		if left.Kind == types.Pointer && right.Kind == types.Pointer {
+			// p - q is the number of elements between them
+			size := t.newTemp()
+			t.emit(ir.CalcInst{Operation: ir.MOV, Operand1: ir.Temp(size), 
+				Operand2: ir.Imm(left.Elem.Size())})
+			t.emit(ir.CalcInst{Operation: ir.DIV, Operand1: ir.Temp(o1), Operand2: ir.Temp(size)})
 		}
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ir_temp)
 		return o1
 	} else if exp, ok := expression.(*ast.PrefixExpression); ok {
-		if exp.Operator.Type == token.MINUS {
+		if exp.Operator.Type == token.BANG {
+			// !x
+			return t.translateBoolean(exp)
+		} else if exp.Operator.Type == token.MINUS {
 			// -1
 			o1 := t.translateExpression(exp.Right)
 			ir_temp := ir.OneInst{
 				Operation: ir.NEG, 
-				Operand1: o1,
+				Operand1: ir.Temp(o1),
 			}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ir_temp)
+			t.emit(ir_temp)
 			return o1
 		} else if exp.Operator.Type == token.ET {
-			// &x or &x[0]
-			if er, ok := exp.Right.(*ast.Identifier); ok {
-				// &x
-				ir_temp := ir.CalcInst{
-					Operation: ir.LEA,
-					Operand1: t.irFunctionList[len(t.irFunctionList) - 1].tempRegister,
-					Operand2: er.Value.Literal + 
-						strconv.Itoa(t.irFunctionList[len(t.irFunctionList) - 1].
-						variableMap[er.Value.Literal]),
-				}
-				t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-					append(t.irFunctionList[len(t.irFunctionList) - 1].irList, ir_temp)
-				t.irFunctionList[len(t.irFunctionList) - 1].tempRegister++
-				// 更新maxRegister
-				if (t.irFunctionList[len(t.irFunctionList) - 1].tempRegister > 
-					t.irFunctionList[len(t.irFunctionList) - 1].maxRegister) {
-					t.irFunctionList[len(t.irFunctionList) - 1].maxRegister = 
-					t.irFunctionList[len(t.irFunctionList) - 1].tempRegister
-				}
-				return t.irFunctionList[len(t.irFunctionList) - 1].tempRegister - 1
-			}
+			// &x, &a[i], &*p
+			addr, _ := t.translateAddress(exp.Right)
+			return addr
 		} else if exp.Operator.Type == token.ASTERISK {
-			// *x
-			if er, ok := exp.Right.(*ast.Identifier); ok {
-				// &x
-				// 首先将地址mov到r9
-				ir_temp := ir.CalcInst{
-					Operation: ir.MOV,
-					Operand1: "r9",
-					Operand2: er.Value.Literal + 
-						strconv.Itoa(t.irFunctionList[len(t.irFunctionList) - 1].
-						variableMap[er.Value.Literal]),
-				}
-				t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-					append(t.irFunctionList[len(t.irFunctionList) - 1].irList, ir_temp)
-				// 将[r9]移动到temp register
-				ir_temp = ir.CalcInst{
-					Operation: ir.MOV,
-					Operand1: t.irFunctionList[len(t.irFunctionList) - 1].tempRegister,
-					Operand2: "[r9]",
-				}
-				t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-					append(t.irFunctionList[len(t.irFunctionList) - 1].irList, ir_temp)
-				t.irFunctionList[len(t.irFunctionList) - 1].tempRegister++
-				// 更新maxRegister
-				if (t.irFunctionList[len(t.irFunctionList) - 1].tempRegister > 
-					t.irFunctionList[len(t.irFunctionList) - 1].maxRegister) {
-					t.irFunctionList[len(t.irFunctionList) - 1].maxRegister = 
-					t.irFunctionList[len(t.irFunctionList) - 1].tempRegister
-				}
-				return t.irFunctionList[len(t.irFunctionList) - 1].tempRegister - 1
+			// *p, **pp, *(p + 1)
+			addr, ok := t.translateAddress(exp)
+			if !ok || t.info.TypeOf(exp).Kind == types.Array {
+				return addr
 			}
+			return t.loadFrom(addr)
 		}
 	} else if exp, ok := expression.(*ast.CallExpression); ok {
-		integer_arguments := []string{"rdi", "rsi", "rdx", "rcx", "r8", "r9"}
 		reg_list := []int{}
 		// prepare for the input arguments
-		// 最多有6个arguments
+		// 前6个放在寄存器里，其余的压栈
 		for _, v := range(exp.Params) {
 			reg := t.translateExpression(v)
 			reg_list = append(reg_list, reg)
 		}
+		stack_list := []int{}
+		if len(reg_list) > len(integer_arguments) {
+			stack_list = reg_list[len(integer_arguments):]
+			reg_list = reg_list[:len(integer_arguments)]
+		}
 		for k, v := range(reg_list) {
 			ir_temp := ir.CalcInst{
 				Operation: ir.MOV, 
 				Operand1: integer_arguments[k], 
-				Operand2: v,
+				Operand2: ir.Temp(v),
 			}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				ir_temp)
+			t.emit(ir_temp)
 		}
 		// reset xor before call func
 		ir_temp := ir.CalcInst{
 			Operation: ir.XOR,
-			Operand1: "rax",
-			Operand2: "rax",
-		}
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ir_temp)
-		// caller saved register
-		// push
-		for _, v := range(integer_arguments) {
-			temp := ir.OneInst{
-				Operation: ir.PUSH, 
-				Operand1: v,
-			}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				temp)
+			Operand1: ir.PhysReg("rax"),
+			Operand2: ir.PhysReg("rax"),
+		}
+		t.emit(ir_temp)
+		// nothing is kept in the caller-saved registers yet; once registers
+		// are allocated the call saves those live across it in the frame
+		// stack arguments are pushed right to left, so the 7th ends up
+		// next to the return address. The stack is 16-byte aligned here
+		// and has to be at the call, so an odd count needs padding.
+		stack_size := len(stack_list) * 8
+		if len(stack_list) % 2 == 1 {
+			stack_size += 8
+			t.emit(ir.CalcInst{Operation: ir.SUB, Operand1: ir.PhysReg("rsp"), Operand2: ir.Imm(8)})
+		}
+		for i := len(stack_list) - 1; i >= 0; i-- {
+			t.emit(ir.OneInst{Operation: ir.PUSH, Operand1: ir.Temp(stack_list[i])})
 		}
 		// call function
 		call_temp := ir.CallInst{
 			FuntionName: exp.Name.String(),
+			Args: len(reg_list),
 		}
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			call_temp)
-		// caller saved register
-		// pop
-		for i := len(integer_arguments) - 1; i >= 0; i-- {
-			temp := ir.OneInst{
-				Operation: ir.POP, 
-				Operand1: integer_arguments[i],
-			}
-			t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-				append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-				temp)
+		t.emit(call_temp)
+		if stack_size > 0 {
+			t.emit(ir.CalcInst{Operation: ir.ADD, Operand1: ir.PhysReg("rsp"), 
+				Operand2: ir.Imm(stack_size)})
 		}
 		// move return value from rax to a temp register
-		ir_temp = ir.CalcInst{
-			Operation: ir.MOV, 
-			Operand1: t.irFunctionList[len(t.irFunctionList) - 1].tempRegister, 
-			Operand2: "rax",
-		}
-		t.irFunctionList[len(t.irFunctionList) - 1].irList = 
-			append(t.irFunctionList[len(t.irFunctionList) - 1].irList, 
-			ir_temp)
-		t.irFunctionList[len(t.irFunctionList) - 1].tempRegister++
-		// 更新maxRegister
-		if (t.irFunctionList[len(t.irFunctionList) - 1].tempRegister > 
-			t.irFunctionList[len(t.irFunctionList) - 1].maxRegister) {
-			t.irFunctionList[len(t.irFunctionList) - 1].maxRegister = 
-			t.irFunctionList[len(t.irFunctionList) - 1].tempRegister
-		}	 
-		return t.irFunctionList[len(t.irFunctionList) - 1].tempRegister - 1
+		temp := t.newTemp()
+		t.emit(ir.CalcInst{Operation: ir.MOV, Operand1: ir.Temp(temp), Operand2: ir.PhysReg("rax")})
+		return temp
 	}
+	t.diags.Errorf(diag.UnsupportedExpression, expression.Span(),
+		"expression `%s` is not supported by the translator", expression.String())
 	return 0
 }
 
 func (t *IrTranslator) Translate() {
+	// globals first, functions may use globals defined after them
+	for _, value := range t.tree.GlobalList {
+		if _, ok := value.(*ast.FunctionLiteral); !ok {
+			t.translateGlobal(value)
+		}
+	}
 	for _, value := range t.tree.GlobalList {
 		if v, ok := value.(*ast.FunctionLiteral); ok {
 			t.translateFunction(v)
@@ -0,0 +1,95 @@
+package ir_translator
+
+import "cigrid/ir"
+import "cigrid/token"
+import "bytes"
+import "sort"
+import "strconv"
+import "strings"
+
+// NewIrFunction builds a function from already lowered IR, e.g. read back
+// from the textual form by package ir/parse. span is where it is declared,
+// kept through the passes for the diagnostics of the backend.
+func NewIrFunction(name string, span token.Span, irList []ir.IntermediateRepresentation,
+				   addressMap map[string]int, frameSize int, maxRegister int) *IrFunction {
+	return &IrFunction{
+		functionName: name,
+		span: span,
+		irList: irList,
+		maxRegister: maxRegister,
+		addressMap: addressMap,
+		frameSize: frameSize,
+	}
+}
+
+// NewFromIr builds a translator that holds already lowered IR and has no
+// source tree, so it can go straight to the backend
+func NewFromIr(functions []*IrFunction, stringList []string,
+			   globals []*GlobalData) *IrTranslator {
+	return &IrTranslator{
+		irFunctionList: functions,
+		string_list: stringList,
+		global_list: globals,
+	}
+}
+
+// String prints the translated program in the textual IR format that
+// package ir/parse reads back:
+//
+//	string str1 "hi %d\n"
+//	global g_x 1 = 5
+//	function main frame 1 temps 2
+//		var x.1 0
+//		mov temp0 [@g_x]
+//	.L0:
+//		ret
+//	end
+//
+// The output only depends on the IR, so it can be kept in golden files.
+func (t *IrTranslator) String() string {
+	var out bytes.Buffer
+	for k, v := range t.string_list {
+		out.WriteString("string str" + strconv.Itoa(k + 1) + " " + strconv.Quote(v) + "\n")
+	}
+	for _, v := range t.global_list {
+		out.WriteString("global " + v.Name + " " + strconv.Itoa(v.Size))
+		if v.Initialized {
+			out.WriteString(" = " + strings.Join(v.Values, ", "))
+		}
+		out.WriteString("\n")
+	}
+	for _, v := range t.irFunctionList {
+		out.WriteString(v.String())
+	}
+	return out.String()
+}
+
+// String prints one function of the textual IR format, its variables
+// ordered by slot
+func (i *IrFunction) String() string {
+	var out bytes.Buffer
+	out.WriteString("function " + i.functionName +
+		" frame " + strconv.Itoa(i.frameSize) +
+		" temps " + strconv.Itoa(i.maxRegister) + "\n")
+	names := []string{}
+	for k := range i.addressMap {
+		names = append(names, k)
+	}
+	sort.Slice(names, func(a, b int) bool {
+		if i.addressMap[names[a]] != i.addressMap[names[b]] {
+			return i.addressMap[names[a]] < i.addressMap[names[b]]
+		}
+		return names[a] < names[b]
+	})
+	for _, v := range names {
+		out.WriteString("\tvar " + v + " " + strconv.Itoa(i.addressMap[v]) + "\n")
+	}
+	for _, v := range i.irList {
+		if _, ok := v.(ir.Label); !ok {
+			out.WriteString("\t")
+		}
+		out.WriteString(v.IrString() + "\n")
+	}
+	out.WriteString("end\n")
+	return out.String()
+}
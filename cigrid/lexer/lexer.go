@@ -1,24 +1,30 @@
 package lexer
 
 import "cigrid/token"
+import "cigrid/diag"
 
 type Lexer struct {
+	file     string // 源文件名，只用于记录位置
 	input    string
 	position int 
+	line     int // line of ch
+	column   int // column of ch
 	ch       byte
 	peekCh   byte 
+	keep     bool // keep comments as trivia
+	diags    diag.List
 }
 
 func isLetter(ch byte) bool {
-	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || ch == '_'
 }
 
 func isDigit(ch byte) bool {
 	return ch >= '0' && ch <= '9'
 }
 
-func New(input string) *Lexer{
-	l := &Lexer{input: input, position: 0}
+func New(file string, input string) *Lexer{
+	l := &Lexer{file: file, input: input, position: 0, line: 1, column: 1}
 	if len(input) == 0 {
 		l.ch = 0
 		l.peekCh = 0
@@ -32,7 +38,26 @@ func New(input string) *Lexer{
 	return l
 }
 
+// KeepComments makes the lexer attach the comments in front of every
+// token to its Trivia instead of dropping them, so that tools like
+// formatters can reproduce them. Comments at the end of the file go to
+// the EOF token.
+func (l *Lexer) KeepComments(keep bool) {
+	l.keep = keep
+}
+
+// Diagnostics returns the errors found while scanning
+func (l *Lexer) Diagnostics() *diag.List {
+	return &l.diags
+}
+
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.column = 1
+	} else if l.position < len(l.input) {
+		l.column++
+	}
 	l.position += 1
 	if l.position >= len(l.input) {
 		l.ch = 0
@@ -46,9 +71,21 @@ func (l *Lexer) readChar() {
 	}
 }
 
+// pos returns the position of the current character
+func (l *Lexer) pos() token.Position {
+	return token.Position{
+		File: l.file,
+		Line: l.line,
+		Column: l.column,
+		Offset: l.position,
+	}
+}
+
 func (l *Lexer) nextToken() token.Token {
-	l.skipWhiteSpace()
+	trivia := l.skipTrivia()
 	var tok token.Token 
+	tok.Span.Start = l.pos()
+	tok.Trivia = trivia
 	switch l.ch {
 	case '=': 
 		if l.peekCh == '=' {
@@ -80,6 +117,9 @@ func (l *Lexer) nextToken() token.Token {
 	case '/':
 		tok.Type = token.SLASH
 		tok.Literal = "/"
+	case '%':
+		tok.Type = token.PERCENT
+		tok.Literal = "%"
 	case '&':
 		if l.peekCh == '&' {
 			tok.Type = token.AND
@@ -94,6 +134,8 @@ func (l *Lexer) nextToken() token.Token {
 			tok.Type = token.OR 
 			tok.Literal = "||"
 			l.readChar()
+		} else {
+			tok = l.illegal(tok)
 		}
 	case '<':
 		if l.peekCh == '=' {
@@ -147,14 +189,32 @@ func (l *Lexer) nextToken() token.Token {
 		if isLetter(l.ch) {
 			tok.Literal = l.readIdent()
 			tok.Type = token.LookupIdent(tok.Literal)
+			tok.Span.End = l.pos()
 			return tok 
 		} else if isDigit(l.ch) {
 			tok.Literal = l.readNumber()
 			tok.Type = token.INT 
+			tok.Span.End = l.pos()
 			return tok
 		}
+		tok = l.illegal(tok)
 	}
-	l.readChar()
+	if l.ch != 0 {
+		l.readChar()
+	}
+	tok.Span.End = l.pos()
+	return tok
+}
+
+// illegal turns tok into an ILLEGAL token holding the current character
+// and reports it
+func (l *Lexer) illegal(tok token.Token) token.Token {
+	tok.Type = token.ILLEGAL
+	tok.Literal = string(l.ch)
+	span := token.Span{Start: tok.Span.Start, End: l.pos()}
+	span.End.Column++
+	span.End.Offset++
+	l.diags.Errorf(diag.UnknownCharacter, span, "unknown character %q", l.ch)
 	return tok
 }
 
@@ -171,7 +231,7 @@ func (l *Lexer) Scan() []token.Token {
 
 func (l *Lexer)readIdent() string {
 	position := l.position 
-	for (isLetter(l.ch)) {
+	for isLetter(l.ch) || isDigit(l.ch) {
 		l.readChar()
 	}
 	return l.input[position:l.position]
@@ -185,17 +245,150 @@ func (l *Lexer)readNumber() string {
 	return l.input[position:l.position]
 }
 
+// readString reads a string literal and returns its bytes with the
+// escape sequences decoded. A string ends at the closing quote; reaching
+// the end of the line first is an error.
 func (l *Lexer)readString() string {
-	position := l.position + 1
+	start := l.pos()
+	var out []byte
 	l.readChar()
 	for l.ch != '"' {
+		if l.ch == '\n' || l.ch == 0 {
+			quote := token.Span{Start: start, End: start}
+			quote.End.Column++
+			quote.End.Offset++
+			l.diags.Errorf(diag.UnterminatedString, quote,
+				"unterminated string literal")
+			// 停在换行符处，下一行照常扫描
+			return string(out)
+		}
+		if l.ch == '\\' {
+			out = append(out, l.readEscape())
+		} else {
+			out = append(out, l.ch)
+		}
 		l.readChar()
 	}
-	return l.input[position:l.position]
+	return string(out)
+}
+
+func hexValue(ch byte) (byte, bool) {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return ch - '0', true
+	case ch >= 'a' && ch <= 'f':
+		return ch - 'a' + 10, true
+	case ch >= 'A' && ch <= 'F':
+		return ch - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// readEscape decodes the escape sequence starting at the backslash and
+// leaves the lexer on its last character
+func (l *Lexer)readEscape() byte {
+	start := l.pos()
+	switch l.peekCh {
+	case 'n':
+		l.readChar()
+		return '\n'
+	case 't':
+		l.readChar()
+		return '\t'
+	case '\\':
+		l.readChar()
+		return '\\'
+	case '"':
+		l.readChar()
+		return '"'
+	case '0':
+		l.readChar()
+		return 0
+	case 'x':
+		l.readChar()
+		high, ok1 := hexValue(l.peekCh)
+		if ok1 {
+			l.readChar()
+		}
+		low, ok2 := hexValue(l.peekCh)
+		if ok1 && ok2 {
+			l.readChar()
+			return high << 4 | low
+		}
+		span := token.Span{Start: start, End: l.pos()}
+		span.End.Column++
+		span.End.Offset++
+		l.diags.Errorf(diag.UnknownEscape, span,
+			"\\x must be followed by two hexadecimal digits")
+		return 0
+	}
+	span := token.Span{Start: start, End: start}
+	span.End.Column += 2
+	span.End.Offset += 2
+	if l.peekCh == '\n' || l.peekCh == 0 {
+		span.End.Column--
+		span.End.Offset--
+		l.diags.Errorf(diag.UnknownEscape, span, "unknown escape sequence")
+		return '\\'
+	}
+	l.diags.Errorf(diag.UnknownEscape, span,
+		"unknown escape sequence `\\%c`", l.peekCh)
+	l.readChar()
+	return l.ch
 }
 
 func (l *Lexer)skipWhiteSpace() {
 	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
 		l.readChar()
 	}
-}
\ No newline at end of file
+}
+
+// skipTrivia skips whitespace and comments. The comments are returned
+// if the lexer keeps them.
+func (l *Lexer)skipTrivia() []token.Token {
+	var trivia []token.Token
+	for {
+		l.skipWhiteSpace()
+		if l.ch != '/' || (l.peekCh != '/' && l.peekCh != '*') {
+			return trivia
+		}
+		comment := l.readComment()
+		if l.keep {
+			trivia = append(trivia, comment)
+		}
+	}
+}
+
+// readComment reads a // or /* */ comment, delimiters included
+func (l *Lexer)readComment() token.Token {
+	tok := token.Token{Type: token.COMMENT}
+	tok.Span.Start = l.pos()
+	position := l.position
+	if l.peekCh == '/' {
+		// 行注释到换行符为止，换行符不属于注释
+		for l.ch != '\n' && l.ch != 0 {
+			l.readChar()
+		}
+	} else {
+		l.readChar()
+		l.readChar()
+		for !(l.ch == '*' && l.peekCh == '/') {
+			if l.ch == 0 {
+				open := token.Span{Start: tok.Span.Start, End: tok.Span.Start}
+				open.End.Column += 2
+				open.End.Offset += 2
+				l.diags.Errorf(diag.UnterminatedComment, open,
+					"unterminated block comment")
+				break
+			}
+			l.readChar()
+		}
+		if l.ch != 0 {
+			l.readChar()
+			l.readChar()
+		}
+	}
+	tok.Literal = l.input[position:l.position]
+	tok.Span.End = l.pos()
+	return tok
+}
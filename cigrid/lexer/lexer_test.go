@@ -0,0 +1,138 @@
+package lexer
+
+import "cigrid/token"
+import "fmt"
+import "testing"
+
+// types lists the types of the tokens, EOF included
+func types(list []token.Token) string {
+	result := []string{}
+	for _, v := range list {
+		result = append(result, string(v.Type))
+	}
+	return fmt.Sprint(result)
+}
+
+// errors lists the diagnostics of l as "line:column code"
+func errors(l *Lexer) []string {
+	result := []string{}
+	for _, d := range l.Diagnostics().Items() {
+		result = append(result, fmt.Sprintf("%d:%d %s", d.Span.Start.Line, d.Span.Start.Column, d.Code))
+	}
+	return result
+}
+
+func TestComments(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []token.TokenType
+	}{
+		{"x // y = 1;\n= 2", []token.TokenType{token.IDENT, token.ASSIGN, token.INT, token.EOF}},
+		{"a /* b\n c */ / d", []token.TokenType{token.IDENT, token.SLASH, token.IDENT, token.EOF}},
+		{"a /** / */ * b", []token.TokenType{token.IDENT, token.ASTERISK, token.IDENT, token.EOF}},
+		{"// only a comment", []token.TokenType{token.EOF}},
+		{"a/*x*//*y*/b", []token.TokenType{token.IDENT, token.IDENT, token.EOF}},
+	}
+	for _, test := range tests {
+		l := New("test.c", test.input)
+		got := l.Scan()
+		if types(got) != fmt.Sprint(test.want) {
+			t.Errorf("%q: got %s, want %v", test.input, types(got), test.want)
+		}
+		if len(errors(l)) > 0 {
+			t.Errorf("%q: unexpected errors %v", test.input, errors(l))
+		}
+	}
+}
+
+// TestTrivia checks that kept comments go to the token after them, the
+// last ones to EOF
+func TestTrivia(t *testing.T) {
+	l := New("test.c", "// one\n/* two */ x /* three */\n// four\n")
+	l.KeepComments(true)
+	list := l.Scan()
+	if len(list) != 2 {
+		t.Fatalf("got %s, want x and EOF", types(list))
+	}
+	want := [][]string{{"// one", "/* two */"}, {"/* three */", "// four"}}
+	for k, tok := range list {
+		got := []string{}
+		for _, v := range tok.Trivia {
+			if v.Type != token.COMMENT {
+				t.Errorf("trivia of type %s", v.Type)
+			}
+			got = append(got, v.Literal)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want[k]) {
+			t.Errorf("token %d: trivia %q, want %q", k, got, want[k])
+		}
+	}
+	if start := list[0].Trivia[1].Span.Start; start.Line != 2 || start.Column != 1 {
+		t.Errorf("`/* two */` at %d:%d, want 2:1", start.Line, start.Column)
+	}
+	// without KeepComments they are dropped
+	if list := New("test.c", "// one\nx").Scan(); len(list[0].Trivia) != 0 {
+		t.Errorf("trivia kept: %v", list[0].Trivia)
+	}
+}
+
+func TestUnterminatedComment(t *testing.T) {
+	l := New("test.c", "x = 1;\n  /* never\nclosed")
+	got := l.Scan()
+	if types(got) != fmt.Sprint([]token.TokenType{token.IDENT, token.ASSIGN, token.INT, token.SEMICOLON, token.EOF}) {
+		t.Errorf("got %s", types(got))
+	}
+	if fmt.Sprint(errors(l)) != "[2:3 E0002]" {
+		t.Errorf("errors %v, want [2:3 E0002]", errors(l))
+	}
+}
+
+func TestEscapes(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`"a\nb"`, "a\nb"},
+		{`"\t\\\"\0"`, "\t\\\"\x00"},
+		{`"\x41\x7a\xFF"`, "Az\xff"},
+		{`"100%\n"`, "100%\n"},
+		{`""`, ""},
+	}
+	for _, test := range tests {
+		l := New("test.c", test.input)
+		got := l.Scan()
+		if got[0].Type != token.STRING || got[0].Literal != test.want {
+			t.Errorf("%s: got %s %q, want %q", test.input, got[0].Type, got[0].Literal, test.want)
+		}
+		if len(errors(l)) > 0 {
+			t.Errorf("%s: unexpected errors %v", test.input, errors(l))
+		}
+	}
+}
+
+func TestBadStrings(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{`x = "a\qb";`, []string{"1:7 E0004"}},
+		{`x = "\x4";`, []string{"1:6 E0004"}},
+		{`x = "\xg1";`, []string{"1:6 E0004"}},
+		// the next line is scanned as usual
+		{"x = \"open;\ny = 1;", []string{"1:5 E0003"}},
+		{"x = \"open\\", []string{"1:10 E0004", "1:5 E0003"}},
+		{`"never closed`, []string{"1:1 E0003"}},
+	}
+	for _, test := range tests {
+		l := New("test.c", test.input)
+		l.Scan()
+		if got := errors(l); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%q: got %v, want %v", test.input, got, test.want)
+		}
+	}
+	list := New("test.c", "x = \"open;\ny = 1;").Scan()
+	if types(list) != fmt.Sprint([]token.TokenType{token.IDENT, token.ASSIGN, token.STRING,
+		token.IDENT, token.ASSIGN, token.INT, token.SEMICOLON, token.EOF}) {
+		t.Errorf("after an unterminated string: %s", types(list))
+	}
+}
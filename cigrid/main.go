@@ -3,80 +3,398 @@ package main
 import "cigrid/token"
 import "cigrid/lexer"
 import "cigrid/parser"
+import "cigrid/sema"
 import "cigrid/ir_translator"
-import "strconv"
+import "cigrid/ir/cfg"
+import "cigrid/ir/ssa"
+import "cigrid/ir/opt"
+import "cigrid/ir/regalloc"
+import "cigrid/ir/parse"
+import "cigrid/ir/interp"
 import "cigrid/asm"
+import "cigrid/diag"
+import "errors"
 import "fmt"
 import "bytes"
 import "os"
+import "io"
+import "flag"
+import "path/filepath"
+import "strings"
 
-func printTokenList(tokList []token.Token) {
+func printTokenList(w io.Writer, tokList []token.Token) {
 	for id, tok := range tokList {
-		fmt.Printf("%-4v $ %-10v $ %-15v\n", id, tok.Type, tok.Literal)
+		for _, v := range tok.Trivia {
+			fmt.Fprintf(w, "     # %-10v $ %-15q $ %v\n", v.Type, v.Literal,
+				v.Span.Start)
+		}
+		fmt.Fprintf(w, "%-4v $ %-10v $ %-15v $ %v\n", id, tok.Type, tok.Literal,
+			tok.Span.Start)
 	}
 }
 
-func printIrList(t *ir_translator.IrTranslator) {
-	stringList := t.ReadStringList()
-	for k, v := range stringList {
-		fmt.Println("str" + strconv.Itoa(k + 1), v)
+func printIrList(w io.Writer, t *ir_translator.IrTranslator) {
+	fmt.Fprint(w, t.String())
+}
+
+// options are the flags that shape the IR after translation
+type options struct {
+	optimize bool
+	verbose  io.Writer // where the passes report what they did, nil for quiet
+	allocate bool      // put temps and variables in registers
+	method   regalloc.Method
+	trapDiv  bool      // check divisors at run time
+}
+
+// printSsa prints the program in SSA form, optimised if asked to
+func printSsa(w io.Writer, t *ir_translator.IrTranslator, opts options) {
+	functions := []*ir_translator.IrFunction{}
+	for _, v := range t.ReadIrFunctionList() {
+		f, stats := toSsa(v, opts.optimize)
+		report(opts, f, stats)
+		functions = append(functions, f)
 	}
-	irFunctionList := t.ReadIrFunctionList()
-	for _, v1 := range irFunctionList {
-		fmt.Println("-----------------------------------------------")
-		fmt.Println("<<" + v1.ReadName() + ">>")
-		for _, v2 := range v1.ReadIrList() {
-			fmt.Println(v2.IrString())
+	printIrList(w, ir_translator.NewFromIr(functions, t.ReadStringList(), t.ReadGlobalList()))
+}
+
+// toSsa builds the SSA form of f, unless an .ir input is in SSA form
+// already, and with optimize runs the passes of package ir/opt over it
+func toSsa(f *ir_translator.IrFunction, optimize bool) (*ir_translator.IrFunction, opt.Stats) {
+	build := ssa.Build
+	if ssa.IsSSA(f) {
+		build = func(f *ir_translator.IrFunction) *ir_translator.IrFunction { return f }
+	}
+	if !optimize {
+		return build(f), opt.Stats{}
+	}
+	// building drops unreachable blocks too, but without counting them
+	f, stats := opt.DCE(f)
+	f, more := opt.SCCP(build(f))
+	stats.Add(more)
+	f, more = opt.DCE(f)
+	stats.Add(more)
+	return f, stats
+}
+
+// optimized returns t with every function optimised in SSA form
+func optimized(t *ir_translator.IrTranslator, opts options) *ir_translator.IrTranslator {
+	functions := []*ir_translator.IrFunction{}
+	for _, v := range t.ReadIrFunctionList() {
+		f, stats := toSsa(v, true)
+		// leaving SSA form lets go of the labels the phis needed
+		f, more := opt.DCE(ssa.Destruct(f))
+		stats.Add(more)
+		report(opts, f, stats)
+		functions = append(functions, f)
+	}
+	return ir_translator.NewFromIr(functions, t.ReadStringList(), t.ReadGlobalList())
+}
+
+// allocated returns t with registers allocated, if asked to, and the
+// registers live across each call saved. A function still in SSA form,
+// read from an .ir input, leaves it first.
+func allocated(t *ir_translator.IrTranslator, opts options) *ir_translator.IrTranslator {
+	functions := []*ir_translator.IrFunction{}
+	for _, v := range t.ReadIrFunctionList() {
+		if ssa.IsSSA(v) {
+			v = ssa.Destruct(v)
 		}
-		for k, v := range v1.ReadAddressMap() {
-			fmt.Println(k + " " + strconv.Itoa(v))
+		if opts.allocate {
+			v = regalloc.Allocate(v, opts.method)
+		} else {
+			v = regalloc.SaveAcrossCalls(v)
 		}
-		fmt.Println(v1.ReadMaxRegister())
-		fmt.Println("-----------------------------------------------")
+		functions = append(functions, v)
+	}
+	return ir_translator.NewFromIr(functions, t.ReadStringList(), t.ReadGlobalList())
+}
+
+// report tells what the optimisations removed from f
+func report(opts options, f *ir_translator.IrFunction, stats opt.Stats) {
+	if opts.verbose != nil && opts.optimize {
+		fmt.Fprintf(opts.verbose, "cigrid: %s: dead code removed: %v\n", f.ReadName(), stats)
 	}
 }
 
-func printAsm(a []string) {
-	var out bytes.Buffer 
+func printCfg(w io.Writer, t *ir_translator.IrTranslator) {
+	for _, v := range t.ReadIrFunctionList() {
+		fmt.Fprintln(w, "<<" + v.ReadName() + ">>")
+		fmt.Fprint(w, cfg.New(v.ReadIrList()).String())
+	}
+}
+
+func printAsm(w io.Writer, a []string) {
+	var out bytes.Buffer
 	for _, v := range(a) {
 		out.WriteString(v)
 		out.WriteString("\n")
 	}
-	fmt.Println(out.String())
-	file, err := os.OpenFile("hello.asm", 
-		os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_TRUNC, 0666)
-	defer file.Close()
+	w.Write(out.Bytes())
+}
+
+// emit kinds accepted by --emit
+var emitKinds = []string{"tokens", "ast", "ir", "ssa", "cfg", "asm"}
+
+func validEmit(kind string) bool {
+	for _, v := range emitKinds {
+		if v == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// readSources lexes every input file and joins the token lists into one
+// program, keeping only the final EOF. The file contents are kept in
+// sources for printing diagnostics. With keepComments the comments at the
+// end of a file move on to the first token of the next one.
+func readSources(paths []string, keepComments bool, sources map[string]string,
+				 diags *diag.List) ([]token.Token, error) {
+	result := []token.Token{}
+	var trailing []token.Token
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sources[path] = string(content)
+		l := lexer.New(path, string(content))
+		l.KeepComments(keepComments)
+		tokList := l.Scan()
+		diags.Append(l.Diagnostics())
+		tokList[0].Trivia = append(trailing, tokList[0].Trivia...)
+		trailing = tokList[len(tokList) - 1].Trivia
+		result = append(result, tokList[:len(tokList) - 1]...)
+	}
+	eof := token.Token{Type: token.EOF, Literal: "", Trivia: trailing}
+	if len(result) > 0 {
+		eof.Span = result[len(result) - 1].Span
+	}
+	result = append(result, eof)
+	return result, nil
+}
+
+// outputPath decides where the result goes: "-" is stdout, an empty -o
+// writes assembly next to the first input and everything else to stdout.
+func outputPath(output string, emit string, inputs []string) string {
+	if output != "" {
+		return output
+	}
+	if emit != "asm" {
+		return "-"
+	}
+	base := strings.TrimSuffix(inputs[0], filepath.Ext(inputs[0]))
+	return base + ".asm"
+}
+
+// readIr reads a program in the textual IR format instead of source
+func readIr(path string, sources map[string]string,
+			diags *diag.List) (*ir_translator.IrTranslator, error) {
+	content, err := os.ReadFile(path)
 	if err != nil {
-		fmt.Println("error")
-		return
-	} 
-	file.WriteString(out.String())
+		return nil, err
+	}
+	sources[path] = string(content)
+	p := parse.New(path, string(content))
+	t := p.Parse()
+	diags.Append(p.Diagnostics())
+	return t, nil
 }
 
-func main() {
-	input := `
-void swap(int * x, int * y) {
-	*x = *x + *y;
-	return;
-}
-int main() {
-	int x = 2;
-	int y = 30;
-	swap(&x, &y);
-	printf("%d %d\n", x, y);
-	return 0;
-}
-`
-	l := lexer.New(input)
-	tokList := l.Scan()
-	printTokenList(tokList) // 打印token list
+// compile runs the pipeline up to the stage selected by emit. It stops
+// after the first stage that reports an error.
+func compile(inputs []string, emit string, opts options,
+			 sources map[string]string, diags *diag.List) ([]byte, error) {
+	var out bytes.Buffer
+	t, err := translate(inputs, emit, &out, sources, diags)
+	if err != nil || t == nil {
+		return out.Bytes(), err
+	}
+	return backend(&out, t, emit, opts, diags), nil
+}
+
+// translate runs the front end and returns the IR of the program. When
+// emit asks for tokens or the AST they are written to out instead and
+// no IR is returned, as after an error. A single .ir input is read as IR.
+func translate(inputs []string, emit string, out *bytes.Buffer,
+			   sources map[string]string, diags *diag.List) (*ir_translator.IrTranslator, error) {
+	if filepath.Ext(inputs[0]) == ".ir" {
+		if len(inputs) > 1 || emit == "tokens" || emit == "ast" {
+			return nil, fmt.Errorf("an .ir input must be the only input and " +
+				"can only emit ir, ssa, cfg or asm")
+		}
+		t, err := readIr(inputs[0], sources, diags)
+		if err != nil || diags.HasErrors() {
+			return nil, err
+		}
+		return t, nil
+	}
+	tokList, err := readSources(inputs, emit == "tokens", sources, diags)
+	if err != nil || diags.HasErrors() {
+		return nil, err
+	}
+	if emit == "tokens" {
+		printTokenList(out, tokList)
+		return nil, nil
+	}
 	p := parser.New(tokList)
 	tree := p.ParseProgram()
-	fmt.Println(tree.String()) // 打印ast
-	t := ir_translator.New(tree)
+	diags.Append(p.Diagnostics())
+	if diags.HasErrors() {
+		return nil, nil
+	}
+	if emit == "ast" {
+		fmt.Fprintln(out, tree.String())
+		return nil, nil
+	}
+	a := sema.New(tree)
+	info := a.Analyze()
+	diags.Append(a.Diagnostics())
+	if diags.HasErrors() {
+		return nil, nil
+	}
+	c := sema.NewChecker(tree, info)
+	c.Check()
+	diags.Append(c.Diagnostics())
+	if diags.HasErrors() {
+		return nil, nil
+	}
+	t := ir_translator.New(tree, info)
 	t.Translate()
-	printIrList(t) // 打印IR
-	asm_list := asm.GenerateAsm(t) 
-	printAsm(asm_list) // 打印x86-64
+	diags.Append(t.Diagnostics())
+	if diags.HasErrors() {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// interpret runs the program in the IR interpreter and returns its exit
+// status
+func interpret(inputs []string, opts options, stdout io.Writer, stderr io.Writer) int {
+	sources := map[string]string{}
+	var diags diag.List
+	var out bytes.Buffer
+	t, err := translate(inputs, "ir", &out, sources, &diags)
+	diags.Sort()
+	diag.RenderAll(stderr, &diags, sources)
+	if err != nil {
+		fmt.Fprintln(stderr, "cigrid:", err)
+		return 1
+	}
+	if t == nil {
+		return 1
+	}
+	if opts.optimize {
+		t = optimized(t, opts)
+	}
+	code, err := interp.New(allocated(t, opts), stdout).Run()
+	if opts.trapDiv && errors.Is(err, interp.ErrDivisionByZero) {
+		// as the program built with --trap-div does
+		fmt.Fprint(stderr, asm.DivTrapMessage)
+		return asm.DivTrapStatus
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "cigrid: runtime error:", err)
+		return 1
+	}
+	return code
+}
+
+// backend emits the translated program as ir, ssa, cfg or asm
+func backend(out *bytes.Buffer, t *ir_translator.IrTranslator, emit string,
+			 opts options, diags *diag.List) []byte {
+	if emit == "ssa" {
+		printSsa(out, t, opts)
+		return out.Bytes()
+	}
+	if opts.optimize {
+		t = optimized(t, opts)
+	}
+	if emit == "ir" {
+		printIrList(out, t)
+		return out.Bytes()
+	} else if emit == "cfg" {
+		printCfg(out, t)
+		return out.Bytes()
+	}
+	asmList := asm.GenerateAsm(allocated(t, opts), asm.Options{TrapDiv: opts.trapDiv}, diags)
+	if diags.HasErrors() {
+		return nil
+	}
+	printAsm(out, asmList)
+	return out.Bytes()
 }
 
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("cigrid", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	output := flags.String("o", "", "write output to `file` (\"-\" for stdout)")
+	emit := flags.String("emit", "asm", "what to emit: " + strings.Join(emitKinds, "|"))
+	runProgram := flags.Bool("run", false, "run the program in the IR interpreter instead")
+	optimize := flags.Bool("O", false, "optimise the IR in SSA form")
+	verbose := flags.Bool("v", false, "report what the optimisations removed")
+	method := flags.String("regalloc", "linear", "register allocation: linear|color|none")
+	trapDiv := flags.Bool("trap-div", false, "stop with a message on a division by zero instead of crashing")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: cigrid [-o file] [--emit=tokens|ast|ir|ssa|cfg|asm] [-O] [-v] [-regalloc=linear|color|none] [--trap-div] [-run] file... | file.ir")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if !validEmit(*emit) {
+		fmt.Fprintf(stderr, "cigrid: unknown emit kind %q\n", *emit)
+		flags.Usage()
+		return 2
+	}
+	inputs := flags.Args()
+	if len(inputs) == 0 {
+		fmt.Fprintln(stderr, "cigrid: no input files")
+		flags.Usage()
+		return 2
+	}
+	opts := options{optimize: *optimize, allocate: *method != "none", trapDiv: *trapDiv}
+	switch *method {
+	case "linear", "none":
+	case "color":
+		opts.method = regalloc.GraphColouring
+	default:
+		fmt.Fprintf(stderr, "cigrid: unknown register allocation %q\n", *method)
+		flags.Usage()
+		return 2
+	}
+	if *verbose {
+		opts.verbose = stderr
+	}
+	if *runProgram {
+		return interpret(inputs, opts, stdout, stderr)
+	}
+
+	sources := map[string]string{}
+	var diags diag.List
+	out, err := compile(inputs, *emit, opts, sources, &diags)
+	diags.Sort()
+	diag.RenderAll(stderr, &diags, sources)
+	if err != nil {
+		fmt.Fprintln(stderr, "cigrid:", err)
+		return 1
+	}
+	if diags.HasErrors() {
+		return 1
+	}
+
+	path := outputPath(*output, *emit, inputs)
+	if path == "-" {
+		stdout.Write(out)
+		return 0
+	}
+	if err := os.WriteFile(path, out, 0666); err != nil {
+		fmt.Fprintln(stderr, "cigrid:", err)
+		return 1
+	}
+	return 0
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
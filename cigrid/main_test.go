@@ -0,0 +1,93 @@
+package main
+
+import "bytes"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+
+func TestOutputPath(t *testing.T) {
+	tests := []struct {
+		output string
+		emit   string
+		inputs []string
+		want   string
+	}{
+		{"", "asm", []string{"c.c"}, "c.asm"},
+		{"", "asm", []string{"sub/c.c", "d.c"}, filepath.Join("sub", "c.asm")},
+		{"", "asm", []string{"/tmp/x/prog.ir"}, "/tmp/x/prog.asm"},
+		{"", "asm", []string{"sub/noext"}, filepath.Join("sub", "noext.asm")},
+		{"", "ir", []string{"sub/c.c"}, "-"},
+		{"out.s", "asm", []string{"sub/c.c"}, "out.s"},
+		{"-", "asm", []string{"sub/c.c"}, "-"},
+	}
+	for _, test := range tests {
+		if got := outputPath(test.output, test.emit, test.inputs); got != test.want {
+			t.Errorf("outputPath(%q, %q, %v) = %q, want %q",
+				test.output, test.emit, test.inputs, got, test.want)
+		}
+	}
+}
+
+// TestRunWritesNextToInput checks that the assembly lands in the
+// directory of the input, not the working directory
+func TestRunWritesNextToInput(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sub")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	input := filepath.Join(dir, "c.c")
+	if err := os.WriteFile(input, []byte("int main() {\n\treturn 0;\n}\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{input}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d: %s", code, stderr.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c.asm")); err != nil {
+		t.Errorf("no assembly next to the input: %v", err)
+	}
+}
+
+// TestSsaInput runs an .ir input already in SSA form, whose phis swap two
+// values, with and without -O: it must not be built into SSA form again
+func TestSsaInput(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "cycle.ir")
+	program := "string str1 \"%d %d\\n\"\nfunction main frame 0 temps 0\n" +
+		".B0:\n\tjmp .L1\n" +
+		".L1:\n\ta#1 = phi .B0: 1, .L2: b#1\n\tb#1 = phi .B0: 2, .L2: a#1\n" +
+		"\tn#1 = phi .B0: 0, .L2: n#2\n\tcmp n#1 1\n\tjge .L3\n" +
+		".L2:\n\tn#2 = add n#1 1\n\tjmp .L1\n" +
+		".L3:\n\tmov %rdi @str1\n\tmov %rsi a#1\n\tmov %rdx b#1\n\txor %rax %rax\n" +
+		"\tcall printf 3\n\tmov %rax 0\n\tret\nend\n"
+	if err := os.WriteFile(input, []byte(program), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"-run"}, {"-run", "-O"}, {"-run", "-O", "-regalloc", "none"}} {
+		var stdout, stderr bytes.Buffer
+		code := run(append(args, input), &stdout, &stderr)
+		if code != 0 || stdout.String() != "2 1\n" {
+			t.Errorf("%v: exit status %d, printed %q, want \"2 1\\n\"; %s",
+				args, code, stdout.String(), stderr.String())
+		}
+	}
+}
+
+// TestVerbose checks that -v counts the branch SCCP decides and the arm
+// it drops, not only what DCE removes
+func TestVerbose(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "branch.c")
+	program := "int main() {\n\tint x = 1;\n\tif (x > 3) {\n\t\treturn 7;\n\t}\n\treturn 9;\n}\n"
+	if err := os.WriteFile(input, []byte(program), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-O", "-v", "-o", "-", input}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d: %s", code, stderr.String())
+	}
+	for _, want := range []string{"2 blocks", "1 branches"} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("%q does not say %q", stderr.String(), want)
+		}
+	}
+}
@@ -1,18 +1,19 @@
-package parser 
+package parser
 
 import "cigrid/token"
 import "cigrid/ast"
+import "cigrid/diag"
 import "strconv"
-//import "fmt"
 
 func lookupPrecedence(tokType token.TokenType) int {
-	if tokType == token.ASTERISK || tokType == token.SLASH { // * /
+	if tokType == token.ASTERISK || tokType == token.SLASH ||
+	   tokType == token.PERCENT { // * / %
 		return 8
-	} else if tokType == token.PLUS || tokType == token.MINUS { // 
+	} else if tokType == token.PLUS || tokType == token.MINUS { //
 		return 7
-	} else if tokType == token.LT || tokType == token.GT || 
+	} else if tokType == token.LT || tokType == token.GT ||
 			  tokType == token.L_EQ || tokType == token.G_EQ {
-		return 6		
+		return 6
 	} else if tokType == token.EQ || tokType == token.NOT_EQ {
 		return 5
 	} else if tokType == token.AND {
@@ -23,12 +24,21 @@ func lookupPrecedence(tokType token.TokenType) int {
 	return 0
 }
 
+func isTypeKeyword(tokType token.TokenType) bool {
+	return tokType == token.TVOID || tokType == token.TINT ||
+		   tokType == token.TSTRING
+}
+
+// Parser 出错时采用 panic mode：出错的函数报告一次错误并返回 nil，
+// 调用链逐层返回 nil，直到语句层或顶层调用 synchronize 跳到下一个
+// 可以继续解析的位置（; } 或顶层的类型关键词）
 type Parser struct {
 	tokList   []token.Token
-	position  int 
-	curToken  token.Token 
+	position  int
+	curToken  token.Token
 	peekToken token.Token
-} 
+	diags     diag.List
+}
 
 
 func New(tokList []token.Token) *Parser {
@@ -41,9 +51,25 @@ func New(tokList []token.Token) *Parser {
 	return p
 }
 
+// Diagnostics returns the syntax errors found by ParseProgram
+func (p *Parser) Diagnostics() *diag.List {
+	return &p.diags
+}
+
+// describe names a token for error messages
+func describe(tok token.Token) string {
+	if tok.Type == token.EOF || tok.Type == token.IDENT || tok.Type == token.INT {
+		return token.Describe(tok.Type)
+	}
+	return "`" + tok.Literal + "`"
+}
+
 func (p *Parser) nextToken() {
 	p.position = p.position + 1
 	eofToken := token.Token{Type: token.EOF, Literal: ""}
+	if len(p.tokList) > 0 {
+		eofToken.Span = p.tokList[len(p.tokList) - 1].Span
+	}
 	if p.position >= len(p.tokList) {
 		p.curToken = eofToken
 		p.peekToken = eofToken
@@ -56,35 +82,122 @@ func (p *Parser) nextToken() {
 	}
 }
 
-func (p *Parser) parseIndexExpression() ast.Expression {
-	ie := &ast.IndexExpression{}
-	ie.Name = &ast.Identifier{Value: p.curToken}
-	p.nextToken()
-	p.nextToken()
-	ie.Index = p.parseExpression(0)
+// expectPeek advances if the next token has type tokType, otherwise it
+// reports the expected and the found token and leaves the position alone.
+func (p *Parser) expectPeek(tokType token.TokenType) bool {
+	if p.peekToken.Type == tokType {
+		p.nextToken()
+		return true
+	}
+	p.diags.Errorf(diag.UnexpectedToken, p.peekToken.Span,
+		"expected %s, found %s", token.Describe(tokType), describe(p.peekToken))
+	return false
+}
+
+// startsStatement tells whether a statement can only begin at tokType.
+// `{` is not one: braces only open the bodies of functions, if and while.
+func startsStatement(tokType token.TokenType) bool {
+	return isTypeKeyword(tokType) || tokType == token.IF ||
+		   tokType == token.WHILE || tokType == token.RETURN
+}
+
+// synchronize skips the rest of a broken statement. It stops after a `;`,
+// in front of the `}` that closes the current block or in front of the
+// keyword that starts the next statement, such as the `int` after a
+// missing `;`; braces opened while skipping are skipped as a whole. The
+// token the error was found at is always skipped, so parsing moves on.
+func (p *Parser) synchronize() {
+	depth := 0
+	for first := true; p.curToken.Type != token.EOF; first = false {
+		if !first && depth == 0 && startsStatement(p.curToken.Type) {
+			return
+		}
+		if p.curToken.Type == token.LBRACE {
+			depth++
+		} else if p.curToken.Type == token.RBRACE {
+			if depth == 0 {
+				return
+			}
+			depth--
+			if depth == 0 && p.peekToken.Type != token.ELSE {
+				p.nextToken()
+				return
+			}
+		} else if p.curToken.Type == token.SEMICOLON && depth == 0 {
+			p.nextToken()
+			return
+		}
+		p.nextToken()
+	}
+}
+
+// synchronizeGlobal skips to the next type keyword outside of any braces,
+// where the next global definition can start.
+func (p *Parser) synchronizeGlobal() {
+	depth := 0
 	p.nextToken()
-	return ie
+	for p.curToken.Type != token.EOF {
+		if p.curToken.Type == token.LBRACE {
+			depth++
+		} else if p.curToken.Type == token.RBRACE && depth > 0 {
+			depth--
+		} else if isTypeKeyword(p.curToken.Type) && depth == 0 {
+			return
+		}
+		p.nextToken()
+	}
+}
+
+// parseIndexExpression parses a[i]{[j]}, curToken is the name
+func (p *Parser) parseIndexExpression() ast.Expression {
+	var left ast.Expression = &ast.Identifier{Value: p.curToken}
+	for p.peekToken.Type == token.LBRACKET {
+		p.nextToken()
+		ie := &ast.IndexExpression{Left: left}
+		p.nextToken()
+		ie.Index = p.parseExpression(0)
+		if ie.Index == nil || !p.expectPeek(token.RBRACKET) {
+			return nil
+		}
+		ie.Rbracket = p.curToken
+		left = ie
+	}
+	return left
 }
 
-func (p *Parser) parseCallExpression() ast.Expression {
+func (p *Parser) parseCallExpression() *ast.CallExpression {
 	ce := &ast.CallExpression{}
 	ce.Name = &ast.Identifier{Value: p.curToken}
-	p.nextToken()
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
 	list := []ast.Expression{}
 	if p.peekToken.Type == token.RPAREN {
-		ce.Params = list 
+		ce.Params = list
 		p.nextToken()
-		return ce 
+		ce.Rparen = p.curToken
+		return ce
 	}
 	p.nextToken()
-	list = append(list, p.parseExpression(0))
+	param := p.parseExpression(0)
+	if param == nil {
+		return nil
+	}
+	list = append(list, param)
 	for p.peekToken.Type == token.COMMA {
 		p.nextToken()
 		p.nextToken()
-		list = append(list, p.parseExpression(0))
+		param = p.parseExpression(0)
+		if param == nil {
+			return nil
+		}
+		list = append(list, param)
 	}
 	ce.Params = list
-	p.nextToken()
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+	ce.Rparen = p.curToken
 	return ce
 }
 
@@ -95,7 +208,10 @@ func (p *Parser) parsePrefixExpression() ast.Expression {
 			return p.parseIndexExpression()
 		} else if p.peekToken.Type == token.LPAREN {
 			// printf("hello")，
-			return p.parseCallExpression()
+			if ce := p.parseCallExpression(); ce != nil {
+				return ce
+			}
+			return nil
 		}
 		// i
 		return &ast.Identifier{Value: p.curToken}
@@ -106,29 +222,50 @@ func (p *Parser) parsePrefixExpression() ast.Expression {
 	} else if p.curToken.Type == token.LPAREN {
 		p.nextToken()
 		expression := p.parseExpression(0)
-		p.nextToken()
+		if expression == nil || !p.expectPeek(token.RPAREN) {
+			return nil
+		}
 		return expression
 	} else if p.curToken.Type == token.LBRACE {
 		// {1, 2, 3, 4}
 		// 空数组不支持
+		al := &ast.ArrayLiteral{Token: p.curToken}
 		list := []ast.Expression{}
 		p.nextToken()
-		list = append(list, p.parseExpression(0))
+		element := p.parseExpression(0)
+		if element == nil {
+			return nil
+		}
+		list = append(list, element)
 		for p.peekToken.Type == token.COMMA {
 			p.nextToken()
 			p.nextToken()
-			list = append(list, p.parseExpression(0))
+			element = p.parseExpression(0)
+			if element == nil {
+				return nil
+			}
+			list = append(list, element)
 		}
-		p.nextToken()
-		return &ast.ArrayLiteral{Elements: list}
-	} else {
+		if !p.expectPeek(token.RBRACE) {
+			return nil
+		}
+		al.Elements = list
+		al.Rbrace = p.curToken
+		return al
+	} else if p.curToken.Type == token.BANG || p.curToken.Type == token.MINUS ||
+			  p.curToken.Type == token.ET || p.curToken.Type == token.ASTERISK {
 		// !, - , &, *
 		expression := &ast.PrefixExpression{Operator: p.curToken}
 		p.nextToken()
 		expression.Right = p.parsePrefixExpression()
+		if expression.Right == nil {
+			return nil
+		}
 		return expression
 	}
-	return &ast.IntegerLiteral{}
+	p.diags.Errorf(diag.ExpectedExpression, p.curToken.Span,
+		"expected expression, found %s", describe(p.curToken))
+	return nil
 }
 
 func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
@@ -136,16 +273,19 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	precedence := lookupPrecedence(p.curToken.Type)
 	p.nextToken()
 	right := p.parseExpression(precedence)
-	expression.Right = right 
+	if right == nil {
+		return nil
+	}
+	expression.Right = right
 	return expression
 }
 
 func (p *Parser) parseExpression(precedence int) ast.Expression {
 	leftExp := p.parsePrefixExpression()
-	for precedence < lookupPrecedence(p.peekToken.Type) {
+	for leftExp != nil && precedence < lookupPrecedence(p.peekToken.Type) {
 		p.nextToken()
 		leftExp = p.parseInfixExpression(leftExp)
-	} 
+	}
 	return leftExp
 }
 
@@ -154,60 +294,123 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 func (p *Parser) parseVarDefStatement() ast.Statement {
 	statement := &ast.VarDef{}
 	statement.VarType = p.parseType()
-	p.nextToken()
+	if statement.VarType == nil || !p.expectPeek(token.IDENT) {
+		return nil
+	}
 	statement.Name = &ast.Identifier{Value: p.curToken}
-	p.nextToken()
+	if p.peekToken.Type == token.LBRACKET {
+		return p.parseArrayDefStatement(statement.VarType, statement.Name)
+	} else if p.peekToken.Type == token.SEMICOLON {
+		// int x;
+		p.nextToken()
+		return statement
+	}
+	if !p.expectPeek(token.ASSIGN) {
+		return nil
+	}
 	p.nextToken()
 	statement.Value = p.parseExpression(0)
-	p.nextToken()
+	if statement.Value == nil || !p.expectPeek(token.SEMICOLON) {
+		return nil
+	}
+	return statement
+}
+
+func (p *Parser) parseArrayDefStatement(varType *ast.Type, name *ast.Identifier) ast.Statement {
+	statement := &ast.ArrayDef{VarType: varType, Name: name}
+	dims, ok := p.parseDims()
+	if !ok {
+		return nil
+	}
+	statement.Dims = dims
+	if p.peekToken.Type == token.ASSIGN {
+		p.nextToken()
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		value, ok := p.parsePrefixExpression().(*ast.ArrayLiteral)
+		if !ok {
+			return nil
+		}
+		statement.Value = value
+	}
+	if !p.expectPeek(token.SEMICOLON) {
+		return nil
+	}
 	return statement
 }
 
 func (p *Parser) parseVarAssignStatement() ast.Statement {
 	statement := &ast.VarAssign{}
 	statement.Left = p.parseExpression(0)
-	p.nextToken()
+	if statement.Left == nil || !p.expectPeek(token.ASSIGN) {
+		return nil
+	}
 	p.nextToken()
 	statement.Right = p.parseExpression(0)
-	p.nextToken()
+	if statement.Right == nil || !p.expectPeek(token.SEMICOLON) {
+		return nil
+	}
 	return statement
 }
 
 func (p *Parser) parseReturnStatement() ast.Statement {
+	returnToken := p.curToken
 	if p.peekToken.Type == token.SEMICOLON {
 		p.nextToken()
-		rs := &ast.ReturnStatement{ReturnValue: nil}
+		rs := &ast.ReturnStatement{Token: returnToken, ReturnValue: nil}
 		return rs
 	}
 	p.nextToken()
-	rs := &ast.ReturnStatement{ReturnValue: p.parseExpression(0)}
-	p.nextToken()
+	rs := &ast.ReturnStatement{Token: returnToken, ReturnValue: p.parseExpression(0)}
+	if rs.ReturnValue == nil || !p.expectPeek(token.SEMICOLON) {
+		return nil
+	}
 	return rs
 }
 
-func (p *Parser) parseIfStatement() ast.Statement {
-	ifstat := &ast.IfStatement{}
-	p.nextToken()
-	ifstat.Condition = p.parseExpression(0)
+// parseCondition parses `( expr )` following if / while
+func (p *Parser) parseCondition() ast.Expression {
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
 	p.nextToken()
+	condition := p.parseExpression(0)
+	if condition == nil || !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+	return condition
+}
+
+func (p *Parser) parseIfStatement() ast.Statement {
+	ifstat := &ast.IfStatement{Token: p.curToken}
+	ifstat.Condition = p.parseCondition()
+	if ifstat.Condition == nil || !p.expectPeek(token.LBRACE) {
+		return nil
+	}
 	ifstat.Consequence = p.parseBlockStatement()
 	if p.peekToken.Type == token.ELSE {
 		p.nextToken()
-		p.nextToken()
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
 		ifstat.Alternative = p.parseBlockStatement()
 	}
 	return ifstat
 }
 
 func (p *Parser) parseWhileStatement() ast.Statement {
-	whilestat := &ast.WhileStatement{}
-	p.nextToken()
-	whilestat.Condition = p.parseExpression(0)
-	p.nextToken()
+	whilestat := &ast.WhileStatement{Token: p.curToken}
+	whilestat.Condition = p.parseCondition()
+	if whilestat.Condition == nil || !p.expectPeek(token.LBRACE) {
+		return nil
+	}
 	whilestat.Consequence = p.parseBlockStatement()
 	return whilestat
 }
 
+// parseStatement 成功时 curToken 停在语句的最后一个 token 上，
+// 失败时返回 nil，由 parseBlockStatement 负责同步
 func (p *Parser) parseStatement() ast.Statement {
 	var statement ast.Statement
 	if p.curToken.Type == token.TSTRING || p.curToken.Type == token.TINT {
@@ -220,73 +423,178 @@ func (p *Parser) parseStatement() ast.Statement {
 		statement = p.parseWhileStatement()
 	} else if p.curToken.Type == token.IDENT && p.peekToken.Type == token.LPAREN {
 		// printf("hello\n");
-		temp, _ := (p.parseCallExpression()).(*ast.CallExpression)
+		temp := p.parseCallExpression()
+		if temp == nil || !p.expectPeek(token.SEMICOLON) {
+			return nil
+		}
 		statement = &ast.CallStatement{Value: temp}
-		p.nextToken()
 	} else if p.curToken.Type == token.IDENT {
 		// x = 1;
 		statement = p.parseVarAssignStatement()
 	} else if p.curToken.Type == token.ASTERISK {
 		// *x = 1;
 		statement = p.parseVarAssignStatement()
+	} else {
+		p.diags.Errorf(diag.ExpectedStatement, p.curToken.Span,
+			"expected statement, found %s", describe(p.curToken))
 	}
 	return statement
 }
 
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
-	block := &ast.BlockStatement{Token: p.curToken, Statements: []ast.Statement{}} 
+	block := &ast.BlockStatement{Token: p.curToken, Statements: []ast.Statement{}}
 	p.nextToken()
-	for p.curToken.Type != token.RBRACE {
+	for p.curToken.Type != token.RBRACE && p.curToken.Type != token.EOF {
 		statement := p.parseStatement()
-		block.Statements = append(block.Statements, statement)
-		p.nextToken()
+		if statement != nil {
+			block.Statements = append(block.Statements, statement)
+			p.nextToken()
+		} else {
+			p.synchronize()
+		}
 	}
+	if p.curToken.Type == token.EOF {
+		p.diags.Errorf(diag.UnexpectedToken, p.curToken.Span,
+			"expected `}`, found end of file").
+			Note(block.Token.Span, "unclosed block starts here")
+	}
+	block.Rbrace = p.curToken
 	return block
 }
 
-func (p *Parser) parseFunctionLiteral() ast.Global {
-	fl := &ast.FunctionLiteral{}
-	fl.ReturnType = p.parseType()
-	p.nextToken()
-	fl.Name = &ast.Identifier{Value: p.curToken}
-	p.nextToken()
-	params := []*ast.TypeIdentifierPair{}
-	if p.peekToken.Type == token.RPAREN {
+// parseParam parses `ty Ident`, curToken is the type keyword
+func (p *Parser) parseParam() *ast.TypeIdentifierPair {
+	param := &ast.TypeIdentifierPair{}
+	param.TypeLiteral = p.parseType()
+	if param.TypeLiteral == nil || !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	param.IdentifierLiteral = &ast.Identifier{Value: p.curToken}
+	return param
+}
+
+// parseDims parses `[UInt]{[UInt]}` following an array name
+func (p *Parser) parseDims() ([]int, bool) {
+	dims := []int{}
+	for p.peekToken.Type == token.LBRACKET {
 		p.nextToken()
-		fl.Param = params
+		if !p.expectPeek(token.INT) {
+			return nil, false
+		}
+		dim, _ := strconv.Atoi(p.curToken.Literal)
+		dims = append(dims, dim)
+		if !p.expectPeek(token.RBRACKET) {
+			return nil, false
+		}
+	}
+	return dims, true
+}
+
+// parseGlobal parses one global definition, a function, a global
+// variable or a global array
+func (p *Parser) parseGlobal() ast.Global {
+	globalType := p.parseType()
+	if globalType == nil || !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	name := &ast.Identifier{Value: p.curToken}
+	if p.peekToken.Type == token.LPAREN {
+		return p.parseFunctionLiteral(globalType, name)
+	} else if p.peekToken.Type == token.LBRACKET {
+		return p.parseGlobalArray(globalType, name)
+	}
+	return p.parseGlobalVar(globalType, name)
+}
+
+func (p *Parser) parseGlobalVar(varType *ast.Type, name *ast.Identifier) ast.Global {
+	gd := &ast.GlobalVarDef{VarType: varType, Name: name}
+	if p.peekToken.Type == token.ASSIGN {
 		p.nextToken()
-		fl.Body = p.parseBlockStatement()
-		return fl
-	} else {
 		p.nextToken()
-		param := &ast.TypeIdentifierPair{}
-		param.TypeLiteral = p.parseType()
+		gd.Value = p.parseExpression(0)
+		if gd.Value == nil {
+			return nil
+		}
+	}
+	if !p.expectPeek(token.SEMICOLON) {
+		return nil
+	}
+	return gd
+}
+
+func (p *Parser) parseGlobalArray(varType *ast.Type, name *ast.Identifier) ast.Global {
+	ga := &ast.GlobalArrayDef{VarType: varType, Name: name}
+	dims, ok := p.parseDims()
+	if !ok {
+		return nil
+	}
+	ga.Dims = dims
+	if p.peekToken.Type == token.ASSIGN {
 		p.nextToken()
-		param.IdentifierLiteral = &ast.Identifier{Value: p.curToken}
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		value, ok := p.parsePrefixExpression().(*ast.ArrayLiteral)
+		if !ok {
+			return nil
+		}
+		ga.Value = value
+	}
+	if !p.expectPeek(token.SEMICOLON) {
+		return nil
+	}
+	return ga
+}
+
+func (p *Parser) parseFunctionLiteral(returnType *ast.Type, name *ast.Identifier) ast.Global {
+	fl := &ast.FunctionLiteral{ReturnType: returnType, Name: name}
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	params := []*ast.TypeIdentifierPair{}
+	if p.peekToken.Type != token.RPAREN {
+		p.nextToken()
+		param := p.parseParam()
+		if param == nil {
+			return nil
+		}
 		params = append(params, param)
 		for p.peekToken.Type == token.COMMA {
 			p.nextToken()
 			p.nextToken()
-			param = &ast.TypeIdentifierPair{}
-			param.TypeLiteral = p.parseType()
-			p.nextToken()
-			param.IdentifierLiteral = &ast.Identifier{Value: p.curToken}
+			param = p.parseParam()
+			if param == nil {
+				return nil
+			}
 			params = append(params, param)
 		}
-		p.nextToken()
-		fl.Param = params
-		p.nextToken()
-		fl.Body = p.parseBlockStatement()
-		return fl
 	}
-	return nil
+	if !p.expectPeek(token.RPAREN) || !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	fl.Param = params
+	fl.Body = p.parseBlockStatement()
+	return fl
 }
 
+// ParseProgram parses the whole token list. Syntax errors are collected
+// in Diagnostics; the returned tree only holds the globals that parsed.
 func (p *Parser) ParseProgram() *ast.ProgramLiteral {
 	program := &ast.ProgramLiteral{}
-	global := []ast.Global{} 
+	global := []ast.Global{}
 	for p.curToken.Type != token.EOF {
-		global = append(global, p.parseFunctionLiteral())
+		if !isTypeKeyword(p.curToken.Type) {
+			p.diags.Errorf(diag.UnexpectedToken, p.curToken.Span,
+				"expected global definition, found %s", describe(p.curToken))
+			p.synchronizeGlobal()
+			continue
+		}
+		g := p.parseGlobal()
+		if g == nil {
+			p.synchronizeGlobal()
+			continue
+		}
+		global = append(global, g)
 		p.nextToken()
 	}
 	program.GlobalList = global
@@ -294,17 +602,16 @@ func (p *Parser) ParseProgram() *ast.ProgramLiteral {
 }
 
 func (p *Parser) parseType() *ast.Type {
-	varType := &ast.Type{Dtype: p.curToken}
-	if p.peekToken.Type == token.ASTERISK {
-		p.nextToken()
-		varType.Dimension = -1
-	} else if p.peekToken.Type == token.LBRACKET {
-		p.nextToken()
-		p.nextToken()
-		varType.Dimension, _ = strconv.Atoi(p.curToken.Literal)
+	if !isTypeKeyword(p.curToken.Type) {
+		p.diags.Errorf(diag.UnexpectedToken, p.curToken.Span,
+			"expected type, found %s", describe(p.curToken))
+		return nil
+	}
+	varType := &ast.Type{Dtype: p.curToken, Last: p.curToken}
+	for p.peekToken.Type == token.ASTERISK {
 		p.nextToken()
-	} else {
-		varType.Dimension = 0
+		varType.Pointer++
+		varType.Last = p.curToken
 	}
 	return varType
 }
@@ -0,0 +1,43 @@
+package parser
+
+import "cigrid/lexer"
+import "fmt"
+import "testing"
+
+// errors parses source and lists its syntax errors as "line:column code"
+func errors(source string) []string {
+	p := New(lexer.New("test.c", source).Scan())
+	p.ParseProgram()
+	result := []string{}
+	for _, d := range p.Diagnostics().Items() {
+		result = append(result, fmt.Sprintf("%d:%d %s", d.Span.Start.Line, d.Span.Start.Column, d.Code))
+	}
+	return result
+}
+
+// TestRecovery checks that every broken statement is reported, also when
+// the error is found at the first token of the next statement
+func TestRecovery(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []string
+	}{
+		{"int main() {\n\tint x = 1\n\tint y = 2 +;\n\treturn 0;\n}\n",
+			[]string{"3:2 E0101", "3:13 E0103"}},
+		{"int main() {\n\tint x = 1\n\treturn x\n}\n",
+			[]string{"3:2 E0101", "4:1 E0101"}},
+		{"int main() {\n\tx = ;\n\ty = ;\n\treturn 0;\n}\n",
+			[]string{"2:6 E0103", "3:6 E0103"}},
+		{"int main() {\n\tif (x { y = 1; }\n\twhile (1) { int z = ; }\n\treturn 0;\n}\n",
+			[]string{"2:8 E0101", "3:22 E0103"}},
+		{"int main() {\n\tint int;\n\tif (1) { x = 1; } else { y = ; }\n}\nint f() { return 0 }\n",
+			[]string{"2:6 E0101", "2:9 E0101", "3:31 E0103", "5:20 E0101"}},
+		{"int main() {\n\tint x = 1;\n\treturn x;\n}\n", []string{}},
+	}
+	for _, test := range tests {
+		got := errors(test.source)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%q:\ngot  %v\nwant %v", test.source, got, test.want)
+		}
+	}
+}
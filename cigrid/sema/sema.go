@@ -0,0 +1,343 @@
+package sema
+
+import "cigrid/ast"
+import "cigrid/diag"
+import "cigrid/types"
+import "strconv"
+
+type SymbolKind int
+
+// SymbolKind
+const (
+	Local SymbolKind = iota
+	Param
+	Global
+	Function
+	Builtin // functions from libc, e.g. printf
+)
+
+func (k SymbolKind) String() string {
+	switch k {
+	case Local:
+		return "local variable"
+	case Param:
+		return "parameter"
+	case Global:
+		return "global variable"
+	}
+	return "function"
+}
+
+// Symbol is a declared name. Every use of the name resolves to the same
+// *Symbol, so it can be used as a key by later stages.
+type Symbol struct {
+	Name     string      // name in the source
+	Unique   string      // unique name, x.2 for locals, g_x for globals
+	Kind     SymbolKind
+	Decl     ast.Node    // declaring node, nil for builtins
+	Type     *types.Type // variable type or function return type
+	Params   []*types.Type // function parameter types
+	Variadic bool        // takes any number of arguments after Params
+}
+
+// IsFunction tells whether calls to the symbol are allowed
+func (s *Symbol) IsFunction() bool {
+	return s.Kind == Function || s.Kind == Builtin
+}
+
+// Info is the resolved-symbol table of a program
+type Info struct {
+	Uses      map[*ast.Identifier]*Symbol     // every identifier, declarations included
+	Functions map[string]*Symbol
+	Types     map[ast.Expression]*types.Type  // filled by the type checker
+}
+
+// Symbol returns the symbol an identifier resolves to, nil if unresolved
+func (info *Info) Symbol(ident *ast.Identifier) *Symbol {
+	return info.Uses[ident]
+}
+
+// TypeOf returns the type of an expression before array decay, nil if
+// the expression was not checked or has an error
+func (info *Info) TypeOf(exp ast.Expression) *types.Type {
+	return info.Types[exp]
+}
+
+// builtins are the functions of the C library cigrid programs may call
+var builtins = []*Symbol{
+	{
+		Name: "printf",
+		Unique: "printf",
+		Kind: Builtin,
+		Type: types.IntType,
+		Params: []*types.Type{types.StringType},
+		Variadic: true,
+	},
+}
+
+type scope struct {
+	parent  *scope
+	symbols map[string]*Symbol
+}
+
+func (s *scope) lookup(name string) *Symbol {
+	for ; s != nil; s = s.parent {
+		if sym, ok := s.symbols[name]; ok {
+			return sym
+		}
+	}
+	return nil
+}
+
+// Analyzer resolves every identifier of a program with nested lexical
+// scopes: globals and functions, then the parameters and body of each
+// function, then one scope per block.
+type Analyzer struct {
+	tree     *ast.ProgramLiteral
+	info     *Info
+	scope    *scope
+	counter  map[string]int // declarations of each name in the function
+	diags    diag.List
+}
+
+func New(tree *ast.ProgramLiteral) *Analyzer {
+	return &Analyzer{
+		tree: tree,
+		info: &Info{
+			Uses: make(map[*ast.Identifier]*Symbol),
+			Functions: make(map[string]*Symbol),
+			Types: make(map[ast.Expression]*types.Type),
+		},
+	}
+}
+
+// Diagnostics returns the name resolution errors found by Analyze
+func (a *Analyzer) Diagnostics() *diag.List {
+	return &a.diags
+}
+
+func (a *Analyzer) openScope() {
+	a.scope = &scope{parent: a.scope, symbols: make(map[string]*Symbol)}
+}
+
+func (a *Analyzer) closeScope() {
+	a.scope = a.scope.parent
+}
+
+// declare adds sym to the innermost scope and reports a redeclaration
+func (a *Analyzer) declare(ident *ast.Identifier, sym *Symbol) {
+	if old, ok := a.scope.symbols[sym.Name]; ok {
+		d := a.diags.Errorf(diag.Redeclared, ident.Span(),
+			"`%s` is already declared in this scope", sym.Name)
+		if old.Decl != nil {
+			d.Note(old.Decl.Span(), "previous declaration of `%s`", sym.Name)
+		}
+	}
+	a.scope.symbols[sym.Name] = sym
+	a.info.Uses[ident] = sym
+}
+
+// declareLocal declares a parameter or local variable and gives it a
+// name that is unique in the function
+func (a *Analyzer) declareLocal(ident *ast.Identifier, sym *Symbol) {
+	a.counter[sym.Name]++
+	sym.Unique = sym.Name + "." + strconv.Itoa(a.counter[sym.Name])
+	a.declare(ident, sym)
+}
+
+// Analyze resolves the program. The result is complete even if errors
+// were reported, unresolved identifiers are simply missing.
+func (a *Analyzer) Analyze() *Info {
+	a.openScope()
+	for _, v := range builtins {
+		a.scope.symbols[v.Name] = v
+		a.info.Functions[v.Name] = v
+	}
+	// the global scope is nested in the builtin one, so a program may
+	// define its own printf
+	a.openScope()
+	// functions can be called before their definition
+	for _, value := range a.tree.GlobalList {
+		if v, ok := value.(*ast.FunctionLiteral); ok {
+			sym := &Symbol{
+				Name: v.Name.String(),
+				Unique: v.Name.String(),
+				Kind: Function,
+				Decl: v,
+				Type: types.FromAST(v.ReturnType, nil),
+				Params: paramTypes(v),
+			}
+			a.declare(v.Name, sym)
+			a.info.Functions[sym.Name] = sym
+		}
+	}
+	for _, value := range a.tree.GlobalList {
+		if v, ok := value.(*ast.GlobalVarDef); ok {
+			if v.Value != nil {
+				a.resolveExpression(v.Value)
+			}
+			a.declare(v.Name, &Symbol{
+				Name: v.Name.String(),
+				Unique: "g_" + v.Name.String(),
+				Kind: Global,
+				Decl: v,
+				Type: types.FromAST(v.VarType, nil),
+			})
+		} else if v, ok := value.(*ast.GlobalArrayDef); ok {
+			if v.Value != nil {
+				a.resolveExpression(v.Value)
+			}
+			a.declare(v.Name, &Symbol{
+				Name: v.Name.String(),
+				Unique: "g_" + v.Name.String(),
+				Kind: Global,
+				Decl: v,
+				Type: types.FromAST(v.VarType, v.Dims),
+			})
+		} else if v, ok := value.(*ast.FunctionLiteral); ok {
+			a.analyzeFunction(v)
+		}
+	}
+	a.closeScope()
+	a.closeScope()
+	return a.info
+}
+
+func paramTypes(fl *ast.FunctionLiteral) []*types.Type {
+	result := []*types.Type{}
+	for _, v := range fl.Param {
+		result = append(result, types.FromAST(v.TypeLiteral, nil))
+	}
+	return result
+}
+
+func (a *Analyzer) analyzeFunction(fl *ast.FunctionLiteral) {
+	a.counter = make(map[string]int)
+	// parameters live in the same scope as the outermost block
+	a.openScope()
+	for _, v := range fl.Param {
+		a.declareLocal(v.IdentifierLiteral, &Symbol{
+			Name: v.IdentifierLiteral.String(),
+			Kind: Param,
+			Decl: v,
+			Type: types.FromAST(v.TypeLiteral, nil),
+		})
+	}
+	for _, v := range fl.Body.Statements {
+		a.resolveStatement(v)
+	}
+	a.closeScope()
+}
+
+func (a *Analyzer) resolveBlock(bs *ast.BlockStatement) {
+	a.openScope()
+	for _, v := range bs.Statements {
+		a.resolveStatement(v)
+	}
+	a.closeScope()
+}
+
+func (a *Analyzer) resolveStatement(statement ast.Statement) {
+	if stmt, ok := statement.(*ast.VarDef); ok {
+		// the name is visible in its own initializer, as in C
+		a.declareLocal(stmt.Name, &Symbol{
+			Name: stmt.Name.String(),
+			Kind: Local,
+			Decl: stmt,
+			Type: types.FromAST(stmt.VarType, nil),
+		})
+		if stmt.Value != nil {
+			a.resolveExpression(stmt.Value)
+		}
+	} else if stmt, ok := statement.(*ast.ArrayDef); ok {
+		a.declareLocal(stmt.Name, &Symbol{
+			Name: stmt.Name.String(),
+			Kind: Local,
+			Decl: stmt,
+			Type: types.FromAST(stmt.VarType, stmt.Dims),
+		})
+		if stmt.Value != nil {
+			a.resolveExpression(stmt.Value)
+		}
+	} else if stmt, ok := statement.(*ast.VarAssign); ok {
+		a.resolveExpression(stmt.Left)
+		a.resolveExpression(stmt.Right)
+	} else if stmt, ok := statement.(*ast.ReturnStatement); ok {
+		if stmt.ReturnValue != nil {
+			a.resolveExpression(stmt.ReturnValue)
+		}
+	} else if stmt, ok := statement.(*ast.IfStatement); ok {
+		a.resolveExpression(stmt.Condition)
+		a.resolveBlock(stmt.Consequence)
+		if stmt.Alternative != nil {
+			a.resolveBlock(stmt.Alternative)
+		}
+	} else if stmt, ok := statement.(*ast.WhileStatement); ok {
+		a.resolveExpression(stmt.Condition)
+		a.resolveBlock(stmt.Consequence)
+	} else if stmt, ok := statement.(*ast.CallStatement); ok {
+		a.resolveExpression(stmt.Value)
+	} else if stmt, ok := statement.(*ast.BlockStatement); ok {
+		a.resolveBlock(stmt)
+	}
+}
+
+func (a *Analyzer) resolveExpression(expression ast.Expression) {
+	if exp, ok := expression.(*ast.Identifier); ok {
+		sym := a.scope.lookup(exp.Value.Literal)
+		if sym == nil {
+			a.diags.Errorf(diag.Undeclared, exp.Span(),
+				"cannot find `%s` in this scope", exp.Value.Literal)
+			return
+		} else if sym.IsFunction() {
+			a.diags.Errorf(diag.NotAVariable, exp.Span(),
+				"`%s` is a function, not a variable", exp.Value.Literal)
+			return
+		}
+		a.info.Uses[exp] = sym
+	} else if exp, ok := expression.(*ast.CallExpression); ok {
+		for _, v := range exp.Params {
+			a.resolveExpression(v)
+		}
+		sym := a.scope.lookup(exp.Name.String())
+		if sym == nil {
+			a.diags.Errorf(diag.UnknownFunction, exp.Name.Span(),
+				"cannot find function `%s`", exp.Name.String())
+			return
+		} else if !sym.IsFunction() {
+			d := a.diags.Errorf(diag.NotAFunction, exp.Name.Span(),
+				"`%s` is a %s, not a function", exp.Name.String(), sym.Kind)
+			if sym.Decl != nil {
+				d.Note(sym.Decl.Span(), "`%s` is declared here", sym.Name)
+			}
+			return
+		}
+		a.info.Uses[exp.Name] = sym
+		if len(exp.Params) != len(sym.Params) && 
+		   !(sym.Variadic && len(exp.Params) > len(sym.Params)) {
+			expected := strconv.Itoa(len(sym.Params))
+			if sym.Variadic {
+				expected = "at least " + expected
+			}
+			d := a.diags.Errorf(diag.ArgumentCount, exp.Span(),
+				"`%s` takes %s argument(s) but %d were given",
+				sym.Name, expected, len(exp.Params))
+			if sym.Decl != nil {
+				d.Note(sym.Decl.(*ast.FunctionLiteral).Name.Span(),
+					"`%s` is defined here", sym.Name)
+			}
+		}
+	} else if exp, ok := expression.(*ast.InfixExpression); ok {
+		a.resolveExpression(exp.Left)
+		a.resolveExpression(exp.Right)
+	} else if exp, ok := expression.(*ast.PrefixExpression); ok {
+		a.resolveExpression(exp.Right)
+	} else if exp, ok := expression.(*ast.IndexExpression); ok {
+		a.resolveExpression(exp.Left)
+		a.resolveExpression(exp.Index)
+	} else if exp, ok := expression.(*ast.ArrayLiteral); ok {
+		for _, v := range exp.Elements {
+			a.resolveExpression(v)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package sema
+
+import "cigrid/ast"
+import "cigrid/diag"
+import "cigrid/lexer"
+import "cigrid/parser"
+import "fmt"
+import "sort"
+import "testing"
+
+// analyze parses source, which must be free of syntax errors, and
+// resolves it
+func analyze(t *testing.T, source string) (*ast.ProgramLiteral, *Info, *diag.List) {
+	p := parser.New(lexer.New("test.c", source).Scan())
+	tree := p.ParseProgram()
+	if p.Diagnostics().HasErrors() {
+		t.Fatalf("%q does not parse", source)
+	}
+	a := New(tree)
+	info := a.Analyze()
+	return tree, info, a.Diagnostics()
+}
+
+// codes lists diagnostics as "line:column code"
+func codes(l *diag.List) []string {
+	result := []string{}
+	for _, d := range l.Items() {
+		result = append(result, fmt.Sprintf("%d:%d %s", d.Span.Start.Line, d.Span.Start.Column, d.Code))
+	}
+	return result
+}
+
+// TestShadowing checks which declaration each use of x resolves to: an
+// inner block may declare x again, and the outer x is back after it
+func TestShadowing(t *testing.T) {
+	_, info, diags := analyze(t, `int x;
+int main() {
+	x = 1;
+	int x = 2;
+	if (x) {
+		int x = 3;
+		x = x + 1;
+	}
+	x = 4;
+	return x;
+}
+int f(int x) {
+	return x;
+}
+`)
+	if diags.Len() > 0 {
+		t.Fatalf("unexpected diagnostics %v", codes(diags))
+	}
+	got := []string{}
+	for ident, sym := range info.Uses {
+		if ident.Value.Literal == "x" {
+			got = append(got, fmt.Sprintf("%02d:%02d %s", ident.Span().Start.Line,
+				ident.Span().Start.Column, sym.Unique))
+		}
+	}
+	sort.Strings(got)
+	want := []string{
+		"01:05 g_x",
+		"03:02 g_x",
+		"04:06 x.1", "05:06 x.1",
+		"06:07 x.2", "07:03 x.2", "07:07 x.2",
+		"09:02 x.1", "10:09 x.1",
+		"12:11 x.1", "13:09 x.1",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []string
+	}{
+		// a parameter shares the scope of the outermost block
+		{"int f(int a) {\n\tint a = 1;\n\treturn a;\n}\n", []string{"2:6 E0302"}},
+		{"int main() {\n\tint x = 1;\n\tint x = 2;\n\treturn 0;\n}\n", []string{"3:6 E0302"}},
+		{"int main() {\n\tif (1) { int y = 1; }\n\treturn y;\n}\n", []string{"3:9 E0301"}},
+		{"int main() {\n\th(1);\n\treturn 0;\n}\n", []string{"2:2 E0303"}},
+		{"int main() {\n\tint x = 1;\n\tx(1);\n\treturn 0;\n}\n", []string{"3:2 E0304"}},
+		{"int f() { return 0; }\nint main() {\n\tint x = f;\n\treturn 0;\n}\n", []string{"3:10 E0305"}},
+		{"int f(int a) { return a; }\nint main() {\n\treturn f(1, 2);\n}\n", []string{"3:9 E0306"}},
+		{"int main() {\n\tprintf(\"%d %d\\n\", 1, 2);\n\treturn 0;\n}\n", []string{}},
+		// functions may be called before their definition
+		{"int main() {\n\treturn f();\n}\nint f() { return 0; }\n", []string{}},
+	}
+	for _, test := range tests {
+		_, _, diags := analyze(t, test.source)
+		if got := codes(diags); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%q:\ngot  %v\nwant %v", test.source, got, test.want)
+		}
+	}
+}
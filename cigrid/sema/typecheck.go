@@ -0,0 +1,465 @@
+package sema
+
+import "cigrid/ast"
+import "cigrid/diag"
+import "cigrid/token"
+import "cigrid/types"
+import "strconv"
+
+// Checker annotates every expression of a resolved program with its type
+// and reports type errors. It runs after Analyze and relies on Info.Uses.
+type Checker struct {
+	tree     *ast.ProgramLiteral
+	info     *Info
+	function *Symbol // function being checked
+	diags    diag.List
+}
+
+func NewChecker(tree *ast.ProgramLiteral, info *Info) *Checker {
+	return &Checker{tree: tree, info: info}
+}
+
+// Diagnostics returns the type errors found by Check
+func (c *Checker) Diagnostics() *diag.List {
+	return &c.diags
+}
+
+// Check fills info.Types. An expression with an error gets no type, and
+// nothing is reported about the expressions around it, so one mistake
+// gives one diagnostic.
+func (c *Checker) Check() {
+	for _, value := range c.tree.GlobalList {
+		if v, ok := value.(*ast.GlobalVarDef); ok {
+			c.checkVarDef(v.Name, v.Value)
+		} else if v, ok := value.(*ast.GlobalArrayDef); ok {
+			c.checkArrayDef(v.Name, v.Value)
+		} else if v, ok := value.(*ast.FunctionLiteral); ok {
+			c.checkFunction(v)
+		}
+	}
+}
+
+func (c *Checker) checkFunction(fl *ast.FunctionLiteral) {
+	c.function = c.info.Symbol(fl.Name)
+	for _, v := range fl.Param {
+		sym := c.info.Symbol(v.IdentifierLiteral)
+		if sym != nil && sym.Type.Kind == types.Void {
+			c.diags.Errorf(diag.VoidVariable, v.Span(),
+				"parameter `%s` declared void", sym.Name)
+		}
+	}
+	c.checkBlock(fl.Body)
+	c.function = nil
+}
+
+func (c *Checker) checkBlock(bs *ast.BlockStatement) {
+	for _, v := range bs.Statements {
+		c.checkStatement(v)
+	}
+}
+
+// checkVarDef checks a scalar variable and its initializer
+func (c *Checker) checkVarDef(name *ast.Identifier, value ast.Expression) {
+	sym := c.info.Symbol(name)
+	if sym == nil {
+		return
+	}
+	if sym.Type.Kind == types.Void {
+		c.diags.Errorf(diag.VoidVariable, name.Span(),
+			"variable `%s` declared void", sym.Name)
+		return
+	}
+	if value == nil {
+		return
+	}
+	if _, ok := value.(*ast.ArrayLiteral); ok {
+		c.diags.Errorf(diag.TypeMismatch, value.Span(),
+			"cannot initialize `%s` with an array initializer", sym.Type)
+		return
+	}
+	c.assign(sym.Type, value, "mismatched types")
+}
+
+func (c *Checker) checkArrayDef(name *ast.Identifier, value *ast.ArrayLiteral) {
+	sym := c.info.Symbol(name)
+	if sym == nil {
+		return
+	}
+	if scalar(sym.Type).Kind == types.Void {
+		c.diags.Errorf(diag.VoidVariable, name.Span(),
+			"array `%s` has void elements", sym.Name)
+		return
+	}
+	if value != nil {
+		c.checkArrayLiteral(value, sym.Type)
+	}
+}
+
+// scalar returns the element type of a possibly nested array
+func scalar(t *types.Type) *types.Type {
+	for t.Kind == types.Array {
+		t = t.Elem
+	}
+	return t
+}
+
+// checkArrayLiteral checks an initializer of array type t. The shape is
+// checked by the translator, which also accepts flat initializers, so
+// only the element types matter here.
+func (c *Checker) checkArrayLiteral(lit *ast.ArrayLiteral, t *types.Type) {
+	for _, v := range lit.Elements {
+		if inner, ok := v.(*ast.ArrayLiteral); ok {
+			if t.Elem.Kind == types.Array {
+				c.checkArrayLiteral(inner, t.Elem)
+			}
+		} else {
+			c.assign(scalar(t), v, "mismatched types")
+		}
+	}
+}
+
+func (c *Checker) checkStatement(statement ast.Statement) {
+	if stmt, ok := statement.(*ast.VarDef); ok {
+		c.checkVarDef(stmt.Name, stmt.Value)
+	} else if stmt, ok := statement.(*ast.ArrayDef); ok {
+		c.checkArrayDef(stmt.Name, stmt.Value)
+	} else if stmt, ok := statement.(*ast.VarAssign); ok {
+		left := c.expr(stmt.Left)
+		if left == nil {
+			c.expr(stmt.Right)
+			return
+		}
+		if !c.isLvalue(stmt.Left) || left.Kind == types.Array {
+			c.diags.Errorf(diag.NotAssignable, stmt.Left.Span(),
+				"cannot assign to this expression of type `%s`", left)
+			c.expr(stmt.Right)
+			return
+		}
+		c.assign(left, stmt.Right, "mismatched types")
+	} else if stmt, ok := statement.(*ast.ReturnStatement); ok {
+		c.checkReturn(stmt)
+	} else if stmt, ok := statement.(*ast.IfStatement); ok {
+		c.condition(stmt.Condition)
+		c.checkBlock(stmt.Consequence)
+		if stmt.Alternative != nil {
+			c.checkBlock(stmt.Alternative)
+		}
+	} else if stmt, ok := statement.(*ast.WhileStatement); ok {
+		c.condition(stmt.Condition)
+		c.checkBlock(stmt.Consequence)
+	} else if stmt, ok := statement.(*ast.CallStatement); ok {
+		c.expr(stmt.Value)
+	} else if stmt, ok := statement.(*ast.BlockStatement); ok {
+		c.checkBlock(stmt)
+	}
+}
+
+func (c *Checker) checkReturn(stmt *ast.ReturnStatement) {
+	if c.function == nil {
+		if stmt.ReturnValue != nil {
+			c.expr(stmt.ReturnValue)
+		}
+		return
+	}
+	want := c.function.Type
+	if stmt.ReturnValue == nil {
+		if want.Kind != types.Void {
+			c.diags.Errorf(diag.ReturnType, stmt.Span(),
+				"`return` without a value in function returning `%s`", want)
+		}
+		return
+	}
+	if want.Kind == types.Void {
+		c.expr(stmt.ReturnValue)
+		c.diags.Errorf(diag.ReturnType, stmt.ReturnValue.Span(),
+			"`return` with a value in function `%s` returning void", c.function.Name)
+		return
+	}
+	d := c.assign(want, stmt.ReturnValue, "mismatched return type")
+	if d != nil {
+		d.Note(c.function.Decl.(*ast.FunctionLiteral).ReturnType.Span(),
+			"`%s` returns `%s`", c.function.Name, want)
+	}
+}
+
+// condition checks the condition of if and while
+func (c *Checker) condition(exp ast.Expression) {
+	t := c.expr(exp)
+	if t != nil && !t.Decay().IsScalar() {
+		c.diags.Errorf(diag.InvalidOperand, exp.Span(),
+			"condition has type `%s`, expected a scalar", t)
+	}
+}
+
+// assign checks that value can be stored in a location of type want and
+// returns the diagnostic it reported, if any
+func (c *Checker) assign(want *types.Type, value ast.Expression,
+						 what string) *diag.Diagnostic {
+	got := c.expr(value)
+	if got == nil || assignable(want, got, value) {
+		return nil
+	}
+	return c.diags.Errorf(diag.TypeMismatch, value.Span(),
+		"%s: expected `%s`, found `%s`", what, want, got)
+}
+
+// isNull tells whether exp is the null pointer constant 0
+func isNull(exp ast.Expression) bool {
+	lit, ok := exp.(*ast.IntegerLiteral)
+	return ok && lit.Value.Literal == "0"
+}
+
+// assignable tells whether a value of type got (written as exp) can be
+// stored in a location of type want. Arrays decay to pointers, 0 is a
+// null pointer and void* converts to and from any pointer.
+func assignable(want *types.Type, got *types.Type, exp ast.Expression) bool {
+	got = got.Decay()
+	if types.Identical(want, got) {
+		return true
+	}
+	if want.Kind != types.Pointer {
+		return false
+	}
+	if got.Kind == types.Int && isNull(exp) {
+		return true
+	}
+	return got.Kind == types.Pointer &&
+		(want.Elem.Kind == types.Void || got.Elem.Kind == types.Void)
+}
+
+// isLvalue tells whether exp designates a memory location
+func (c *Checker) isLvalue(exp ast.Expression) bool {
+	switch e := exp.(type) {
+	case *ast.Identifier:
+		return true
+	case *ast.IndexExpression:
+		return true
+	case *ast.PrefixExpression:
+		return e.Operator.Type == token.ASTERISK
+	}
+	return false
+}
+
+// pointee returns the type a pointer or array points to, nil if t
+// cannot be dereferenced
+func pointee(t *types.Type) *types.Type {
+	t = t.Decay()
+	if t.Kind != types.Pointer || t.Elem.Kind == types.Void {
+		return nil
+	}
+	return t.Elem
+}
+
+// expr checks an expression and records its type
+func (c *Checker) expr(expression ast.Expression) *types.Type {
+	var result *types.Type
+	switch exp := expression.(type) {
+	case *ast.IntegerLiteral:
+		if _, err := strconv.ParseInt(exp.Value.Literal, 10, 64); err != nil {
+			c.diags.Errorf(diag.IntegerOverflow, exp.Span(),
+				"integer literal `%s` does not fit in 64 bits", exp.Value.Literal)
+		}
+		result = types.IntType
+	case *ast.StringLiteral:
+		result = types.StringType
+	case *ast.Identifier:
+		if sym := c.info.Symbol(exp); sym != nil {
+			result = sym.Type
+		}
+	case *ast.CallExpression:
+		result = c.call(exp)
+	case *ast.InfixExpression:
+		result = c.infix(exp)
+	case *ast.PrefixExpression:
+		result = c.prefix(exp)
+	case *ast.IndexExpression:
+		left := c.expr(exp.Left)
+		index := c.expr(exp.Index)
+		if left == nil || index == nil {
+			return nil
+		}
+		result = pointee(left)
+		if result == nil {
+			c.diags.Errorf(diag.InvalidOperand, exp.Left.Span(),
+				"cannot index into a value of type `%s`", left)
+		} else if index.Decay().Kind != types.Int {
+			c.diags.Errorf(diag.InvalidOperand, exp.Index.Span(),
+				"array index has type `%s`, expected `int`", index)
+			result = nil
+		}
+	case *ast.ArrayLiteral:
+		c.diags.Errorf(diag.InvalidOperand, exp.Span(),
+			"an array initializer is only allowed in a declaration")
+	}
+	if result != nil {
+		c.info.Types[expression] = result
+	}
+	return result
+}
+
+func (c *Checker) call(exp *ast.CallExpression) *types.Type {
+	args := []*types.Type{}
+	for _, v := range exp.Params {
+		args = append(args, c.expr(v))
+	}
+	sym := c.info.Symbol(exp.Name)
+	if sym == nil {
+		return nil
+	}
+	for i, got := range args {
+		if got == nil {
+			continue
+		}
+		if i >= len(sym.Params) {
+			// the variadic part takes any value
+			if got.Kind == types.Void {
+				c.diags.Errorf(diag.ArgumentType, exp.Params[i].Span(),
+					"argument of `%s` has type `void`", sym.Name)
+			}
+			continue
+		}
+		if !assignable(sym.Params[i], got, exp.Params[i]) {
+			d := c.diags.Errorf(diag.ArgumentType, exp.Params[i].Span(),
+				"argument %d of `%s`: expected `%s`, found `%s`",
+				i + 1, sym.Name, sym.Params[i], got)
+			if fl, ok := sym.Decl.(*ast.FunctionLiteral); ok {
+				d.Note(fl.Param[i].Span(), "parameter declared here")
+			}
+		}
+	}
+	return sym.Type
+}
+
+func (c *Checker) prefix(exp *ast.PrefixExpression) *types.Type {
+	right := c.expr(exp.Right)
+	if right == nil {
+		return nil
+	}
+	switch exp.Operator.Type {
+	case token.MINUS:
+		if right.Kind == types.Int {
+			return types.IntType
+		}
+	case token.BANG:
+		if right.Decay().IsScalar() {
+			return types.IntType
+		}
+	case token.ET:
+		if c.isLvalue(exp.Right) {
+			return types.PointerTo(right)
+		}
+		c.diags.Errorf(diag.InvalidOperand, exp.Right.Span(),
+			"cannot take the address of this expression")
+		return nil
+	case token.ASTERISK:
+		if elem := pointee(right); elem != nil {
+			return elem
+		}
+		c.diags.Errorf(diag.InvalidOperand, exp.Span(),
+			"cannot dereference a value of type `%s`", right)
+		return nil
+	}
+	c.diags.Errorf(diag.InvalidOperand, exp.Span(),
+		"cannot apply unary `%s` to `%s`", exp.Operator.Literal, right)
+	return nil
+}
+
+func (c *Checker) infix(exp *ast.InfixExpression) *types.Type {
+	left := c.expr(exp.Left)
+	right := c.expr(exp.Right)
+	if left == nil || right == nil {
+		return nil
+	}
+	l, r := left.Decay(), right.Decay()
+	isInt := l.Kind == types.Int && r.Kind == types.Int
+	switch exp.Operator.Type {
+	case token.PLUS:
+		if isInt {
+			return types.IntType
+		} else if pointee(l) != nil && r.Kind == types.Int {
+			return l
+		} else if l.Kind == types.Int && pointee(r) != nil {
+			return r
+		}
+	case token.MINUS:
+		if isInt {
+			return types.IntType
+		} else if pointee(l) != nil && r.Kind == types.Int {
+			return l
+		} else if pointee(l) != nil && types.Identical(l, r) {
+			// distance between two pointers
+			return types.IntType
+		}
+	case token.ASTERISK:
+		if isInt {
+			return types.IntType
+		}
+	case token.SLASH, token.PERCENT:
+		if isInt {
+			if value, ok := Constant(exp.Right); ok && value == 0 {
+				what := "division"
+				if exp.Operator.Type == token.PERCENT {
+					what = "remainder"
+				}
+				c.diags.Warnf(diag.DivisionByZero, exp.Right.Span(),
+					"%s by zero is undefined", what)
+			}
+			return types.IntType
+		}
+	case token.LT, token.GT, token.L_EQ, token.G_EQ:
+		if isInt || (l.Kind == types.Pointer && types.Identical(l, r)) {
+			return types.IntType
+		}
+	case token.EQ, token.NOT_EQ:
+		if types.Identical(l, r) && l.IsScalar() ||
+		   assignable(l, r, exp.Right) && l.Kind == types.Pointer ||
+		   assignable(r, l, exp.Left) && r.Kind == types.Pointer {
+			return types.IntType
+		}
+	case token.AND, token.OR:
+		if l.IsScalar() && r.IsScalar() {
+			return types.IntType
+		}
+	}
+	c.diags.Errorf(diag.InvalidOperands, exp.Span(),
+		"cannot apply `%s` to `%s` and `%s`", exp.Operator.Literal, left, right)
+	return nil
+}
+
+// Constant computes the value of a constant integer expression: integer
+// literals combined with unary minus and + - * / %. A division by zero is
+// not constant.
+func Constant(expression ast.Expression) (int64, bool) {
+	if exp, ok := expression.(*ast.IntegerLiteral); ok {
+		value, err := strconv.ParseInt(exp.Value.Literal, 10, 64)
+		return value, err == nil
+	} else if exp, ok := expression.(*ast.PrefixExpression); ok {
+		value, ok := Constant(exp.Right)
+		if ok && exp.Operator.Type == token.MINUS {
+			return -value, true
+		}
+	} else if exp, ok := expression.(*ast.InfixExpression); ok {
+		left, ok1 := Constant(exp.Left)
+		right, ok2 := Constant(exp.Right)
+		if !ok1 || !ok2 {
+			return 0, false
+		}
+		switch exp.Operator.Type {
+		case token.PLUS:
+			return left + right, true
+		case token.MINUS:
+			return left - right, true
+		case token.ASTERISK:
+			return left * right, true
+		case token.SLASH:
+			if right != 0 {
+				return left / right, true
+			}
+		case token.PERCENT:
+			if right != 0 {
+				return left % right, true
+			}
+		}
+	}
+	return 0, false
+}
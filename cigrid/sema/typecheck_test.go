@@ -0,0 +1,67 @@
+package sema
+
+import "cigrid/diag"
+import "fmt"
+import "testing"
+
+// check resolves and type checks source, and lists what the checker
+// reports as "line:column code"
+func check(t *testing.T, source string) []string {
+	tree, info, diags := analyze(t, source)
+	if diags.HasErrors() {
+		t.Fatalf("%q: resolving failed: %v", source, codes(diags))
+	}
+	c := NewChecker(tree, info)
+	c.Check()
+	return codes(c.Diagnostics())
+}
+
+func TestTypeErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []string
+	}{
+		{"int main() { int *p = 1; return 0; }", []string{"1:23 E0401"}},
+		// 0 is the null pointer
+		{"int main() { int *p = 0; return p == 0; }", []string{}},
+		{"int main() { string s = 1; return 0; }", []string{"1:25 E0401"}},
+		{"int main() { int a[3]; a = 0; return 0; }", []string{"1:24 E0404"}},
+		{"int main() { int x = 1; int y = *x; return 0; }", []string{"1:33 E0403"}},
+		{"int main() { string s = \"a\"; int n = s + 1; return 0; }", []string{"1:38 E0402"}},
+		{"void f() { return; } int main() { int x = f(); return 0; }", []string{"1:43 E0401"}},
+		{"int main() { return \"a\"; }", []string{"1:21 E0401"}},
+		{"void f() { return 1; } int main() { return 0; }", []string{"1:19 E0405"}},
+		{"int main() { return; }", []string{"1:14 E0405"}},
+		{"int f(int *p) { return *p; } int main() { int x = 1; return f(x); }", []string{"1:63 E0406"}},
+		// a row of a two dimensional array is an array, which decays
+		{"int main() { int a[2][3]; int *p = a[1]; int q = a[1]; return 0; }", []string{"1:50 E0401"}},
+		{"int main() { int x; int *p = &x; int **pp = &p; **pp = 1; return *p; }", []string{}},
+		{"int main() { int *p; int *q; int d = p - q; int e = p + q; return 0; }", []string{"1:53 E0402"}},
+		{"int main() { int *p; int **q; return p == q; }", []string{"1:38 E0402"}},
+		{"int main() { string s = \"a\"; if (s) { return 1; } return s < s; }", []string{"1:58 E0402"}},
+		{"int main() { return 9223372036854775807; }", []string{}},
+		{"int main() { int x = 9223372036854775808; return 0; }", []string{"1:22 E0409"}},
+		{"int x = 99999999999999999999; int main() { return x; }", []string{"1:9 E0409"}},
+		// only warned about, the division may never run
+		{"int main() { int x = 5; return x / 0; }", []string{"1:36 W0401"}},
+		{"int main() { int x = 5; return x % (2 - 2); }", []string{"1:37 W0401"}},
+		{"int main() { int x = 5; return x / 1; }", []string{}},
+	}
+	for _, test := range tests {
+		if got := check(t, test.source); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%q:\ngot  %v\nwant %v", test.source, got, test.want)
+		}
+	}
+}
+
+// TestDivisionByZero checks that a constant zero divisor is a warning,
+// which does not stop the compilation
+func TestDivisionByZero(t *testing.T) {
+	tree, info, _ := analyze(t, "int main() { return 1 / 0; }")
+	c := NewChecker(tree, info)
+	c.Check()
+	items := c.Diagnostics().Items()
+	if len(items) != 1 || items[0].Severity != diag.Warning || c.Diagnostics().HasErrors() {
+		t.Errorf("got %v, want one warning", codes(c.Diagnostics()))
+	}
+}
@@ -1,16 +1,62 @@
 package token
 
+import "strconv"
+
 type TokenType string 
 
+// Position is a location in a source file. Line and Column start at 1,
+// Offset is the byte offset from the beginning of the file.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+	Offset int
+}
+
+func (p Position) String() string {
+	out := strconv.Itoa(p.Line) + ":" + strconv.Itoa(p.Column)
+	if p.File != "" {
+		out = p.File + ":" + out
+	}
+	return out
+}
+
+// Span covers the source text from Start up to (not including) End.
+type Span struct {
+	Start Position
+	End   Position
+}
+
+// Join returns the smallest span covering both s and other.
+func (s Span) Join(other Span) Span {
+	// a zero span (Line 0) carries no position
+	if other.Start.Line == 0 {
+		return s
+	} else if s.Start.Line == 0 {
+		return other
+	}
+	result := s
+	if other.Start.Offset < result.Start.Offset {
+		result.Start = other.Start
+	}
+	if other.End.Offset > result.End.Offset {
+		result.End = other.End
+	}
+	return result
+}
+
 type Token struct {
 	Type    TokenType 
 	Literal string
+	Span    Span
+	Trivia  []Token // comments before the token, only kept on request
 }
 
 // TokenType
 const (
 	ILLEGAL = "ILLEGAL"
 	EOF     = "EOF"
+	COMMENT = "COMMENT" // only appears in Token.Trivia
 
 	IDENT  = "IDENT"
 	INT    = "INT"
@@ -30,6 +76,7 @@ const (
 	MINUS = "-"
 	ASTERISK = "*"
 	SLASH = "/"
+	PERCENT = "%"
 	ET = "&"
 	AND = "&&"
 	OR = "||"
@@ -69,3 +116,28 @@ func LookupIdent(ident string) TokenType {
 	return IDENT
 }
 
+
+// Describe names a token type for error messages, e.g. "`;`", "`int`"
+// or "identifier".
+func Describe(tokType TokenType) string {
+	switch tokType {
+	case ILLEGAL:
+		return "unknown character"
+	case EOF:
+		return "end of file"
+	case IDENT:
+		return "identifier"
+	case INT:
+		return "integer literal"
+	case STRING:
+		return "string literal"
+	case COMMENT:
+		return "comment"
+	}
+	for k, v := range keywords {
+		if v == tokType {
+			return "`" + k + "`"
+		}
+	}
+	return "`" + string(tokType) + "`"
+}
@@ -0,0 +1,118 @@
+package types
+
+import "cigrid/ast"
+import "cigrid/token"
+import "strconv"
+
+type Kind int
+
+// Kind
+const (
+	Int Kind = iota
+	String
+	Void
+	Pointer
+	Array
+)
+
+// Type is a cigrid type. Every value is 8 bytes, so the size of a type
+// is 8 times the number of its scalar elements.
+type Type struct {
+	Kind Kind
+	Elem *Type // Pointer and Array
+	Len  int   // Array
+}
+
+var (
+	IntType    = &Type{Kind: Int}
+	StringType = &Type{Kind: String}
+	VoidType   = &Type{Kind: Void}
+)
+
+func PointerTo(elem *Type) *Type {
+	return &Type{Kind: Pointer, Elem: elem}
+}
+
+func ArrayOf(elem *Type, length int) *Type {
+	return &Type{Kind: Array, Elem: elem, Len: length}
+}
+
+// FromAST converts a declared type; dims are the array dimensions that
+// follow the declared name, as in int a[2][3].
+func FromAST(t *ast.Type, dims []int) *Type {
+	var result *Type
+	switch t.Dtype.Type {
+	case token.TINT:
+		result = IntType
+	case token.TSTRING:
+		result = StringType
+	default:
+		result = VoidType
+	}
+	for i := 0; i < t.Pointer; i++ {
+		result = PointerTo(result)
+	}
+	for i := len(dims) - 1; i >= 0; i-- {
+		result = ArrayOf(result, dims[i])
+	}
+	return result
+}
+
+func (t *Type) String() string {
+	switch t.Kind {
+	case Int:
+		return "int"
+	case String:
+		return "string"
+	case Void:
+		return "void"
+	case Pointer:
+		return t.Elem.String() + "*"
+	}
+	// int[2][3] is an array of 2 arrays of 3 ints
+	inner := t
+	suffix := ""
+	for inner.Kind == Array {
+		suffix += "[" + strconv.Itoa(inner.Len) + "]"
+		inner = inner.Elem
+	}
+	return inner.String() + suffix
+}
+
+// Identical reports whether a and b are the same type
+func Identical(a, b *Type) bool {
+	if a.Kind != b.Kind {
+		return false
+	}
+	switch a.Kind {
+	case Pointer:
+		return Identical(a.Elem, b.Elem)
+	case Array:
+		return a.Len == b.Len && Identical(a.Elem, b.Elem)
+	}
+	return true
+}
+
+// Size is the size of a value of type t in bytes
+func (t *Type) Size() int {
+	if t.Kind == Array {
+		return t.Len * t.Elem.Size()
+	} else if t.Kind == Void {
+		return 0
+	}
+	return 8
+}
+
+// Decay turns an array into a pointer to its first element, as happens
+// when an array is used as a value
+func (t *Type) Decay() *Type {
+	if t.Kind == Array {
+		return PointerTo(t.Elem)
+	}
+	return t
+}
+
+// IsScalar tells whether t can be used as a condition
+func (t *Type) IsScalar() bool {
+	return t.Kind == Int || t.Kind == Pointer || t.Kind == String
+}